@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+)
+
+var (
+	analyzeOutput = flag.String("analyze_output", "table", "Output format of the analyze subcommand. Supported: table and json.")
+
+	analyzeTop = flag.Int("analyze_top", 10, "Number of routes, paths, and clients reported by the analyze subcommand.")
+
+	analyzeWindow = flag.Duration("analyze_window", time.Minute, "Width of the windows over which the analyze subcommand reports error rates.")
+
+	analyzePercentiles = flag.String("analyze_percentiles", "50,90,99", "A comma-separated list of latency percentiles reported per route by the analyze subcommand.")
+)
+
+func parseAnalyzePercentiles() ([]float64, error) {
+	var percentiles []float64
+
+	if len(*analyzePercentiles) > 0 {
+		for _, elem := range strings.Split(*analyzePercentiles, ",") {
+			p, err := strconv.ParseFloat(elem, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse percentile: %v", err)
+			}
+			percentiles = append(percentiles, p)
+		}
+	}
+
+	return percentiles, nil
+}
+
+// writeReportTable writes the supplied report as human-readable tables.
+func writeReportTable(out io.Writer, report *consumer.Report) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Lines read:\t%d\n", report.Lines)
+	fmt.Fprintf(w, "Requests parsed:\t%d\n", report.Requests)
+
+	fmt.Fprintf(w, "\nSTATUS CLASS\tREQUESTS\tFRACTION\n")
+	for _, c := range report.StatusClasses {
+		fmt.Fprintf(w, "%s\t%d\t%.4f\n", c.Class, c.Requests, float64(c.Requests)/float64(report.Requests))
+	}
+
+	fmt.Fprintf(w, "\nMETHOD\tROUTE\tREQUESTS")
+	if len(report.Routes) > 0 {
+		for _, p := range report.Routes[0].Latencies {
+			fmt.Fprintf(w, "\tP%s (s)", strconv.FormatFloat(p.Percentile, 'g', -1, 64))
+		}
+	}
+	fmt.Fprintf(w, "\n")
+	for _, r := range report.Routes {
+		fmt.Fprintf(w, "%s\t%s\t%d", r.Method, r.Path, r.Requests)
+		for _, p := range r.Latencies {
+			fmt.Fprintf(w, "\t%.3f", p.Seconds)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "\nPATH\tREQUESTS\tERROR RATE\n")
+	for _, p := range report.Paths {
+		fmt.Fprintf(w, "%s\t%d\t%.4f\n", p.Path, p.Requests, p.ErrorRate)
+	}
+
+	fmt.Fprintf(w, "\nCLIENT\tREQUESTS\n")
+	for _, c := range report.Clients {
+		fmt.Fprintf(w, "%s\t%d\n", c.Client, c.Requests)
+	}
+
+	fmt.Fprintf(w, "\nWINDOW START\tREQUESTS\tERRORS\tERROR RATE\n")
+	for _, e := range report.ErrorRates {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.4f\n", e.Start.Format(time.RFC3339), e.Requests, e.Errors, e.ErrorRate)
+	}
+
+	writeReasonCounts(w, "PARSE ERROR", report.ParseErrors)
+	writeReasonCounts(w, "SKIPPED", report.Skipped)
+
+	return w.Flush()
+}
+
+// writeReasonCounts writes a table of the supplied counts, ordered by reason.
+func writeReasonCounts(w io.Writer, heading string, counts map[string]uint64) {
+	var reasons []string
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintf(w, "\n%s\tCOUNT\n", heading)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s\t%d\n", reason, counts[reason])
+	}
+}
+
+// analyze implements the analyze subcommand, which prints a summary of one or
+// more access logs.
+func analyze(args []string) {
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s analyze [flags] LOG...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+
+	logs := flag.Args()
+	if len(logs) == 0 {
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+
+	if *analyzeOutput != "table" && *analyzeOutput != "json" {
+		log.Fatalf("Unsupported output format: \"%s\"", *analyzeOutput)
+	}
+
+	percentiles, err := parseAnalyzePercentiles()
+	if err != nil {
+		log.Fatalf("Could not parse percentiles: %v", err)
+	}
+
+	a, err := consumer.NewAnalyzer(*accessLogFormat, consumer.AnalyzeOptions{
+		N:           *analyzeTop,
+		Window:      *analyzeWindow,
+		Percentiles: percentiles,
+		Clients: consumer.TopClientsOptions{
+			Field:         *topClientsField,
+			IPv4PrefixLen: *topClientsIPv4Prefix,
+			IPv6PrefixLen: *topClientsIPv6Prefix,
+		},
+	})
+	if err != nil {
+		log.Fatalf("Could not create analyzer: %v", err)
+	}
+
+	for _, path := range logs {
+		r, err := openLog(path)
+		if err != nil {
+			log.Fatalf("Could not open %s: %v", path, err)
+		}
+		if err := a.ConsumeReader(r); err != nil {
+			log.Fatalf("Failure reading %s: %v", path, err)
+		}
+		r.Close()
+	}
+
+	report := a.Report()
+	if *analyzeOutput == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeReportTable(os.Stdout, report)
+	}
+	if err != nil {
+		log.Fatalf("Could not write report: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+	"github.com/swfrench/nginx-log-exporter/internal/openmetrics"
+)
+
+var (
+	backfillStep = flag.Duration("backfill_step", time.Minute, "Interval between the timestamped samples written by the backfill subcommand.")
+
+	backfillAllowedLateness = flag.Duration("backfill_allowed_lateness", 5*time.Minute, "Period by which lines may be logged out of order (e.g. across logs) and still be counted by the backfill subcommand, after which they are dropped.")
+
+	backfillOutput = flag.String("backfill_output", "", "Path to which the backfill subcommand writes OpenMetrics output. Defaults to stdout.")
+)
+
+// openLog opens the log at the supplied path, decompressing it if gzipped
+// (e.g. as rotated by logrotate with compress).
+func openLog(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not read gzipped log %s: %v", path, err)
+		}
+		return &gzipLog{Reader: z, file: f}, nil
+	}
+
+	return &plainLog{Reader: r, file: f}, nil
+}
+
+type plainLog struct {
+	*bufio.Reader
+	file *os.File
+}
+
+func (l *plainLog) Close() error {
+	return l.file.Close()
+}
+
+type gzipLog struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (l *gzipLog) Close() error {
+	if err := l.Reader.Close(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// backfill implements the backfill subcommand, which reads historical access
+// logs (in order of their first logged timestamp) and writes their response metrics as timestamped OpenMetrics
+// samples, e.g. for `promtool tsdb create-blocks-from openmetrics`.
+func backfill(args []string) {
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s backfill [flags] LOG...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+
+	logs := flag.Args()
+	if len(logs) == 0 {
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+
+	labels, err := parseCustomLabels()
+	if err != nil {
+		log.Fatalf("Could not parse custom labels: %v", err)
+	}
+
+	paths, err := parseMonitoredPaths()
+	if err != nil {
+		log.Fatalf("Could not parse monitored paths: %v", err)
+	}
+
+	buckets, err := parseHistogramBuckets()
+	if err != nil {
+		log.Fatalf("Could not parse histogram buckets: %v", err)
+	}
+
+	w := os.Stdout
+	if len(*backfillOutput) > 0 {
+		if w, err = os.Create(*backfillOutput); err != nil {
+			log.Fatalf("Could not create output file: %v", err)
+		}
+	}
+
+	// The samples of each family are buffered in temporary files (under
+	// $TMPDIR) until all logs are read, rather than in memory.
+	writer := openmetrics.NewTempFileWriter(w, "")
+	opts := consumer.Options{
+		Buckets: buckets,
+		Windows: &consumer.WindowOptions{
+			Width:           *backfillStep,
+			AllowedLateness: *backfillAllowedLateness,
+			Sink:            writer,
+			Labels:          labels,
+		},
+		Backfill: true,
+	}
+
+	if err := addResponseLabelOptions(&opts); err != nil {
+		log.Fatalf("Could not configure response labels: %v", err)
+	}
+
+	// Metrics are aggregated into windows alongside the usual (unused)
+	// metrics, which are registered with a private registry.
+	m := metrics.NewManager(nil, nil, nil)
+
+	c, err := consumer.NewConsumer(*backfillStep, nil, m, paths, *accessLogFormat, opts)
+	if err != nil {
+		log.Fatalf("Could not create consumer: %v", err)
+	}
+
+	if err := c.ConsumeLogs(logs, openLog); err != nil {
+		log.Fatalf("Could not backfill logs: %v", err)
+	}
+
+	if err := c.Flush(); err != nil {
+		log.Fatalf("Could not flush windows: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Could not write output: %v", err)
+	}
+}
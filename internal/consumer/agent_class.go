@@ -0,0 +1,171 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	// Name of the label added to HTTP response metrics by agent
+	// classification.
+	agentClassLabel = "agent_class"
+
+	// Class reported for user agents matching no rule (or absent).
+	agentClassUnknown = "unknown"
+
+	// Default log field containing the user agent.
+	defaultAgentClassField = "http_user_agent"
+)
+
+// AgentRule maps user agents matching Pattern to Class.
+type AgentRule struct {
+	Class   string
+	Pattern *regexp.Regexp
+}
+
+// DefaultAgentRules are the built-in user agent classification rules, used
+// when no rule file is configured. Rules are evaluated in order, such that
+// e.g. monitoring services are not reported as generic crawlers.
+var DefaultAgentRules = []AgentRule{
+	{"monitoring", regexp.MustCompile(`(?i)uptimerobot|pingdom|statuscake|site24x7|datadog|newrelicpinger|kube-probe|elb-healthchecker|googlehc|blackbox.exporter|nagios|zabbix`)},
+	{"crawler", regexp.MustCompile(`(?i)bot\b|crawl|spider|slurp|facebookexternalhit|mediapartners|archiver`)},
+	{"library", regexp.MustCompile(`(?i)^(curl|wget|python-requests|python-urllib|python-httpx|aiohttp|go-http-client|okhttp|java|apache-httpclient|libwww-perl|axios|node-fetch|ruby|php)\b`)},
+	{"mobile", regexp.MustCompile(`(?i)mobile|android|iphone|ipad|ipod|opera mini|iemobile`)},
+	{"desktop", regexp.MustCompile(`(?i)^mozilla/|^opera/`)},
+}
+
+// agentRuleConfig is the JSON representation of an AgentRule.
+type agentRuleConfig struct {
+	Class   string `json:"class"`
+	Pattern string `json:"pattern"`
+}
+
+// ParseAgentRules parses a JSON list of user agent classification rules (see
+// README.md), e.g.:
+//
+//	[{"class": "crawler", "pattern": "(?i)googlebot|bingbot"}, {"class": "library", "pattern": "^curl/"}]
+func ParseAgentRules(b []byte) ([]AgentRule, error) {
+	var configs []agentRuleConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("could not parse agent rules: %v", err)
+	}
+
+	var rules []AgentRule
+	for _, config := range configs {
+		if config.Class == "" {
+			return nil, fmt.Errorf("agent rule class must be non-empty")
+		}
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse pattern for agent class %s: %v", config.Class, err)
+		}
+		rules = append(rules, AgentRule{
+			Class:   config.Class,
+			Pattern: pattern,
+		})
+	}
+
+	return rules, nil
+}
+
+// AgentClassOptions configures classification of user agents, exported as the
+// "agent_class" label on the response count metrics.
+type AgentClassOptions struct {
+	// Field names the log field containing the user agent. Defaults to
+	// "http_user_agent", which is also available in CLF format when the
+	// combined log format is used.
+	Field string
+	// RulesPath, if non-empty, is a file containing classification rules
+	// (see ParseAgentRules), used in place of DefaultAgentRules. The file is
+	// reloaded when modified.
+	RulesPath string
+}
+
+func (o *AgentClassOptions) setDefaults() {
+	if o.Field == "" {
+		o.Field = defaultAgentClassField
+	}
+}
+
+// agentClassifier is a labeler classifying the user agent of each line.
+type agentClassifier struct {
+	opts    AgentClassOptions
+	rules   []AgentRule
+	modTime time.Time
+}
+
+func newAgentClassifier(opts AgentClassOptions) (*agentClassifier, error) {
+	a := &agentClassifier{
+		opts:  opts,
+		rules: DefaultAgentRules,
+	}
+	if opts.RulesPath != "" {
+		if _, err := a.load(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// load (re)loads rules from the configured rule file if it has been modified
+// since last loaded, returning true if so.
+func (a *agentClassifier) load() (bool, error) {
+	info, err := os.Stat(a.opts.RulesPath)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(a.modTime) {
+		return false, nil
+	}
+	b, err := ioutil.ReadFile(a.opts.RulesPath)
+	if err != nil {
+		return false, err
+	}
+	rules, err := ParseAgentRules(b)
+	if err != nil {
+		return false, err
+	}
+	a.rules = rules
+	a.modTime = info.ModTime()
+	return true, nil
+}
+
+// classify returns the class of the supplied user agent.
+func (a *agentClassifier) classify(agent string) string {
+	if agent == "" || agent == "-" {
+		return agentClassUnknown
+	}
+	for _, rule := range a.rules {
+		if rule.Pattern.MatchString(agent) {
+			return rule.Class
+		}
+	}
+	return agentClassUnknown
+}
+
+func (a *agentClassifier) labelNames() []string {
+	return []string{agentClassLabel}
+}
+
+func (a *agentClassifier) labels(line *parsedLogLine) map[string]string {
+	return map[string]string{
+		agentClassLabel: a.classify(line.Fields[a.opts.Field]),
+	}
+}
+
+func (a *agentClassifier) refresh() {
+	if a.opts.RulesPath == "" {
+		return
+	}
+	if loaded, err := a.load(); err != nil {
+		// Note: The previously loaded rules remain in effect.
+		log.Printf("Could not reload agent rules from %s: %v", a.opts.RulesPath, err)
+	} else if loaded {
+		log.Printf("Reloaded agent rules from %s", a.opts.RulesPath)
+	}
+}
@@ -0,0 +1,64 @@
+package consumer_test
+
+import (
+	"testing"
+
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+)
+
+func TestParseAgentRules(t *testing.T) {
+	rules, err := consumer.ParseAgentRules([]byte(`[
+		{"class": "crawler", "pattern": "(?i)googlebot"},
+		{"class": "library", "pattern": "^curl/"}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseAgentRules returned unexpected error: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d: %v", len(rules), rules)
+	}
+	if rules[0].Class != "crawler" || !rules[0].Pattern.MatchString("Googlebot/2.1") {
+		t.Errorf("Unexpected rule: %+v", rules[0])
+	}
+	if rules[1].Class != "library" || !rules[1].Pattern.MatchString("curl/7.68.0") {
+		t.Errorf("Unexpected rule: %+v", rules[1])
+	}
+}
+
+func TestParseAgentRulesInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"class": "crawler"}`,
+		`[{"pattern": "bot"}]`,
+		`[{"class": "crawler", "pattern": "("}]`,
+	} {
+		if rules, err := consumer.ParseAgentRules([]byte(config)); err == nil {
+			t.Errorf("Expected ParseAgentRules to fail for config %s, got: %v", config, rules)
+		}
+	}
+}
+
+func TestDefaultAgentRules(t *testing.T) {
+	classify := func(agent string) string {
+		for _, rule := range consumer.DefaultAgentRules {
+			if rule.Pattern.MatchString(agent) {
+				return rule.Class
+			}
+		}
+		return ""
+	}
+	for agent, want := range map[string]string{
+		"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)": "crawler",
+		"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)":      "crawler",
+		"Pingdom.com_bot_version_1.4_(http://www.pingdom.com/)":                   "monitoring",
+		"kube-probe/1.27": "monitoring",
+		"Wget/1.21.2":     "library",
+		"okhttp/4.9.3":    "library",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile": "mobile",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_2) AppleWebKit/605.1.15 (KHTML, like Gecko) Safari/605.1":  "desktop",
+		"SomethingElse/1.0": "",
+	} {
+		if got := classify(agent); got != want {
+			t.Errorf("Expected agent %q to be classified as %q, got %q", agent, want, got)
+		}
+	}
+}
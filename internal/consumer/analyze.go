@@ -0,0 +1,391 @@
+package consumer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// Defaults for AnalyzeOptions.
+	defaultAnalyzeN      = 10
+	defaultAnalyzeWindow = time.Minute
+)
+
+var (
+	// Default percentiles reported per route.
+	defaultAnalyzePercentiles = []float64{50, 90, 99}
+)
+
+// AnalyzeOptions configures an Analyzer.
+type AnalyzeOptions struct {
+	// N is the number of routes, paths, and clients reported. Defaults to 10.
+	N int
+	// Window is the width of the windows over which error rates are
+	// reported. Defaults to one minute.
+	Window time.Duration
+	// Percentiles are the latency percentiles reported per route (each in
+	// (0, 100]). Defaults to 50, 90, and 99.
+	Percentiles []float64
+	// Clients configures the identification of clients, as for top clients
+	// (N and Capacity are ignored).
+	Clients TopClientsOptions
+}
+
+func (o *AnalyzeOptions) setDefaults() {
+	if o.N == 0 {
+		o.N = defaultAnalyzeN
+	}
+	if o.Window == 0 {
+		o.Window = defaultAnalyzeWindow
+	}
+	if len(o.Percentiles) == 0 {
+		o.Percentiles = defaultAnalyzePercentiles
+	}
+	o.Clients.N = o.N
+}
+
+func (o *AnalyzeOptions) validate() error {
+	if o.N < 0 {
+		return fmt.Errorf("number of reported entries must be positive, got %d", o.N)
+	}
+	if o.Window < 0 {
+		return fmt.Errorf("error rate window must be positive, got %v", o.Window)
+	}
+	for _, p := range o.Percentiles {
+		if !(p > 0 && p <= 100) {
+			return fmt.Errorf("percentiles must be in (0, 100], got %v", p)
+		}
+	}
+	return nil
+}
+
+// StatusClassCount reports the number of requests of a status class (e.g.
+// "2xx").
+type StatusClassCount struct {
+	Class    string `json:"class"`
+	Requests uint64 `json:"requests"`
+}
+
+// Percentile reports a single latency percentile.
+type Percentile struct {
+	Percentile float64 `json:"percentile"`
+	Seconds    float64 `json:"seconds"`
+}
+
+// RouteStats reports request statistics for a single route, i.e. a method and
+// normalized path (as for top paths).
+type RouteStats struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Requests uint64 `json:"requests"`
+	// Latencies is empty if no response durations were logged (e.g. CLF).
+	Latencies []Percentile `json:"latencies,omitempty"`
+}
+
+// AnalyzedPathStats reports request statistics for a single normalized path.
+type AnalyzedPathStats struct {
+	Path      string  `json:"path"`
+	Requests  uint64  `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// ClientStats reports the number of requests issued by a single client.
+type ClientStats struct {
+	Client   string `json:"client"`
+	Requests uint64 `json:"requests"`
+}
+
+// WindowErrorRate reports the fraction of requests logged within a window
+// having a 5xx status.
+type WindowErrorRate struct {
+	Start     time.Time `json:"start"`
+	Requests  uint64    `json:"requests"`
+	Errors    uint64    `json:"errors"`
+	ErrorRate float64   `json:"error_rate"`
+}
+
+// Report is the result of analyzing one or more logs.
+type Report struct {
+	// Lines is the number of lines read.
+	Lines uint64 `json:"lines"`
+	// Requests is the number of lines parsed.
+	Requests      uint64             `json:"requests"`
+	StatusClasses []StatusClassCount `json:"status_classes"`
+	// Routes, Paths, and Clients report those with the most requests.
+	Routes     []RouteStats        `json:"routes"`
+	Paths      []AnalyzedPathStats `json:"paths"`
+	Clients    []ClientStats       `json:"clients"`
+	ErrorRates []WindowErrorRate   `json:"error_rates"`
+	// ParseErrors reports the number of parse errors by reason, as in
+	// ParseErrorsMetricName.
+	ParseErrors map[string]uint64 `json:"parse_errors"`
+	// Skipped reports the number of requests excluded from Routes and Paths
+	// by reason, as in LinesSkippedMetricName.
+	Skipped map[string]uint64 `json:"skipped"`
+}
+
+// routeData holds the requests and response durations of a route.
+type routeData struct {
+	method    string
+	path      string
+	requests  uint64
+	latencies []float64
+}
+
+// windowData holds the request and error counts of a window.
+type windowData struct {
+	requests uint64
+	errors   uint64
+}
+
+// Analyzer computes summary statistics over access logs (see Report), by
+// consuming them with a Consumer, such that parsing and normalization are
+// identical. Unlike a Consumer, all statistics are exact, and so memory use
+// grows with the number of distinct paths, clients, and windows.
+type Analyzer struct {
+	opts        AnalyzeOptions
+	consumer    *Consumer
+	report      Report
+	classes     map[string]uint64
+	routes      map[string]*routeData
+	paths       map[string]*pathData
+	clientCount map[string]uint64
+	windows     map[int64]*windowData
+}
+
+// NewAnalyzer returns an Analyzer for access logs of the supplied format
+// ("JSON" or "CLF").
+func NewAnalyzer(format string, opts AnalyzeOptions) (*Analyzer, error) {
+	opts.setDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if format == StreamFormat || format == ErrorLogFormat {
+		return nil, fmt.Errorf("unsupported log format: \"%s\"", format)
+	}
+
+	a := &Analyzer{
+		opts:        opts,
+		classes:     make(map[string]uint64),
+		routes:      make(map[string]*routeData),
+		paths:       make(map[string]*pathData),
+		clientCount: make(map[string]uint64),
+		windows:     make(map[int64]*windowData),
+	}
+	a.report.ParseErrors = make(map[string]uint64)
+	a.report.Skipped = make(map[string]uint64)
+
+	// Clients are identified as for top clients, while the usual (unused)
+	// metrics are registered with a private registry.
+	clients := opts.Clients
+	c, err := NewConsumer(0, nil, metrics.NewManager(nil, nil, nil), nil, format, Options{
+		TopClients: &clients,
+		Backfill:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.sink = a
+	a.consumer = c
+
+	return a, nil
+}
+
+// ConsumeReader analyzes all lines read from r.
+func (a *Analyzer) ConsumeReader(r io.Reader) error {
+	return a.consumer.ConsumeReader(r)
+}
+
+// consumeStats records the line counts, parse errors, and skipped requests of
+// a batch of lines consumed.
+func (a *Analyzer) consumeStats(stats *logStats) {
+	a.report.Lines += uint64(stats.linesRead)
+	a.report.Requests += uint64(stats.linesParsed)
+	for reason, count := range stats.parseErrors.counts {
+		a.report.ParseErrors[reason] += uint64(count.total)
+	}
+	for reason, count := range stats.linesSkipped.counts {
+		a.report.Skipped[reason] += uint64(count.total)
+	}
+}
+
+// consumeLine analyzes a single consumed line, having the supplied method and
+// path (empty if the request is malformed).
+func (a *Analyzer) consumeLine(line *parsedLogLine, method, path string) {
+	class := "other"
+	if len(line.Status) == 3 && line.Status[0] >= '1' && line.Status[0] <= '5' {
+		class = line.Status[:1] + "xx"
+	}
+	a.classes[class]++
+
+	isError := strings.HasPrefix(line.Status, "5")
+	start := line.Time.Truncate(a.opts.Window).UnixNano()
+	w, ok := a.windows[start]
+	if !ok {
+		w = &windowData{}
+		a.windows[start] = w
+	}
+	w.requests++
+	if isError {
+		w.errors++
+	}
+
+	clients := a.consumer.topClients
+	if value, ok := line.Fields[clients.opts.Field]; ok && value != "" && value != "-" {
+		a.clientCount[clients.client(value)]++
+	}
+
+	if path == "" {
+		return
+	}
+	path = normalizePath(path)
+
+	p, ok := a.paths[path]
+	if !ok {
+		p = &pathData{}
+		a.paths[path] = p
+	}
+	p.requests++
+	if isError {
+		p.errors++
+	}
+
+	key := method + " " + path
+	r, ok := a.routes[key]
+	if !ok {
+		r = &routeData{
+			method: method,
+			path:   path,
+		}
+		a.routes[key] = r
+	}
+	r.requests++
+	if line.RequestTime >= 0 {
+		r.latencies = append(r.latencies, line.RequestTime)
+	}
+}
+
+// topKeys returns up to n keys of the supplied counts, in decreasing order of
+// count (and then by key).
+func topKeys(counts map[string]uint64, n int) []string {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// percentile returns the supplied percentile of sorted values, per the
+// nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Report returns the statistics of all lines analyzed.
+func (a *Analyzer) Report() *Report {
+	report := a.report
+	report.ParseErrors = make(map[string]uint64)
+	for reason, n := range a.report.ParseErrors {
+		report.ParseErrors[reason] = n
+	}
+	report.Skipped = make(map[string]uint64)
+	for reason, n := range a.report.Skipped {
+		report.Skipped[reason] = n
+	}
+	report.StatusClasses = []StatusClassCount{}
+	report.Routes = []RouteStats{}
+	report.Paths = []AnalyzedPathStats{}
+	report.Clients = []ClientStats{}
+	report.ErrorRates = []WindowErrorRate{}
+
+	var classes []string
+	for class := range a.classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		report.StatusClasses = append(report.StatusClasses, StatusClassCount{
+			Class:    class,
+			Requests: a.classes[class],
+		})
+	}
+
+	routeCounts := make(map[string]uint64)
+	for key, r := range a.routes {
+		routeCounts[key] = r.requests
+	}
+	for _, key := range topKeys(routeCounts, a.opts.N) {
+		r := a.routes[key]
+		stats := RouteStats{
+			Method:   r.method,
+			Path:     r.path,
+			Requests: r.requests,
+		}
+		if len(r.latencies) > 0 {
+			sort.Float64s(r.latencies)
+			for _, p := range a.opts.Percentiles {
+				stats.Latencies = append(stats.Latencies, Percentile{
+					Percentile: p,
+					Seconds:    percentile(r.latencies, p),
+				})
+			}
+		}
+		report.Routes = append(report.Routes, stats)
+	}
+
+	pathCounts := make(map[string]uint64)
+	for path, p := range a.paths {
+		pathCounts[path] = p.requests
+	}
+	for _, path := range topKeys(pathCounts, a.opts.N) {
+		p := a.paths[path]
+		report.Paths = append(report.Paths, AnalyzedPathStats{
+			Path:      path,
+			Requests:  p.requests,
+			ErrorRate: float64(p.errors) / float64(p.requests),
+		})
+	}
+
+	for _, client := range topKeys(a.clientCount, a.opts.N) {
+		report.Clients = append(report.Clients, ClientStats{
+			Client:   client,
+			Requests: a.clientCount[client],
+		})
+	}
+
+	var starts []int64
+	for start := range a.windows {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		w := a.windows[start]
+		report.ErrorRates = append(report.ErrorRates, WindowErrorRate{
+			Start:     time.Unix(0, start).UTC(),
+			Requests:  w.requests,
+			Errors:    w.errors,
+			ErrorRate: float64(w.errors) / float64(w.requests),
+		})
+	}
+
+	return &report
+}
@@ -0,0 +1,121 @@
+package consumer_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+)
+
+func TestAnalyzer(t *testing.T) {
+	a, err := consumer.NewAnalyzer("JSON", consumer.AnalyzeOptions{
+		N:           2,
+		Percentiles: []float64{50, 100},
+		Clients: consumer.TopClientsOptions{
+			IPv4PrefixLen: 24,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAnalyzer returned unexpected error: %v", err)
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		offset      time.Duration
+		request     string
+		status      string
+		requestTime float64
+		remoteAddr  string
+	}{
+		{0, "GET /users/1 HTTP/1.1", "200", 0.1, "10.0.0.1"},
+		{10 * time.Second, "GET /users/2 HTTP/1.1", "200", 0.2, "10.0.0.2"},
+		{20 * time.Second, "GET /users/3 HTTP/1.1", "500", 0.3, "10.0.1.1"},
+		{30 * time.Second, "GET /users/4 HTTP/1.1", "200", 0.4, "10.0.0.3"},
+		{70 * time.Second, "POST /users HTTP/1.1", "201", 0.5, "10.0.1.2"},
+		{80 * time.Second, "GET / HTTP/1.1", "404", 0.6, "10.0.2.1"},
+		{90 * time.Second, "GET /other HTTP/1.1", "503", 0.7, "-"},
+		{100 * time.Second, "bad", "400", 0.8, "10.0.2.2"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"request_time\": %v, \"request\": \"%s\", \"bytes_sent\": 100, \"remote_addr\": \"%s\"}\n", start.Add(line.offset).Format(consumer.ISO8601), line.status, line.requestTime, line.request, line.remoteAddr)
+	}
+	buffer.WriteString("not a log line\n")
+
+	if err := a.ConsumeReader(&buffer); err != nil {
+		t.Fatalf("ConsumeReader returned unexpected error: %v", err)
+	}
+
+	want := &consumer.Report{
+		Lines:    9,
+		Requests: 8,
+		StatusClasses: []consumer.StatusClassCount{
+			{"2xx", 4},
+			{"4xx", 2},
+			{"5xx", 2},
+		},
+		Routes: []consumer.RouteStats{
+			{
+				Method:   "GET",
+				Path:     "/users/{id}",
+				Requests: 4,
+				Latencies: []consumer.Percentile{
+					{50, 0.2},
+					{100, 0.4},
+				},
+			},
+			{
+				Method:   "GET",
+				Path:     "/",
+				Requests: 1,
+				Latencies: []consumer.Percentile{
+					{50, 0.6},
+					{100, 0.6},
+				},
+			},
+		},
+		Paths: []consumer.AnalyzedPathStats{
+			{"/users/{id}", 4, 0.25},
+			{"/", 1, 0},
+		},
+		Clients: []consumer.ClientStats{
+			{"10.0.0.0/24", 3},
+			{"10.0.1.0/24", 2},
+		},
+		ErrorRates: []consumer.WindowErrorRate{
+			{start, 4, 1, 0.25},
+			{start.Add(time.Minute), 4, 1, 0.25},
+		},
+		ParseErrors: map[string]uint64{
+			"malformed_line": 1,
+		},
+		Skipped: map[string]uint64{
+			"malformed_request": 1,
+		},
+	}
+
+	if got := a.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected report:\ngot:  %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestAnalyzerInvalidOptions(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		opts   consumer.AnalyzeOptions
+	}{
+		{"STREAM", consumer.AnalyzeOptions{}},
+		{"JSON", consumer.AnalyzeOptions{N: -1}},
+		{"JSON", consumer.AnalyzeOptions{Window: -time.Minute}},
+		{"JSON", consumer.AnalyzeOptions{Percentiles: []float64{0}}},
+		{"JSON", consumer.AnalyzeOptions{Percentiles: []float64{101}}},
+		{"CLF", consumer.AnalyzeOptions{Clients: consumer.TopClientsOptions{Field: "http_x_forwarded_for"}}},
+	} {
+		if _, err := consumer.NewAnalyzer(tc.format, tc.opts); err == nil {
+			t.Errorf("Expected NewAnalyzer to fail for %s format with options: %+v", tc.format, tc.opts)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package consumer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// Size of the batches of lines in which ConsumeReader consumes content,
+	// and the maximum line length supported by ConsumeReader and Analyzer.
+	readerBatchSize = 1 << 20
+)
+
+// ConsumeReader consumes all lines read from r (e.g. a historical log, see
+// Options.Backfill) in batches, as if each were returned by a separate poll of
+// the tailer. Flush should be called once all logs have been consumed.
+func (c *Consumer) ConsumeReader(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), readerBatchSize)
+
+	var batch []byte
+	for scanner.Scan() {
+		batch = append(append(batch, scanner.Bytes()...), '\n')
+		if len(batch) >= readerBatchSize {
+			if err := c.consumeBytes(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return c.consumeBytes(batch)
+	}
+	return nil
+}
+
+// ConsumeLogs consumes all lines of the logs at the supplied paths (see
+// ConsumeReader), opened via open, in order of the logged timestamp of their
+// first line. Logs may thus be supplied in any order (e.g. newest first, as
+// rotated by logrotate), provided they do not overlap by more than the allowed
+// lateness. Each log is opened twice.
+func (c *Consumer) ConsumeLogs(paths []string, open func(path string) (io.ReadCloser, error)) error {
+	type firstLine struct {
+		path string
+		time time.Time
+	}
+	var logs []firstLine
+	for _, path := range paths {
+		r, err := open(path)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %v", path, err)
+		}
+		t, err := c.firstLogTime(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failure reading %s: %v", path, err)
+		}
+		logs = append(logs, firstLine{path, t})
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].time.Before(logs[j].time)
+	})
+
+	for _, l := range logs {
+		log.Printf("Reading %s", l.path)
+
+		r, err := open(l.path)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %v", l.path, err)
+		}
+		err = c.ConsumeReader(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failure consuming logs from %s: %v", l.path, err)
+		}
+	}
+	return nil
+}
+
+// firstLogTime returns the logged timestamp of the first line read from r
+// which can be parsed, or the zero time if there is none.
+func (c *Consumer) firstLogTime(r io.Reader) (time.Time, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), readerBatchSize)
+	for scanner.Scan() {
+		if line, err := c.parse(scanner.Bytes()); err == nil {
+			return line.Time, nil
+		}
+	}
+	return time.Time{}, scanner.Err()
+}
+
+// Flush closes all open windows (see Options.Windows), regardless of allowed
+// lateness, writing them to the sink.
+func (c *Consumer) Flush() error {
+	if c.windows == nil {
+		return nil
+	}
+	return c.windows.flush()
+}
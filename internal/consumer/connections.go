@@ -0,0 +1,190 @@
+package consumer
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// ConnectionsOpenedMetricName is the name of the metric reporting the
+	// total number of connections opened (i.e. requests which were the first
+	// on their connection).
+	ConnectionsOpenedMetricName = "nginx_http_connections_opened_total"
+	// RequestsPerConnectionMetricName is the name of the metric reporting the
+	// distribution of the number of requests served per connection.
+	RequestsPerConnectionMetricName = "nginx_http_requests_per_connection"
+)
+
+const (
+	// Defaults for ConnectionsOptions.
+	defaultConnectionField         = "connection"
+	defaultConnectionRequestsField = "connection_requests"
+	defaultConnectionIdleTimeout   = 75 * time.Second
+	defaultConnectionMaxTracked    = 100000
+)
+
+var (
+	// Default buckets used with the requests-per-connection distribution
+	// metric.
+	requestsPerConnectionBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+)
+
+// ConnectionsOptions configures export of connection reuse (keepalive)
+// metrics, derived from the connection serial number ($connection) and the
+// number of requests served on it so far ($connection_requests).
+type ConnectionsOptions struct {
+	// Field names the log field containing the connection serial number.
+	// Defaults to "connection".
+	Field string
+	// RequestsField names the log field containing the number of requests
+	// served on the connection. Defaults to "connection_requests".
+	RequestsField string
+	// IdleTimeout is the period without requests after which a connection is
+	// considered closed, and its number of requests observed. This should be
+	// at least nginx's keepalive_timeout. Defaults to 75 seconds.
+	IdleTimeout time.Duration
+	// MaxTracked is the maximum number of open connections tracked, beyond
+	// which requests on new connections are excluded from the distribution of
+	// requests per connection. Defaults to 100000.
+	MaxTracked int
+}
+
+func (o *ConnectionsOptions) setDefaults() {
+	if o.Field == "" {
+		o.Field = defaultConnectionField
+	}
+	if o.RequestsField == "" {
+		o.RequestsField = defaultConnectionRequestsField
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = defaultConnectionIdleTimeout
+	}
+	if o.MaxTracked == 0 {
+		o.MaxTracked = defaultConnectionMaxTracked
+	}
+}
+
+func (o *ConnectionsOptions) validate() error {
+	if o.IdleTimeout < 0 {
+		return fmt.Errorf("connection idle timeout must be positive, got %v", o.IdleTimeout)
+	}
+	if o.MaxTracked < 0 {
+		return fmt.Errorf("maximum number of tracked connections must be positive, got %d", o.MaxTracked)
+	}
+	return nil
+}
+
+// connectionState holds the state of a tracked (open) connection.
+type connectionState struct {
+	requests float64
+	lastSeen time.Time
+	// Additional labels of the requests-per-connection observation, taken
+	// from the first request observed on the connection.
+	key    string
+	labels map[string]string
+}
+
+// connections tracks open connections, such that the number of requests
+// served on each may be observed once closed.
+type connections struct {
+	opts         ConnectionsOptions
+	open         map[string]*connectionState
+	opened       metrics.CounterT
+	perConn      metrics.HistogramT
+	openedCounts *keyedCounter
+	newest       time.Time
+}
+
+func (c *Consumer) addConnections(opts ConnectionsOptions) (*connections, error) {
+	if err := c.manager.AddCounter(ConnectionsOpenedMetricName, "Total number of connections opened (first requests on a connection)", c.labelNames(ConnectionsOpenedMetricName)); err != nil {
+		return nil, err
+	}
+	opened, err := c.manager.GetCounter(ConnectionsOpenedMetricName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addHistogram(RequestsPerConnectionMetricName, "Distribution of the number of requests served per connection", c.labelNames(RequestsPerConnectionMetricName), requestsPerConnectionBuckets); err != nil {
+		return nil, err
+	}
+	perConn, err := c.manager.GetHistogram(RequestsPerConnectionMetricName)
+	if err != nil {
+		return nil, err
+	}
+	return &connections{
+		opts:         opts,
+		open:         make(map[string]*connectionState),
+		opened:       opened,
+		perConn:      perConn,
+		openedCounts: newKeyedCounter(),
+	}, nil
+}
+
+// consume records a request on the connection identified in the supplied line
+// (if any), having the supplied additional labels.
+func (n *connections) consume(line *parsedLogLine, extra map[string]map[string]string) {
+	requests, err := strconv.ParseFloat(line.Fields[n.opts.RequestsField], 64)
+	if err != nil || requests < 1 {
+		return
+	}
+	if requests == 1 {
+		n.openedCounts.inc(withLabels(nil, extra[ConnectionsOpenedMetricName]))
+	}
+	if line.Time.After(n.newest) {
+		n.newest = line.Time
+	}
+
+	id := line.Fields[n.opts.Field]
+	if id == "" || id == "-" {
+		return
+	}
+	state, ok := n.open[id]
+	if !ok {
+		if len(n.open) >= n.opts.MaxTracked {
+			return
+		}
+		state = &connectionState{}
+		state.key, state.labels = withLabels(nil, extra[RequestsPerConnectionMetricName])
+		n.open[id] = state
+	}
+	// Note: Requests on multiplexed (e.g. HTTP/2) connections may be logged
+	// out of order.
+	if requests > state.requests {
+		state.requests = requests
+	}
+	if line.Time.After(state.lastSeen) {
+		state.lastSeen = line.Time
+	}
+}
+
+// export exports the number of connections opened since the last export, and
+// observes the number of requests served on connections idle as of now (or the
+// newest logged timestamp, if later).
+func (n *connections) export(now time.Time) error {
+	if n.newest.After(now) {
+		now = n.newest
+	}
+
+	for _, count := range n.openedCounts.counts {
+		if err := n.opened.Add(count.annotations, count.total); err != nil {
+			return err
+		}
+	}
+	n.openedCounts = newKeyedCounter()
+
+	closed := newKeyedAccumulator()
+	for id, state := range n.open {
+		if now.Sub(state.lastSeen) >= n.opts.IdleTimeout {
+			closed.record(state.key, state.requests, state.labels)
+			delete(n.open, id)
+		}
+	}
+	for _, observations := range closed.observations {
+		if err := n.perConn.Observe(observations.annotations, observations.seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -36,51 +38,207 @@ const (
 	ResponseSizeMetricName = "nginx_http_response_size_bytes"
 )
 
+const (
+	// Help strings of the HTTP response metrics.
+	responseCountHelp         = "Total number of responses by status code"
+	responseCountDetailedHelp = "Total number of responses by status code, path, and method"
+	responseDurationHelp      = "Distribution of response duration (seconds) by status code"
+	responseSizeHelp          = "Distribution of response size (bytes) by status code"
+)
+
 var (
-	// Buckets used with the response-size distribution metric.
+	// Matches valid Prometheus label names.
+	labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// Matches a W3C traceparent header, capturing trace and parent (span)
+	// IDs.
+	traceparentRE = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+	// Fields extracted from CLF log lines into parsedLogLine.Fields.
+	clfFields = map[string]bool{
+		"remote_addr":     true,
+		"http_referer":    true,
+		"http_user_agent": true,
+	}
+
+	// Default buckets used with the response-size distribution metric.
 	bytesSentBuckets = []float64{8, 16, 64, 128, 256, 512, 1024, 2048, 4096}
 )
 
+const (
+	// Parse error reasons, used as values of the "reason" label on
+	// ParseErrorsMetricName.
+	reasonMalformedLine = "malformed_line"
+	reasonMissingFields = "missing_fields"
+	reasonBadTimestamp  = "bad_timestamp"
+)
+
+const (
+	// Reasons for which parsed lines are skipped, used as values of the
+	// "reason" label on LinesSkippedMetricName. Lines predating startup are
+	// skipped entirely, while those with a malformed request or path are
+	// skipped only by path-based metrics.
+	reasonBeforeStartup    = "before_startup"
+	reasonMalformedRequest = "malformed_request"
+	reasonMalformedPath    = "malformed_path"
+)
+
+// parseError is an error encountered while parsing a log line, annotated with
+// the reason for the failure.
+type parseError struct {
+	reason string
+	err    error
+}
+
+func (e *parseError) Error() string {
+	return e.err.Error()
+}
+
+func newParseError(reason, format string, args ...interface{}) *parseError {
+	return &parseError{
+		reason: reason,
+		err:    fmt.Errorf(format, args...),
+	}
+}
+
 // Common representation for a parsed log line (across log formats)
 type parsedLogLine struct {
 	Time    time.Time
 	Request string
 	Status  string
-	// Values less than 0 for the following two fields indicate they are not present.
+	// Values less than 0 for the following three fields indicate they are not
+	// present.
 	RequestTime float64
 	BytesSent   float64
+	// Present in stream logs only.
+	BytesReceived float64
+	// Additional named fields extracted from the log line, where
+	// supported by the log format and present.
+	Fields map[string]string
+
+	// Cached result of query.
+	queryValues url.Values
+	queryParsed bool
 }
 
-func parseJSON(b []byte) (*parsedLogLine, error) {
-	line := &struct {
-		Time        string  `json:"time"`
-		Request     string  `json:"request"`
-		Status      string  `json:"status"`
-		RequestTime float64 `json:"request_time"`
-		BytesSent   float64 `json:"bytes_sent"`
-	}{
-		RequestTime: -1,
-		BytesSent:   -1,
+// query returns the parsed query parameters of the request, which are empty if
+// the request is malformed.
+func (l *parsedLogLine) query() url.Values {
+	if !l.queryParsed {
+		l.queryParsed = true
+		l.queryValues = url.Values{}
+		if requestFields := strings.Fields(l.Request); len(requestFields) == 3 {
+			if u, err := url.ParseRequestURI(requestFields[1]); err == nil {
+				// Note: Malformed parameters are omitted.
+				l.queryValues, _ = url.ParseQuery(u.RawQuery)
+			}
+		}
 	}
+	return l.queryValues
+}
 
-	if err := json.Unmarshal(b, line); err != nil {
-		return nil, fmt.Errorf("could not parse log line: %v", err)
+// jsonLogLine holds the fields of a JSON log line common to all consumers.
+type jsonLogLine struct {
+	Time        string  `json:"time"`
+	Request     string  `json:"request"`
+	Status      string  `json:"status"`
+	RequestTime float64 `json:"request_time"`
+	BytesSent   float64 `json:"bytes_sent"`
+}
+
+func newJSONLogLine() *jsonLogLine {
+	return &jsonLogLine{
+		RequestTime: -1,
+		BytesSent:   -1,
 	}
+}
 
-	t, err := time.Parse(ISO8601, line.Time)
+// parsed returns the parsedLogLine corresponding to the JSON log line.
+func (l *jsonLogLine) parsed() (*parsedLogLine, error) {
+	t, err := time.Parse(ISO8601, l.Time)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse log line timestamp: %v", err)
+		return nil, newParseError(reasonBadTimestamp, "could not parse log line timestamp: %v", err)
 	}
 
 	return &parsedLogLine{
 		Time:        t,
-		Request:     line.Request,
-		Status:      line.Status,
-		RequestTime: line.RequestTime,
-		BytesSent:   line.BytesSent,
+		Request:     l.Request,
+		Status:      l.Status,
+		RequestTime: l.RequestTime,
+		BytesSent:   l.BytesSent,
 	}, nil
 }
 
+func parseJSON(b []byte) (*parsedLogLine, error) {
+	line := newJSONLogLine()
+	if err := json.Unmarshal(b, line); err != nil {
+		return nil, newParseError(reasonMalformedLine, "could not parse log line: %v", err)
+	}
+	return line.parsed()
+}
+
+// newJSONParser returns a parser for JSON log lines which additionally
+// extracts the named fields (where present) into Fields of each parsed line.
+// Non-string field values are extracted verbatim. Each line is decoded once,
+// with the common fields extracted from the decoded object.
+func newJSONParser(fields []string) func([]byte) (*parsedLogLine, error) {
+	if len(fields) == 0 {
+		return parseJSON
+	}
+	return func(b []byte) (*parsedLogLine, error) {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, newParseError(reasonMalformedLine, "could not parse log line: %v", err)
+		}
+
+		line := newJSONLogLine()
+		for _, field := range []struct {
+			name  string
+			value interface{}
+		}{
+			{"time", &line.Time},
+			{"request", &line.Request},
+			{"status", &line.Status},
+			{"request_time", &line.RequestTime},
+			{"bytes_sent", &line.BytesSent},
+		} {
+			value, ok := raw[field.name]
+			if !ok {
+				continue
+			}
+			if err := json.Unmarshal(value, field.value); err != nil {
+				return nil, newParseError(reasonMalformedLine, "could not parse log line: %v", err)
+			}
+		}
+
+		parsed, err := line.parsed()
+		if err != nil {
+			return nil, err
+		}
+
+		parsed.Fields = make(map[string]string)
+		addJSONFields(parsed.Fields, raw, fields)
+		return parsed, nil
+	}
+}
+
+// addJSONFields adds the values of the named fields present in the supplied
+// JSON object to fields. Non-string values are stored verbatim.
+func addJSONFields(fields map[string]string, raw map[string]json.RawMessage, names []string) {
+	for _, name := range names {
+		value, ok := raw[name]
+		if !ok {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			fields[name] = s
+		} else if string(value) != "null" {
+			fields[name] = string(value)
+		}
+	}
+}
+
 func parseCLF(b []byte) (*parsedLogLine, error) {
 	line := &struct {
 		// Note: Most of these are unused for now.
@@ -93,21 +251,36 @@ func parseCLF(b []byte) (*parsedLogLine, error) {
 		Status      string
 		BytesSent   float64
 		RequestTime float64
+		// Present in the combined log format only.
+		Referer   string
+		UserAgent string
 	}{
 		// Not supported in CLF.
 		RequestTime: -1,
 	}
 
 	s := string(b)
-	if numItems, err := fmt.Sscanf(s, "%s %s %s [%s %5s] %q %s %f", &line.RemoteHost, &line.ClientID, &line.UserID, &line.Time, &line.TimeZone, &line.Request, &line.Status, &line.BytesSent); err != nil {
-		return nil, fmt.Errorf("could not parse log line: %v", err)
-	} else if want := 8; numItems < want {
-		return nil, fmt.Errorf("could not parse log line: expected %d fields, extracted %d (full line: \"%s\")", want, numItems, s)
+	// Note: The trailing referer and user agent fields of the combined log
+	// format are optional, hence errors after the first 8 fields are ignored.
+	numItems, err := fmt.Sscanf(s, "%s %s %s [%s %5s] %q %s %f %q %q", &line.RemoteHost, &line.ClientID, &line.UserID, &line.Time, &line.TimeZone, &line.Request, &line.Status, &line.BytesSent, &line.Referer, &line.UserAgent)
+	if want := 8; numItems < want {
+		if err != nil {
+			return nil, newParseError(reasonMalformedLine, "could not parse log line: %v", err)
+		}
+		return nil, newParseError(reasonMissingFields, "could not parse log line: expected %d fields, extracted %d (full line: \"%s\")", want, numItems, s)
 	}
 
 	t, err := time.Parse(CLF, fmt.Sprintf("%s %s", line.Time, line.TimeZone))
 	if err != nil {
-		return nil, fmt.Errorf("could not parse log line timestamp: %v", err)
+		return nil, newParseError(reasonBadTimestamp, "could not parse log line timestamp: %v", err)
+	}
+
+	fields := map[string]string{
+		"remote_addr": line.RemoteHost,
+	}
+	if numItems == 10 {
+		fields["http_referer"] = line.Referer
+		fields["http_user_agent"] = line.UserAgent
 	}
 
 	return &parsedLogLine{
@@ -116,6 +289,7 @@ func parseCLF(b []byte) (*parsedLogLine, error) {
 		Status:      line.Status,
 		RequestTime: line.RequestTime,
 		BytesSent:   line.BytesSent,
+		Fields:      fields,
 	}, nil
 }
 
@@ -135,13 +309,17 @@ func newKeyedCounter() *keyedCounter {
 }
 
 func (c *keyedCounter) inc(key string, annotations map[string]string) {
+	c.add(key, 1, annotations)
+}
+
+func (c *keyedCounter) add(key string, value float64, annotations map[string]string) {
 	if _, ok := c.counts[key]; ok {
-		c.counts[key].total++
+		c.counts[key].total += value
 		return
 	}
 
 	a := &annotatedCount{
-		total:       1,
+		total:       value,
 		annotations: nil,
 	}
 	if annotations != nil {
@@ -153,8 +331,14 @@ func (c *keyedCounter) inc(key string, annotations map[string]string) {
 	c.counts[key] = a
 }
 
+type exemplarObservation struct {
+	value    float64
+	exemplar map[string]string
+}
+
 type annotatedObservations struct {
 	seen        []float64
+	exemplars   []exemplarObservation
 	annotations map[string]string
 }
 
@@ -168,16 +352,14 @@ func newKeyedAccumulator() *keyedAccumulator {
 	}
 }
 
-func (a *keyedAccumulator) record(key string, value float64, annotations map[string]string) {
-	if _, ok := a.observations[key]; ok {
-		a.observations[key].seen = append(a.observations[key].seen, value)
-		return
+func (a *keyedAccumulator) get(key string, annotations map[string]string) *annotatedObservations {
+	if o, ok := a.observations[key]; ok {
+		return o
 	}
 
 	o := &annotatedObservations{
 		annotations: nil,
 	}
-	o.seen = append(o.seen, value)
 	if annotations != nil {
 		o.annotations = make(map[string]string)
 		for k, v := range annotations {
@@ -185,6 +367,26 @@ func (a *keyedAccumulator) record(key string, value float64, annotations map[str
 		}
 	}
 	a.observations[key] = o
+	return o
+}
+
+func (a *keyedAccumulator) record(key string, value float64, annotations map[string]string) {
+	o := a.get(key, annotations)
+	o.seen = append(o.seen, value)
+}
+
+// recordWithExemplar records an observation as in record, but with the
+// supplied exemplar labels attached (if non-nil).
+func (a *keyedAccumulator) recordWithExemplar(key string, value float64, annotations map[string]string, exemplar map[string]string) {
+	if exemplar == nil {
+		a.record(key, value, annotations)
+		return
+	}
+	o := a.get(key, annotations)
+	o.exemplars = append(o.exemplars, exemplarObservation{
+		value:    value,
+		exemplar: exemplar,
+	})
 }
 
 type logStats struct {
@@ -192,6 +394,156 @@ type logStats struct {
 	detailedStatusCounts  *keyedCounter
 	latencyObservations   *keyedAccumulator
 	bytesSentObservations *keyedAccumulator
+	parseErrors           *keyedCounter
+	linesRead             float64
+	linesParsed           float64
+	linesSkipped          *keyedCounter
+	linesConsumed         float64
+	newestLogTime         time.Time
+	ingestionLags         []float64
+	slos                  *sloStats
+	protocols             map[string]*keyedCounter
+	limited               *keyedCounter
+	stream                *streamStats
+	errorLog              *errorLogStats
+}
+
+func newLogStats() *logStats {
+	return &logStats{
+		statusCounts:          newKeyedCounter(),
+		detailedStatusCounts:  newKeyedCounter(),
+		latencyObservations:   newKeyedAccumulator(),
+		bytesSentObservations: newKeyedAccumulator(),
+		parseErrors:           newKeyedCounter(),
+		linesSkipped:          newKeyedCounter(),
+		slos:                  newSLOStats(),
+		protocols:             make(map[string]*keyedCounter),
+		limited:               newKeyedCounter(),
+		stream:                newStreamStats(),
+		errorLog:              newErrorLogStats(),
+	}
+}
+
+// recordParseError records a parse error of the supplied reason.
+func (s *logStats) recordParseError(reason string) {
+	s.parseErrors.inc(reason, map[string]string{
+		"reason": reason,
+	})
+}
+
+// recordSkipped records a (parsed) line skipped for the supplied reason.
+func (s *logStats) recordSkipped(reason string) {
+	s.linesSkipped.inc(reason, map[string]string{
+		"reason": reason,
+	})
+}
+
+// Options holds optional configuration for a Consumer. The zero value
+// corresponds to the default behavior.
+type Options struct {
+	// NativeHistograms, if non-nil, causes the response duration and size
+	// distribution metrics to be exported as native histograms (alongside
+	// their classic buckets) configured with the supplied options.
+	NativeHistograms *metrics.NativeHistogramOpts
+	// Buckets maps histogram metric names to bucket layouts, overriding the
+	// defaults for those metrics. Each layout must be valid per
+	// metrics.ValidateBuckets, and each name must correspond to a histogram
+	// registered by the Consumer (i.e. one which is enabled).
+	Buckets map[string][]float64
+	// Source identifies the log consumed by the Consumer in exporter
+	// self-observability metrics (see ExporterMetrics). Defaults to
+	// "access_log".
+	Source string
+	// ExporterMetrics, if non-nil, is used in place of creating new
+	// exporter self-observability metrics (e.g. to share those of another
+	// Consumer, obtained via its ExporterMetrics method).
+	ExporterMetrics *ExporterMetrics
+	// ExemplarField, if non-empty, names a log field (JSON format only)
+	// whose value is attached as an exemplar to response duration
+	// observations. Values in W3C traceparent format (e.g. as logged via
+	// $http_traceparent) are exported as "trace_id" and "span_id" exemplar
+	// labels, while others (e.g. $request_id) are exported verbatim with the
+	// field name as label.
+	ExemplarField string
+	// SLOs, if non-empty, are evaluated against each consumed request, with
+	// event counts (and Apdex classes, for those having a latency threshold)
+	// exported per SLO.
+	SLOs []SLO
+	// TopClients, if non-nil, configures export of the clients issuing the
+	// most requests.
+	TopClients *TopClientsOptions
+	// TopPaths, if non-nil, configures tracking of the most frequently
+	// requested paths, served via TopPathsHandler.
+	TopPaths *TopPathsOptions
+	// UniqueVisitors, if non-nil, configures estimation of the number of
+	// distinct visitors.
+	UniqueVisitors *UniqueVisitorsOptions
+	// AgentClass, if non-nil, configures classification of user agents,
+	// exported as the "agent_class" label on the response count metrics.
+	AgentClass *AgentClassOptions
+	// GeoIP, if non-nil, configures labeling of HTTP response metrics with
+	// the country and / or ASN of the client.
+	GeoIP *GeoIPOptions
+	// HTTPProtocols, if non-nil, configures export of request counts by
+	// HTTP protocol version, as logged in the request line.
+	HTTPProtocols *ProtocolDimensionOptions
+	// TLSProtocols, if non-nil, configures export of request counts by TLS
+	// protocol version (JSON format only, e.g. as logged via $ssl_protocol).
+	TLSProtocols *ProtocolDimensionOptions
+	// TLSCiphers, if non-nil, configures export of request counts by TLS
+	// cipher suite (JSON format only, e.g. as logged via $ssl_cipher).
+	TLSCiphers *ProtocolDimensionOptions
+	// Connections, if non-nil, configures export of connection reuse
+	// (keepalive) metrics (JSON format only).
+	Connections *ConnectionsOptions
+	// LabelExtractions define additional labels added to HTTP response
+	// metrics, extracted from request query parameters or log fields.
+	LabelExtractions []LabelExtraction
+	// Limits, if non-nil, configures export of counts of requests delayed or
+	// rejected by limit_req or limit_conn (JSON format only).
+	Limits *LimitsOptions
+	// Windows, if non-nil, configures aggregation of the HTTP response
+	// metrics into fixed windows by logged timestamp, with timestamped
+	// samples written to a sink.
+	Windows *WindowOptions
+	// Backfill, if true, configures the Consumer for historical logs read
+	// via ConsumeReader: Lines are consumed regardless of logged timestamp
+	// (rather than only those logged after the Consumer is created), and
+	// windows are closed by logged timestamp alone.
+	Backfill bool
+	// ErrorEvents are error log classification rules evaluated before
+	// DefaultErrorEventRules (ErrorLogFormat only).
+	ErrorEvents []ErrorEventRule
+}
+
+// validateNonHTTP returns an error if any option applicable only to HTTP
+// access logs is configured for a Consumer of the supplied (non-HTTP) format.
+// Label extractions are also supported for stream access logs.
+func (o *Options) validateNonHTTP(format string) error {
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{"ExemplarField", o.ExemplarField != ""},
+		{"SLOs", len(o.SLOs) > 0},
+		{"TopClients", o.TopClients != nil},
+		{"TopPaths", o.TopPaths != nil},
+		{"UniqueVisitors", o.UniqueVisitors != nil},
+		{"AgentClass", o.AgentClass != nil},
+		{"GeoIP", o.GeoIP != nil},
+		{"HTTPProtocols", o.HTTPProtocols != nil},
+		{"TLSProtocols", o.TLSProtocols != nil},
+		{"TLSCiphers", o.TLSCiphers != nil},
+		{"Connections", o.Connections != nil},
+		{"LabelExtractions", len(o.LabelExtractions) > 0 && format != StreamFormat},
+		{"Limits", o.Limits != nil},
+		{"Windows", o.Windows != nil},
+	} {
+		if option.set {
+			return fmt.Errorf("option %s is not supported for %s format", option.name, format)
+		}
+	}
+	return nil
 }
 
 // Consumer implements periodic polling of the supplied nginx access log
@@ -204,10 +556,42 @@ type Consumer struct {
 	stop                        chan bool
 	initFinshed                 time.Time
 	parse                       func([]byte) (*parsedLogLine, error)
+	format                      string
+	source                      string
+	opts                        Options
+	histograms                  map[string][]float64
+	exporterMetrics             *ExporterMetrics
+	fields                      []string
+	tailerStats                 file.Stats
+	newestLogTime               time.Time
+	sloMetrics                  *sloMetrics
+	topClients                  *topClients
+	topPaths                    *topPaths
+	uniqueVisitors              *uniqueVisitors
+	labelers                    []extraLabeler
+	protocolDimensions          []*protocolDimension
+	connections                 *connections
+	limits                      *limits
+	windows                     *windows
+	streamMetrics               *streamMetrics
+	errorLog                    *errorLog
 	httpResponseCounter         metrics.CounterT
 	detailedHTTPResponseCounter metrics.CounterT
 	httpResponseTimeHist        metrics.HistogramT
 	httpResponseByteSentHist    metrics.HistogramT
+	// sink, if non-nil, additionally receives all consumed lines (see
+	// Analyzer).
+	sink lineSink
+}
+
+// lineSink receives the access log lines consumed by a Consumer, along with
+// the stats of each batch of lines, in addition to their export as metrics.
+type lineSink interface {
+	// consumeLine is called for each consumed line, having the supplied
+	// request method and path (both empty if the request is malformed).
+	consumeLine(line *parsedLogLine, method, path string)
+	// consumeStats is called with the stats of each batch of lines.
+	consumeStats(stats *logStats)
 }
 
 // NewConsumer returns a Consumer polling the supplied tailer for new access
@@ -215,146 +599,568 @@ type Consumer struct {
 // specified period. The specific metrics exported by the Consumer will be
 // created during init in NewConsumer. Log lines provided by the tailer are
 // expected to be in the supplied format, of which "JSON" (see README.md) and
-// "CLF" are supported.
-func NewConsumer(period time.Duration, tailer file.TailerT, manager metrics.ManagerT, paths []string, format string) (*Consumer, error) {
+// "CLF" are supported for HTTP access logs, StreamFormat for stream access
+// logs, and ErrorLogFormat for error logs. Additional behavior is configured
+// via opts, though most options apply only to HTTP access logs.
+func NewConsumer(period time.Duration, tailer file.TailerT, manager metrics.ManagerT, paths []string, format string, opts Options) (*Consumer, error) {
 	c := &Consumer{
 		Period:  period,
 		tailer:  tailer,
 		manager: manager,
 		paths:   make(map[string]bool),
 		stop:    make(chan bool, 1),
+		format:  format,
+		source:  opts.Source,
+		opts:    opts,
+
+		histograms:      make(map[string][]float64),
+		exporterMetrics: opts.ExporterMetrics,
+	}
+	httpLog := format != StreamFormat && format != ErrorLogFormat
+	if c.source == "" {
+		switch format {
+		case StreamFormat:
+			c.source = "stream_log"
+		case ErrorLogFormat:
+			c.source = "error_log"
+		default:
+			c.source = "access_log"
+		}
+	}
+	if !httpLog {
+		if len(paths) > 0 {
+			return nil, fmt.Errorf("monitored paths are not supported for %s format", format)
+		}
+		if err := opts.validateNonHTTP(format); err != nil {
+			return nil, err
+		}
+	}
+	if format != ErrorLogFormat && len(opts.ErrorEvents) > 0 {
+		return nil, fmt.Errorf("error event rules are only supported for %s format", ErrorLogFormat)
 	}
 	for _, path := range paths {
 		c.paths[path] = true
 	}
 
+	if opts.ExemplarField != "" {
+		if !labelNameRE.MatchString(opts.ExemplarField) {
+			return nil, fmt.Errorf("exemplar field name must be a valid label name: \"%s\"", opts.ExemplarField)
+		}
+		c.fields = append(c.fields, opts.ExemplarField)
+	}
+
+	var topClientsOpts TopClientsOptions
+	if opts.TopClients != nil {
+		topClientsOpts = *opts.TopClients
+		topClientsOpts.setDefaults()
+		if err := topClientsOpts.validate(); err != nil {
+			return nil, err
+		}
+		c.fields = append(c.fields, topClientsOpts.Field)
+	}
+
+	var connectionsOpts ConnectionsOptions
+	if opts.Connections != nil {
+		connectionsOpts = *opts.Connections
+		connectionsOpts.setDefaults()
+		if err := connectionsOpts.validate(); err != nil {
+			return nil, err
+		}
+		c.fields = append(c.fields, connectionsOpts.Field, connectionsOpts.RequestsField)
+	}
+
+	var windowOpts WindowOptions
+	if opts.Windows != nil {
+		windowOpts = *opts.Windows
+		windowOpts.setDefaults()
+		if err := windowOpts.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var limitsOpts LimitsOptions
+	if opts.Limits != nil {
+		limitsOpts = *opts.Limits
+		limitsOpts.setDefaults()
+		c.fields = append(c.fields, limitsOpts.fields()...)
+	}
+
+	var uniqueVisitorsOpts UniqueVisitorsOptions
+	if opts.UniqueVisitors != nil {
+		uniqueVisitorsOpts = *opts.UniqueVisitors
+		uniqueVisitorsOpts.setDefaults()
+		if err := uniqueVisitorsOpts.validate(); err != nil {
+			return nil, err
+		}
+		c.fields = append(c.fields, uniqueVisitorsOpts.fields()...)
+	}
+
+	if opts.AgentClass != nil {
+		agentClassOpts := *opts.AgentClass
+		agentClassOpts.setDefaults()
+		classifier, err := newAgentClassifier(agentClassOpts)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.addLabeler(classifier, []string{ResponseCountMetricName, ResponseCountDetailedMetricName}); err != nil {
+			return nil, err
+		}
+		c.fields = append(c.fields, agentClassOpts.Field)
+	}
+
+	if opts.GeoIP != nil {
+		geoIPOpts := *opts.GeoIP
+		geoIPOpts.setDefaults()
+		if err := geoIPOpts.validate(); err != nil {
+			return nil, err
+		}
+		g, err := newGeoIP(geoIPOpts)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.addLabeler(g, geoIPOpts.Families); err != nil {
+			return nil, err
+		}
+		c.fields = append(c.fields, geoIPOpts.fields()...)
+	}
+
+	for i := range opts.LabelExtractions {
+		e := opts.LabelExtractions[i]
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+		families := e.Families
+		if len(families) == 0 {
+			families = []string{ResponseCountMetricName}
+		}
+		if err := c.addLabeler(newLabelExtractor(e), families); err != nil {
+			return nil, err
+		}
+		if e.Field != "" {
+			c.fields = append(c.fields, e.Field)
+		}
+	}
+
+	for _, dimension := range []struct {
+		spec protocolDimensionSpec
+		opts *ProtocolDimensionOptions
+	}{
+		{httpProtocolSpec, opts.HTTPProtocols},
+		{tlsProtocolSpec, opts.TLSProtocols},
+		{tlsCipherSpec, opts.TLSCiphers},
+	} {
+		if dimension.opts == nil {
+			continue
+		}
+		d, err := newProtocolDimension(dimension.spec, *dimension.opts)
+		if err != nil {
+			return nil, err
+		}
+		if d.field != "" {
+			c.fields = append(c.fields, d.field)
+		}
+		c.protocolDimensions = append(c.protocolDimensions, d)
+	}
+
 	switch format {
 	case "JSON":
-		c.parse = parseJSON
+		c.parse = newJSONParser(c.fields)
 	case "CLF":
+		for _, field := range c.fields {
+			if !clfFields[field] {
+				return nil, fmt.Errorf("log field is not supported in CLF format: \"%s\"", field)
+			}
+		}
 		c.parse = parseCLF
+	case StreamFormat:
+		c.parse = newStreamParser(c.fields)
+	case ErrorLogFormat:
+		c.parse = parseErrorLog
 	default:
 		return nil, fmt.Errorf("unsupported log format: \"%s\"", format)
 	}
 
 	var err error
 
-	if err = manager.AddCounter(ResponseCountMetricName, "Total number of responses by status code", []string{
+	switch format {
+	case StreamFormat:
+		if c.streamMetrics, err = c.addStreamMetrics(); err != nil {
+			return nil, err
+		}
+	case ErrorLogFormat:
+		if c.errorLog, err = c.addErrorLog(opts.ErrorEvents); err != nil {
+			return nil, err
+		}
+	default:
+		if err = c.addHTTPMetrics(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.exporterMetrics == nil {
+		if c.exporterMetrics, err = c.addExporterMetrics(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, d := range c.protocolDimensions {
+		if err := d.register(manager, c.labelNames(d.spec.name, d.spec.label)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.SLOs) > 0 {
+		names := make(map[string]bool)
+		for i := range opts.SLOs {
+			if err := opts.SLOs[i].validate(); err != nil {
+				return nil, err
+			} else if names[opts.SLOs[i].Name] {
+				return nil, fmt.Errorf("duplicate SLO name: %s", opts.SLOs[i].Name)
+			}
+			names[opts.SLOs[i].Name] = true
+		}
+		if c.sloMetrics, err = c.addSLOMetrics(); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TopPaths != nil {
+		if c.topPaths, err = newTopPaths(*opts.TopPaths); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TopClients != nil {
+		if c.topClients, err = c.addTopClients(topClientsOpts, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Connections != nil {
+		if c.connections, err = c.addConnections(connectionsOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Windows != nil {
+		if c.windows, err = c.addWindows(windowOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Limits != nil {
+		if c.limits, err = c.addLimits(limitsOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.UniqueVisitors != nil {
+		if c.uniqueVisitors, err = c.addUniqueVisitors(uniqueVisitorsOpts, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range opts.Buckets {
+		if _, ok := c.histograms[name]; !ok {
+			return nil, fmt.Errorf("buckets configured for metric %s which is not enabled", name)
+		}
+	}
+
+	if !opts.Backfill {
+		c.initFinshed = time.Now()
+	}
+
+	return c, nil
+}
+
+// addHTTPMetrics adds the HTTP response metrics to the manager.
+func (c *Consumer) addHTTPMetrics() error {
+	var err error
+
+	if err = c.manager.AddCounter(ResponseCountMetricName, responseCountHelp, c.labelNames(ResponseCountMetricName,
 		"status_code",
-	}); err != nil {
-		return nil, err
+	)); err != nil {
+		return err
 	}
-	if c.httpResponseCounter, err = manager.GetCounter(ResponseCountMetricName); err != nil {
-		return nil, err
+	if c.httpResponseCounter, err = c.manager.GetCounter(ResponseCountMetricName); err != nil {
+		return err
 	}
 
-	if err = manager.AddCounter(ResponseCountDetailedMetricName, "Total number of responses by status code, path, and method", []string{
+	if err = c.manager.AddCounter(ResponseCountDetailedMetricName, responseCountDetailedHelp, c.labelNames(ResponseCountDetailedMetricName,
 		"status_code",
 		"path",
 		"method",
-	}); err != nil {
-		return nil, err
+	)); err != nil {
+		return err
 	}
-	if c.detailedHTTPResponseCounter, err = manager.GetCounter(ResponseCountDetailedMetricName); err != nil {
-		return nil, err
+	if c.detailedHTTPResponseCounter, err = c.manager.GetCounter(ResponseCountDetailedMetricName); err != nil {
+		return err
 	}
 
-	if err = manager.AddHistogram(ResponseDurationMetricName, "Distribution of response duration (seconds) by status code", []string{
+	if err = c.addHistogram(ResponseDurationMetricName, responseDurationHelp, c.labelNames(ResponseDurationMetricName,
 		"status_code",
-	}, nil); err != nil {
-		return nil, err
+	), nil); err != nil {
+		return err
 	}
-	if c.httpResponseTimeHist, err = manager.GetHistogram(ResponseDurationMetricName); err != nil {
-		return nil, err
+	if c.httpResponseTimeHist, err = c.manager.GetHistogram(ResponseDurationMetricName); err != nil {
+		return err
 	}
 
-	if err = manager.AddHistogram(ResponseSizeMetricName, "Distribution of response size (bytes) by status code", []string{
+	if err = c.addHistogram(ResponseSizeMetricName, responseSizeHelp, c.labelNames(ResponseSizeMetricName,
 		"status_code",
-	}, bytesSentBuckets); err != nil {
-		return nil, err
+	), bytesSentBuckets); err != nil {
+		return err
 	}
-	if c.httpResponseByteSentHist, err = manager.GetHistogram(ResponseSizeMetricName); err != nil {
-		return nil, err
+	if c.httpResponseByteSentHist, err = c.manager.GetHistogram(ResponseSizeMetricName); err != nil {
+		return err
 	}
 
-	c.initFinshed = time.Now()
+	return nil
+}
 
-	return c, nil
+// addHistogram adds a histogram metric to the manager, as a native histogram
+// if so configured. The supplied default buckets are used unless overridden in
+// the Consumer's Options.
+func (c *Consumer) addHistogram(name, help string, labelNames []string, buckets []float64) error {
+	if override, ok := c.opts.Buckets[name]; ok {
+		if err := metrics.ValidateBuckets(override); err != nil {
+			return fmt.Errorf("invalid buckets for %s: %v", name, err)
+		}
+		buckets = override
+	}
+	c.histograms[name] = buckets
+	if c.opts.NativeHistograms != nil {
+		return c.manager.AddNativeHistogram(name, help, labelNames, buckets, *c.opts.NativeHistograms)
+	}
+	return c.manager.AddHistogram(name, help, labelNames, buckets)
+}
+
+// exemplar returns the exemplar labels to attach to observations derived from
+// the supplied line, or nil if there are none.
+func (c *Consumer) exemplar(line *parsedLogLine) map[string]string {
+	if c.opts.ExemplarField == "" {
+		return nil
+	}
+	value, ok := line.Fields[c.opts.ExemplarField]
+	if !ok || value == "" {
+		return nil
+	}
+	var exemplar map[string]string
+	if m := traceparentRE.FindStringSubmatch(value); m != nil {
+		exemplar = map[string]string{
+			"trace_id": m[1],
+			"span_id":  m[2],
+		}
+	} else {
+		exemplar = map[string]string{
+			c.opts.ExemplarField: value,
+		}
+	}
+	// Exemplars exceeding the OpenMetrics length limit are dropped.
+	if err := metrics.ValidateExemplar(exemplar); err != nil {
+		return nil
+	}
+	return exemplar
 }
 
 func (c *Consumer) consumeLine(line *parsedLogLine, stats *logStats) {
-	stats.statusCounts.inc(line.Status, nil)
+	extra := c.extraLabels(line)
+	status := map[string]string{
+		"status_code": line.Status,
+	}
+	windowed := c.windows != nil && c.windows.accept(line.Time)
+
+	key, labels := withLabels(status, extra[ResponseCountMetricName])
+	stats.statusCounts.inc(key, labels)
+	if windowed {
+		c.windows.count(line.Time, ResponseCountMetricName, key, labels)
+	}
+
+	if c.topClients != nil {
+		c.topClients.consume(line)
+	}
+
+	if c.connections != nil {
+		c.connections.consume(line, extra)
+	}
+
+	if c.limits != nil {
+		c.limits.consume(line, extra[LimitedRequestsMetricName], stats.limited)
+	}
 
 	if line.RequestTime >= 0 {
-		stats.latencyObservations.record(line.Status, line.RequestTime, nil)
+		key, labels := withLabels(status, extra[ResponseDurationMetricName])
+		stats.latencyObservations.recordWithExemplar(key, line.RequestTime, labels, c.exemplar(line))
+		if windowed {
+			c.windows.observe(line.Time, ResponseDurationMetricName, key, line.RequestTime, labels)
+		}
 	}
 
 	if line.BytesSent >= 0 {
-		stats.bytesSentObservations.record(line.Status, line.BytesSent, nil)
+		key, labels := withLabels(status, extra[ResponseSizeMetricName])
+		stats.bytesSentObservations.record(key, line.BytesSent, labels)
+		if windowed {
+			c.windows.observe(line.Time, ResponseSizeMetricName, key, line.BytesSent, labels)
+		}
 	}
 
-	if requestFields := strings.Fields(line.Request); len(requestFields) != 3 {
+	requestFields := strings.Fields(line.Request)
+	c.consumeProtocols(line, requestFields, extra, stats)
+
+	var method, path string
+	if len(requestFields) != 3 {
 		log.Printf("Skipping malformed request field: %v", line.Request)
+		stats.recordSkipped(reasonMalformedRequest)
 	} else if u, err := url.ParseRequestURI(requestFields[1]); err != nil {
 		log.Printf("Skipping malformed request path: %v", requestFields[1])
-	} else if _, ok := c.paths[u.Path]; ok {
-		key := strings.Join([]string{line.Status, requestFields[0], u.Path}, ":")
-		stats.detailedStatusCounts.inc(key, map[string]string{
-			"status_code": line.Status,
-			"path":        u.Path,
-			"method":      requestFields[0],
-		})
+		stats.recordSkipped(reasonMalformedPath)
+	} else {
+		method, path = requestFields[0], u.Path
+		if _, ok := c.paths[u.Path]; ok {
+			key, labels := withLabels(map[string]string{
+				"status_code": line.Status,
+				"path":        u.Path,
+				"method":      requestFields[0],
+			}, extra[ResponseCountDetailedMetricName])
+			stats.detailedStatusCounts.inc(key, labels)
+			if windowed {
+				c.windows.count(line.Time, ResponseCountDetailedMetricName, key, labels)
+			}
+		}
+		c.consumeSLOs(line, requestFields[0], u.Path, extra, stats.slos)
+		if c.topPaths != nil {
+			c.topPaths.consume(line, u.Path)
+		}
+		if c.uniqueVisitors != nil {
+			c.uniqueVisitors.consume(line, u.Path)
+		}
+	}
+
+	if c.sink != nil {
+		c.sink.consumeLine(line, method, path)
 	}
 }
 
 func (c *Consumer) consumeBytes(b []byte) error {
-	stats := &logStats{
-		statusCounts:          newKeyedCounter(),
-		detailedStatusCounts:  newKeyedCounter(),
-		latencyObservations:   newKeyedAccumulator(),
-		bytesSentObservations: newKeyedAccumulator(),
+	stats := newLogStats()
+	now := time.Now()
+
+	for _, e := range c.labelers {
+		e.labeler.refresh()
+	}
+	if c.windows != nil {
+		c.windows.begin(now)
 	}
 
 	scanner := bufio.NewScanner(bytes.NewReader(b))
 	for scanner.Scan() {
-		if nextLine, err := c.parse(scanner.Bytes()); err != nil {
+		stats.linesRead++
+		nextLine, err := c.parse(scanner.Bytes())
+		if err != nil {
 			log.Printf("Error parsing log line: %v", err)
-		} else if nextLine.Time.After(c.initFinshed) {
-			c.consumeLine(nextLine, stats)
+			if perr, ok := err.(*parseError); ok {
+				stats.recordParseError(perr.reason)
+			} else {
+				stats.recordParseError(reasonMalformedLine)
+			}
+			continue
+		}
+		stats.linesParsed++
+		if nextLine.Time.After(c.initFinshed) {
+			stats.linesConsumed++
+			if nextLine.Time.After(stats.newestLogTime) {
+				stats.newestLogTime = nextLine.Time
+			}
+			stats.ingestionLags = append(stats.ingestionLags, now.Sub(nextLine.Time).Seconds())
+			switch {
+			case c.streamMetrics != nil:
+				c.consumeStream(nextLine, stats.stream)
+			case c.errorLog != nil:
+				c.errorLog.consume(nextLine, stats.errorLog)
+			default:
+				c.consumeLine(nextLine, stats)
+			}
+		} else {
+			stats.recordSkipped(reasonBeforeStartup)
 		}
 	}
 
-	for code, count := range stats.statusCounts.counts {
-		if err := c.httpResponseCounter.Add(map[string]string{
-			"status_code": code,
-		}, count.total); err != nil {
+	if c.sink != nil {
+		c.sink.consumeStats(stats)
+	}
+
+	if err := c.recordLines(stats, len(b), now); err != nil {
+		return err
+	}
+
+	for _, count := range stats.statusCounts.counts {
+		if err := c.httpResponseCounter.Add(count.annotations, count.total); err != nil {
 			return err
 		}
 	}
-	for code, count := range stats.detailedStatusCounts.counts {
-		labels := map[string]string{
-			"status_code": code,
+	for _, count := range stats.detailedStatusCounts.counts {
+		if err := c.detailedHTTPResponseCounter.Add(count.annotations, count.total); err != nil {
+			return err
+		}
+	}
+	for _, observations := range stats.latencyObservations.observations {
+		labels := observations.annotations
+		if len(observations.seen) > 0 {
+			if err := c.httpResponseTimeHist.Observe(labels, observations.seen); err != nil {
+				return err
+			}
 		}
-		if count.annotations != nil {
-			for k, v := range count.annotations {
-				labels[k] = v
+		for _, e := range observations.exemplars {
+			if err := c.httpResponseTimeHist.ObserveWithExemplar(labels, e.value, e.exemplar); err != nil {
+				return err
 			}
 		}
-		if err := c.detailedHTTPResponseCounter.Add(labels, count.total); err != nil {
+	}
+	for _, observations := range stats.bytesSentObservations.observations {
+		if err := c.httpResponseByteSentHist.Observe(observations.annotations, observations.seen); err != nil {
+			return err
+		}
+	}
+	if err := c.recordProtocols(stats); err != nil {
+		return err
+	}
+	if c.streamMetrics != nil {
+		if err := c.recordStream(stats.stream); err != nil {
+			return err
+		}
+	}
+	if c.errorLog != nil {
+		if err := c.errorLog.record(stats.errorLog); err != nil {
+			return err
+		}
+	}
+	if c.sloMetrics != nil {
+		if err := c.recordSLOs(stats.slos); err != nil {
+			return err
+		}
+	}
+	if c.topClients != nil {
+		if err := c.topClients.export(now); err != nil {
+			return err
+		}
+	}
+	if c.connections != nil {
+		if err := c.connections.export(now); err != nil {
 			return err
 		}
 	}
-	for code, observations := range stats.latencyObservations.observations {
-		if err := c.httpResponseTimeHist.Observe(map[string]string{
-			"status_code": code,
-		}, observations.seen); err != nil {
+	if c.limits != nil {
+		if err := c.limits.export(stats.limited); err != nil {
 			return err
 		}
 	}
-	for code, observations := range stats.bytesSentObservations.observations {
-		if err := c.httpResponseByteSentHist.Observe(map[string]string{
-			"status_code": code,
-		}, observations.seen); err != nil {
+	if c.windows != nil {
+		if err := c.windows.export(now); err != nil {
+			return err
+		}
+	}
+	if c.uniqueVisitors != nil {
+		if err := c.uniqueVisitors.export(now); err != nil {
 			return err
 		}
 	}
@@ -370,15 +1176,34 @@ func (c *Consumer) Run() error {
 		case <-c.stop:
 			return nil
 		}
+		start := time.Now()
 		b, err := c.tailer.Next()
 		if err != nil {
 			return fmt.Errorf("could not retrieve log content: %v", err)
 		} else if err := c.consumeBytes(b); err != nil {
 			return fmt.Errorf("could not export log content: %v", err)
+		} else if err := c.recordPoll(start); err != nil {
+			return fmt.Errorf("could not export poll stats: %v", err)
 		}
 	}
 }
 
+// ExporterMetrics returns the exporter self-observability metrics used by the
+// Consumer, e.g. for sharing with other Consumers via Options.
+func (c *Consumer) ExporterMetrics() *ExporterMetrics {
+	return c.exporterMetrics
+}
+
+// TopPathsHandler returns an HTTP handler serving the most frequently
+// requested (normalized) paths and associated statistics as JSON (see
+// TopPaths), or nil if not configured via Options.
+func (c *Consumer) TopPathsHandler() http.Handler {
+	if c.topPaths == nil {
+		return nil
+	}
+	return c.topPaths
+}
+
 // Stop signals that polling should cease in Run and the latter should return
 // (e.g. if Run is blocking in another goroutine).
 func (c *Consumer) Stop() {
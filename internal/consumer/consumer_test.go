@@ -2,17 +2,31 @@ package consumer_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
+	"sync"
 	"testing"
 	"text/template"
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+	"github.com/swfrench/nginx-log-exporter/internal/file"
 	"github.com/swfrench/nginx-log-exporter/internal/file/mock_tailer"
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
 	"github.com/swfrench/nginx-log-exporter/internal/metrics/mock_metrics"
+	"github.com/swfrench/nginx-log-exporter/internal/openmetrics"
 )
 
 var (
@@ -124,6 +138,32 @@ func FloatElementsEq(want []float64) FloatElementsMatcher {
 	return m
 }
 
+type FloatElementsRangeMatcher struct {
+	min float64
+	max float64
+}
+
+func (m FloatElementsRangeMatcher) Matches(got interface{}) bool {
+	gotSlice, ok := got.([]float64)
+	if !ok || len(gotSlice) == 0 {
+		return false
+	}
+	for _, v := range gotSlice {
+		if v < m.min || v > m.max {
+			return false
+		}
+	}
+	return true
+}
+
+func (m FloatElementsRangeMatcher) String() string {
+	return fmt.Sprintf("is a non-empty []float64 with all elements in [%v, %v]", m.min, m.max)
+}
+
+func FloatElementsInRange(min, max float64) FloatElementsRangeMatcher {
+	return FloatElementsRangeMatcher{min: min, max: max}
+}
+
 // Helpers
 
 type logLine struct {
@@ -146,6 +186,12 @@ func buildLogLine(format string, line logLine, buffer *bytes.Buffer) error {
 }
 
 func testRunConsumer(t *testing.T, c *consumer.Consumer) {
+	testRunConsumerPeriods(t, c, 2)
+}
+
+// testRunConsumerPeriods is as testRunConsumer, but waits at least the
+// supplied number of polling periods, for tests requiring several polls.
+func testRunConsumerPeriods(t *testing.T, c *consumer.Consumer, periods int) {
 	done := make(chan bool, 1)
 	var consumerErr error
 	go func() {
@@ -153,8 +199,8 @@ func testRunConsumer(t *testing.T, c *consumer.Consumer) {
 		done <- true
 	}()
 
-	// Wait at least two polling periods and stop.
-	time.Sleep(2 * c.Period)
+	// Wait at least the requested polling periods and stop.
+	time.Sleep(time.Duration(periods) * c.Period)
 	c.Stop()
 
 	// Ensure the consumer terminated in a timely manner.
@@ -176,45 +222,316 @@ type mockMetricsSet struct {
 	responseCountsDetailed *mock_metrics.MockCounterT
 	responseTime           *mock_metrics.MockHistogramT
 	responseSize           *mock_metrics.MockHistogramT
+	exporterCounters       map[string]*mock_metrics.MockCounterT
+	pollDuration           *mock_metrics.MockHistogramT
+	ingestionLag           *mock_metrics.MockHistogramT
+	lastConsumed           *mock_metrics.MockGaugeT
+	newestLog              *mock_metrics.MockGaugeT
+	sloCounters            map[string]*mock_metrics.MockCounterT
+	topClients             *mock_metrics.MockGaugeT
+	uniqueVisitors         *mock_metrics.MockGaugeT
+	protocolCounters       map[string]*mock_metrics.MockCounterT
+	connectionsOpened      *mock_metrics.MockCounterT
+	requestsPerConnection  *mock_metrics.MockHistogramT
+	streamSessions         *mock_metrics.MockCounterT
+	streamDuration         *mock_metrics.MockHistogramT
+	streamBytesSent        *mock_metrics.MockCounterT
+	streamBytesReceived    *mock_metrics.MockCounterT
+	errorLogMessages       *mock_metrics.MockCounterT
+	errorLogEvents         *mock_metrics.MockCounterT
+	errorLogLimited        *mock_metrics.MockCounterT
+	limitedRequests        *mock_metrics.MockCounterT
+	windowDroppedLines     *mock_metrics.MockCounterT
+}
+
+// expectAnyExporterMetricUpdates permits arbitrary updates to exporter
+// self-observability metrics, for tests which do not examine them.
+func (s *mockMetricsSet) expectAnyExporterMetricUpdates() {
+	for _, counter := range s.exporterCounters {
+		counter.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	}
+	s.pollDuration.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	s.ingestionLag.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	s.lastConsumed.EXPECT().Set(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	s.newestLog.EXPECT().Set(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+}
+
+var exporterCounterNames = []string{
+	consumer.LinesReadMetricName,
+	consumer.LinesParsedMetricName,
+	consumer.ParseErrorsMetricName,
+	consumer.LinesSkippedMetricName,
+	consumer.BytesReadMetricName,
+	consumer.RotationsMetricName,
+	consumer.TruncationsMetricName,
+}
+
+var sloCounterLabels = map[string][]string{
+	consumer.SLOEventsMetricName:     {"slo"},
+	consumer.SLOGoodEventsMetricName: {"slo"},
+	consumer.SLOBadEventsMetricName:  {"slo", "reason"},
+	consumer.SLOApdexMetricName:      {"slo", "class"},
+}
+
+// expectedLabels returns the label names expected for the named HTTP response
+// metric family given the supplied options, beginning with the supplied base
+// label names.
+func expectedLabels(opts consumer.Options, family string, base ...string) []string {
+	var labels []string
+	labels = append(labels, base...)
+	if opts.AgentClass != nil && (family == consumer.ResponseCountMetricName || family == consumer.ResponseCountDetailedMetricName) {
+		labels = append(labels, "agent_class")
+	}
+	if opts.GeoIP != nil {
+		families := opts.GeoIP.Families
+		if len(families) == 0 {
+			families = []string{consumer.ResponseCountMetricName}
+		}
+		for _, f := range families {
+			if f != family {
+				continue
+			}
+			if len(opts.GeoIP.Labels) == 0 {
+				labels = append(labels, "country", "asn")
+			} else {
+				labels = append(labels, opts.GeoIP.Labels...)
+			}
+		}
+	}
+	for _, e := range opts.LabelExtractions {
+		families := e.Families
+		if len(families) == 0 {
+			families = []string{consumer.ResponseCountMetricName}
+		}
+		for _, f := range families {
+			if f == family {
+				labels = append(labels, e.Label)
+			}
+		}
+	}
+	return labels
+}
+
+func mockInit(ctrl *gomock.Controller, opts consumer.Options) (*mock_tailer.MockTailerT, *mock_metrics.MockManagerT, *mockMetricsSet) {
+	return mockInitFormat(ctrl, "JSON", opts)
 }
 
-func mockInit(ctrl *gomock.Controller) (*mock_tailer.MockTailerT, *mock_metrics.MockManagerT, *mockMetricsSet) {
+// mockInitFormat is as mockInit, but for a consumer of the supplied format,
+// which determines whether HTTP, stream, or error log metrics are expected.
+func mockInitFormat(ctrl *gomock.Controller, format string, opts consumer.Options) (*mock_tailer.MockTailerT, *mock_metrics.MockManagerT, *mockMetricsSet) {
 	t := mock_tailer.NewMockTailerT(ctrl)
 	m := mock_metrics.NewMockManagerT(ctrl)
 
-	m.EXPECT().AddCounter(consumer.ResponseCountMetricName, gomock.Any(), []string{
-		"status_code",
-	}).Return(nil)
+	switch format {
+	case consumer.StreamFormat:
+		mockInitStreamMetrics(m, opts)
+	case consumer.ErrorLogFormat:
+		m.EXPECT().AddCounter(consumer.ErrorLogMessagesMetricName, gomock.Any(), []string{"level"}).Return(nil)
+		m.EXPECT().AddCounter(consumer.ErrorLogEventsMetricName, gomock.Any(), []string{"event"}).Return(nil)
+		m.EXPECT().AddCounter(consumer.ErrorLogLimitedRequestsMetricName, gomock.Any(), []string{"limit", "status", "zone", "server"}).Return(nil)
+	default:
+		mockInitHTTPMetrics(m, opts)
+	}
 
-	m.EXPECT().AddCounter(consumer.ResponseCountDetailedMetricName, gomock.Any(), []string{
-		"status_code",
-		"path",
-		"method",
-	}).Return(nil)
+	for _, name := range exporterCounterNames {
+		m.EXPECT().AddCounter(name, gomock.Any(), gomock.Any()).Return(nil)
+	}
 
-	m.EXPECT().AddHistogram(consumer.ResponseDurationMetricName, gomock.Any(), []string{
-		"status_code",
-	}, gomock.Nil()).Return(nil)
+	if opts.NativeHistograms != nil {
+		m.EXPECT().AddNativeHistogram(consumer.PollDurationMetricName, gomock.Any(), []string{
+			"source",
+		}, gomock.Nil(), *opts.NativeHistograms).Return(nil)
+		m.EXPECT().AddNativeHistogram(consumer.IngestionLagMetricName, gomock.Any(), []string{
+			"source",
+		}, gomock.Any(), *opts.NativeHistograms).Return(nil)
+	} else {
+		m.EXPECT().AddHistogram(consumer.PollDurationMetricName, gomock.Any(), []string{
+			"source",
+		}, gomock.Nil()).Return(nil)
+		m.EXPECT().AddHistogram(consumer.IngestionLagMetricName, gomock.Any(), []string{
+			"source",
+		}, gomock.Any()).Return(nil)
+	}
 
-	m.EXPECT().AddHistogram(consumer.ResponseSizeMetricName, gomock.Any(), []string{
-		"status_code",
-	}, FloatElementsEq([]float64{8, 16, 64, 128, 256, 512, 1024, 2048, 4096})).Return(nil)
+	m.EXPECT().AddGauge(consumer.LastConsumedMetricName, gomock.Any(), []string{
+		"source",
+	}).Return(nil)
+	m.EXPECT().AddGauge(consumer.NewestLogTimestampMetricName, gomock.Any(), []string{
+		"source",
+	}).Return(nil)
 
 	s := &mockMetricsSet{
 		responseCounts:         mock_metrics.NewMockCounterT(ctrl),
 		responseCountsDetailed: mock_metrics.NewMockCounterT(ctrl),
 		responseTime:           mock_metrics.NewMockHistogramT(ctrl),
 		responseSize:           mock_metrics.NewMockHistogramT(ctrl),
+		exporterCounters:       make(map[string]*mock_metrics.MockCounterT),
+		pollDuration:           mock_metrics.NewMockHistogramT(ctrl),
+		ingestionLag:           mock_metrics.NewMockHistogramT(ctrl),
+		lastConsumed:           mock_metrics.NewMockGaugeT(ctrl),
+		newestLog:              mock_metrics.NewMockGaugeT(ctrl),
+		sloCounters:            make(map[string]*mock_metrics.MockCounterT),
+		topClients:             mock_metrics.NewMockGaugeT(ctrl),
+		uniqueVisitors:         mock_metrics.NewMockGaugeT(ctrl),
+		protocolCounters:       make(map[string]*mock_metrics.MockCounterT),
+		connectionsOpened:      mock_metrics.NewMockCounterT(ctrl),
+		requestsPerConnection:  mock_metrics.NewMockHistogramT(ctrl),
+		streamSessions:         mock_metrics.NewMockCounterT(ctrl),
+		streamDuration:         mock_metrics.NewMockHistogramT(ctrl),
+		streamBytesSent:        mock_metrics.NewMockCounterT(ctrl),
+		streamBytesReceived:    mock_metrics.NewMockCounterT(ctrl),
+		errorLogMessages:       mock_metrics.NewMockCounterT(ctrl),
+		errorLogEvents:         mock_metrics.NewMockCounterT(ctrl),
+		errorLogLimited:        mock_metrics.NewMockCounterT(ctrl),
+		limitedRequests:        mock_metrics.NewMockCounterT(ctrl),
+		windowDroppedLines:     mock_metrics.NewMockCounterT(ctrl),
+	}
+
+	if opts.Connections != nil {
+		m.EXPECT().AddCounter(consumer.ConnectionsOpenedMetricName, gomock.Any(), expectedLabels(opts, consumer.ConnectionsOpenedMetricName)).Return(nil)
+		m.EXPECT().GetCounter(consumer.ConnectionsOpenedMetricName).AnyTimes().Return(s.connectionsOpened, nil)
+		perConnBuckets := FloatElementsEq([]float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000})
+		if opts.NativeHistograms != nil {
+			m.EXPECT().AddNativeHistogram(consumer.RequestsPerConnectionMetricName, gomock.Any(), expectedLabels(opts, consumer.RequestsPerConnectionMetricName), perConnBuckets, *opts.NativeHistograms).Return(nil)
+		} else {
+			m.EXPECT().AddHistogram(consumer.RequestsPerConnectionMetricName, gomock.Any(), expectedLabels(opts, consumer.RequestsPerConnectionMetricName), perConnBuckets).Return(nil)
+		}
+		m.EXPECT().GetHistogram(consumer.RequestsPerConnectionMetricName).AnyTimes().Return(s.requestsPerConnection, nil)
+	}
+
+	for _, dimension := range []struct {
+		name  string
+		label string
+		opts  *consumer.ProtocolDimensionOptions
+	}{
+		{consumer.HTTPProtocolMetricName, "protocol", opts.HTTPProtocols},
+		{consumer.TLSProtocolMetricName, "tls_protocol", opts.TLSProtocols},
+		{consumer.TLSCipherMetricName, "tls_cipher", opts.TLSCiphers},
+	} {
+		if dimension.opts == nil {
+			continue
+		}
+		m.EXPECT().AddCounter(dimension.name, gomock.Any(), expectedLabels(opts, dimension.name, dimension.label)).Return(nil)
+		s.protocolCounters[dimension.name] = mock_metrics.NewMockCounterT(ctrl)
+		m.EXPECT().GetCounter(dimension.name).AnyTimes().Return(s.protocolCounters[dimension.name], nil)
+	}
+
+	if opts.Limits != nil {
+		m.EXPECT().AddCounter(consumer.LimitedRequestsMetricName, gomock.Any(), expectedLabels(opts, consumer.LimitedRequestsMetricName, "limit", "status", "server")).Return(nil)
+		m.EXPECT().GetCounter(consumer.LimitedRequestsMetricName).AnyTimes().Return(s.limitedRequests, nil)
+	}
+
+	if opts.Windows != nil {
+		m.EXPECT().AddCounter(consumer.WindowDroppedLinesMetricName, gomock.Any(), []string{"source", "reason"}).Return(nil)
+		m.EXPECT().GetCounter(consumer.WindowDroppedLinesMetricName).AnyTimes().Return(s.windowDroppedLines, nil)
 	}
 
+	if opts.UniqueVisitors != nil {
+		m.EXPECT().AddGauge(consumer.UniqueVisitorsMetricName, gomock.Any(), append([]string{
+			"window",
+		}, opts.UniqueVisitors.Dimensions...)).Return(nil)
+		m.EXPECT().GetGauge(consumer.UniqueVisitorsMetricName).AnyTimes().Return(s.uniqueVisitors, nil)
+	}
+
+	if opts.TopClients != nil {
+		m.EXPECT().AddGauge(consumer.TopClientRequestsMetricName, gomock.Any(), []string{
+			"client",
+		}).Return(nil)
+		m.EXPECT().GetGauge(consumer.TopClientRequestsMetricName).AnyTimes().Return(s.topClients, nil)
+	}
+
+	if len(opts.SLOs) > 0 {
+		for name, labels := range sloCounterLabels {
+			m.EXPECT().AddCounter(name, gomock.Any(), expectedLabels(opts, name, labels...)).Return(nil)
+			s.sloCounters[name] = mock_metrics.NewMockCounterT(ctrl)
+			m.EXPECT().GetCounter(name).AnyTimes().Return(s.sloCounters[name], nil)
+		}
+	}
+
+	for _, name := range exporterCounterNames {
+		s.exporterCounters[name] = mock_metrics.NewMockCounterT(ctrl)
+		m.EXPECT().GetCounter(name).AnyTimes().Return(s.exporterCounters[name], nil)
+	}
+	m.EXPECT().GetHistogram(consumer.PollDurationMetricName).AnyTimes().Return(s.pollDuration, nil)
+	m.EXPECT().GetHistogram(consumer.IngestionLagMetricName).AnyTimes().Return(s.ingestionLag, nil)
+	m.EXPECT().GetGauge(consumer.LastConsumedMetricName).AnyTimes().Return(s.lastConsumed, nil)
+	m.EXPECT().GetGauge(consumer.NewestLogTimestampMetricName).AnyTimes().Return(s.newestLog, nil)
+
+	t.EXPECT().Stats().AnyTimes().Return(file.Stats{})
+
 	m.EXPECT().GetCounter(consumer.ResponseCountMetricName).AnyTimes().Return(s.responseCounts, nil)
 	m.EXPECT().GetCounter(consumer.ResponseCountDetailedMetricName).AnyTimes().Return(s.responseCountsDetailed, nil)
 	m.EXPECT().GetHistogram(consumer.ResponseDurationMetricName).AnyTimes().Return(s.responseTime, nil)
 	m.EXPECT().GetHistogram(consumer.ResponseSizeMetricName).AnyTimes().Return(s.responseSize, nil)
+	m.EXPECT().GetCounter(consumer.StreamSessionsMetricName).AnyTimes().Return(s.streamSessions, nil)
+	m.EXPECT().GetHistogram(consumer.StreamSessionDurationMetricName).AnyTimes().Return(s.streamDuration, nil)
+	m.EXPECT().GetCounter(consumer.StreamBytesSentMetricName).AnyTimes().Return(s.streamBytesSent, nil)
+	m.EXPECT().GetCounter(consumer.StreamBytesReceivedMetricName).AnyTimes().Return(s.streamBytesReceived, nil)
+	m.EXPECT().GetCounter(consumer.ErrorLogMessagesMetricName).AnyTimes().Return(s.errorLogMessages, nil)
+	m.EXPECT().GetCounter(consumer.ErrorLogEventsMetricName).AnyTimes().Return(s.errorLogEvents, nil)
+	m.EXPECT().GetCounter(consumer.ErrorLogLimitedRequestsMetricName).AnyTimes().Return(s.errorLogLimited, nil)
 
 	return t, m, s
 }
 
+// mockInitHTTPMetrics expects registration of the HTTP response metrics.
+func mockInitHTTPMetrics(m *mock_metrics.MockManagerT, opts consumer.Options) {
+	m.EXPECT().AddCounter(consumer.ResponseCountMetricName, gomock.Any(), expectedLabels(opts, consumer.ResponseCountMetricName,
+		"status_code",
+	)).Return(nil)
+
+	m.EXPECT().AddCounter(consumer.ResponseCountDetailedMetricName, gomock.Any(), expectedLabels(opts, consumer.ResponseCountDetailedMetricName,
+		"status_code",
+		"path",
+		"method",
+	)).Return(nil)
+
+	var durationBuckets gomock.Matcher = gomock.Nil()
+	if b, ok := opts.Buckets[consumer.ResponseDurationMetricName]; ok {
+		durationBuckets = FloatElementsEq(b)
+	}
+	sizeBuckets := FloatElementsEq([]float64{8, 16, 64, 128, 256, 512, 1024, 2048, 4096})
+	if b, ok := opts.Buckets[consumer.ResponseSizeMetricName]; ok {
+		sizeBuckets = FloatElementsEq(b)
+	}
+
+	if opts.NativeHistograms != nil {
+		m.EXPECT().AddNativeHistogram(consumer.ResponseDurationMetricName, gomock.Any(), expectedLabels(opts, consumer.ResponseDurationMetricName,
+			"status_code",
+		), durationBuckets, *opts.NativeHistograms).Return(nil)
+
+		m.EXPECT().AddNativeHistogram(consumer.ResponseSizeMetricName, gomock.Any(), expectedLabels(opts, consumer.ResponseSizeMetricName,
+			"status_code",
+		), sizeBuckets, *opts.NativeHistograms).Return(nil)
+	} else {
+		m.EXPECT().AddHistogram(consumer.ResponseDurationMetricName, gomock.Any(), expectedLabels(opts, consumer.ResponseDurationMetricName,
+			"status_code",
+		), durationBuckets).Return(nil)
+
+		m.EXPECT().AddHistogram(consumer.ResponseSizeMetricName, gomock.Any(), expectedLabels(opts, consumer.ResponseSizeMetricName,
+			"status_code",
+		), sizeBuckets).Return(nil)
+	}
+}
+
+// mockInitStreamMetrics expects registration of the stream session metrics.
+func mockInitStreamMetrics(m *mock_metrics.MockManagerT, opts consumer.Options) {
+	m.EXPECT().AddCounter(consumer.StreamSessionsMetricName, gomock.Any(), expectedLabels(opts, consumer.StreamSessionsMetricName, "status_code")).Return(nil)
+
+	durationBuckets := FloatElementsEq([]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60, 300, 900, 3600})
+	if b, ok := opts.Buckets[consumer.StreamSessionDurationMetricName]; ok {
+		durationBuckets = FloatElementsEq(b)
+	}
+	if opts.NativeHistograms != nil {
+		m.EXPECT().AddNativeHistogram(consumer.StreamSessionDurationMetricName, gomock.Any(), expectedLabels(opts, consumer.StreamSessionDurationMetricName, "status_code"), durationBuckets, *opts.NativeHistograms).Return(nil)
+	} else {
+		m.EXPECT().AddHistogram(consumer.StreamSessionDurationMetricName, gomock.Any(), expectedLabels(opts, consumer.StreamSessionDurationMetricName, "status_code"), durationBuckets).Return(nil)
+	}
+
+	m.EXPECT().AddCounter(consumer.StreamBytesSentMetricName, gomock.Any(), expectedLabels(opts, consumer.StreamBytesSentMetricName, "upstream")).Return(nil)
+	m.EXPECT().AddCounter(consumer.StreamBytesReceivedMetricName, gomock.Any(), expectedLabels(opts, consumer.StreamBytesReceivedMetricName, "upstream")).Return(nil)
+}
+
 // Tests
 
 func testWithoutDetailedCountsBase(format, timeExample string, t *testing.T) {
@@ -223,10 +540,10 @@ func testWithoutDetailedCountsBase(format, timeExample string, t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	tailer, manager, metricsSet := mockInit(ctrl)
+	tailer, manager, metricsSet := mockInit(ctrl, consumer.Options{})
 
 	minCreationTime := time.Now()
-	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, format)
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, format, consumer.Options{})
 	if err != nil {
 		t.Fatalf("Could not build new consumer: %v", err)
 	}
@@ -278,6 +595,8 @@ func testWithoutDetailedCountsBase(format, timeExample string, t *testing.T) {
 		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
 	)
 
+	metricsSet.expectAnyExporterMetricUpdates()
+
 	metricsSet.responseCounts.EXPECT().Add(map[string]string{"status_code": "200"}, FloatEq(2)).Return(nil)
 	metricsSet.responseCounts.EXPECT().Add(map[string]string{"status_code": "500"}, FloatEq(1)).Return(nil)
 
@@ -311,13 +630,13 @@ func testWithDetailedCountsBase(format, timeExample string, t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	tailer, manager, metricsSet := mockInit(ctrl)
+	tailer, manager, metricsSet := mockInit(ctrl, consumer.Options{})
 
 	minCreationTime := time.Now()
 	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{
 		"/foo",
 		"/bar",
-	}, format)
+	}, format, consumer.Options{})
 	if err != nil {
 		t.Fatalf("Could not build new consumer: %v", err)
 	}
@@ -385,6 +704,8 @@ func testWithDetailedCountsBase(format, timeExample string, t *testing.T) {
 		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
 	)
 
+	metricsSet.expectAnyExporterMetricUpdates()
+
 	metricsSet.responseCounts.EXPECT().Add(map[string]string{"status_code": "200"}, FloatEq(3)).Return(nil)
 	metricsSet.responseCounts.EXPECT().Add(map[string]string{"status_code": "500"}, FloatEq(2)).Return(nil)
 
@@ -425,3 +746,2188 @@ func TestWithDetailedCountsJson(t *testing.T) {
 func TestWithDetailedCountsClf(t *testing.T) {
 	testWithDetailedCountsBase("CLF", consumer.CLF, t)
 }
+
+func TestNativeHistograms(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		NativeHistograms: &metrics.NativeHistogramOpts{
+			BucketFactor:    1.1,
+			MaxBucketNumber: 100,
+		},
+	}
+
+	// Observations are checked via a real manager, since native buckets are
+	// only visible in the gathered histograms.
+	registry := prometheus.NewRegistry()
+	manager := metrics.NewManager(nil, registry, registry)
+	tailer := mock_tailer.NewMockTailerT(ctrl)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+	line := fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100}\n", timeLate)
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return([]byte(line), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+	tailer.EXPECT().Stats().AnyTimes().Return(file.Stats{})
+
+	testRunConsumer(t, c)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Could not gather metrics: %v", err)
+	}
+	observed := make(map[string]bool)
+	for _, family := range families {
+		name := family.GetName()
+		if name != consumer.ResponseDurationMetricName && name != consumer.ResponseSizeMetricName {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			h := m.GetHistogram()
+			if got := h.GetSampleCount(); got != 1 {
+				t.Errorf("Expected 1 observation in %s, got %d", name, got)
+			}
+			var native uint64
+			for _, delta := range h.GetPositiveDelta() {
+				native = uint64(int64(native) + delta)
+			}
+			if len(h.GetPositiveSpan()) == 0 || native != 1 {
+				t.Errorf("Expected the observation in %s to be recorded in a native bucket, got: %v", name, h)
+			}
+			observed[name] = true
+		}
+	}
+	for _, name := range []string{consumer.ResponseDurationMetricName, consumer.ResponseSizeMetricName} {
+		if !observed[name] {
+			t.Errorf("Expected an observation in %s", name)
+		}
+	}
+}
+
+func TestCustomBuckets(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		Buckets: map[string][]float64{
+			consumer.ResponseDurationMetricName: {0.1, 1, 10},
+			consumer.ResponseSizeMetricName:     {1024, 4096, 16384, 65536},
+		},
+	}
+
+	tailer, manager, _ := mockInit(ctrl, opts)
+
+	if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts); err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+}
+
+func TestInvalidBuckets(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, buckets := range []map[string][]float64{
+		{consumer.ResponseSizeMetricName: {1024, 512}},
+		{consumer.ResponseSizeMetricName: {}},
+		{"nginx_unknown_histogram": {1, 2, 3}},
+		// Known histograms which are not enabled.
+		{consumer.StreamSessionDurationMetricName: {1, 2, 3}},
+		{consumer.RequestsPerConnectionMetricName: {1, 2, 3}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+		manager.EXPECT().AddCounter(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+		manager.EXPECT().AddHistogram(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+		manager.EXPECT().GetCounter(gomock.Any()).AnyTimes().Return(mock_metrics.NewMockCounterT(ctrl), nil)
+		manager.EXPECT().GetHistogram(gomock.Any()).AnyTimes().Return(mock_metrics.NewMockHistogramT(ctrl), nil)
+		manager.EXPECT().AddGauge(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+		manager.EXPECT().GetGauge(gomock.Any()).AnyTimes().Return(mock_metrics.NewMockGaugeT(ctrl), nil)
+
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", consumer.Options{
+			Buckets: buckets,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for buckets: %v", buckets)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestExporterMetrics(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tailer, manager, metricsSet := mockInit(ctrl, consumer.Options{})
+
+	minCreationTime := time.Now()
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", consumer.Options{})
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+	maxCreationTime := time.Now()
+
+	timeEarly := minCreationTime.Add(-1 * time.Minute).Format(consumer.ISO8601)
+	timeLate := maxCreationTime.Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []logLine{
+		{
+			Time:        timeEarly,
+			Status:      "200",
+			RequestTime: "0.010",
+			BytesSent:   "100",
+			Method:      "GET",
+			Path:        "/",
+		},
+		{
+			Time:        timeLate,
+			Status:      "200",
+			RequestTime: "0.020",
+			BytesSent:   "200",
+			Method:      "GET",
+			Path:        "/foo",
+		},
+		{
+			Time:        timeLate,
+			Status:      "400",
+			RequestTime: "0.020",
+			BytesSent:   "200",
+			Method:      "GET",
+			Path:        "/foo bar",
+		},
+		{
+			Time:        timeLate,
+			Status:      "400",
+			RequestTime: "0.020",
+			BytesSent:   "200",
+			Method:      "GET",
+			Path:        "foo",
+		},
+		{
+			Time:        "not a timestamp",
+			Status:      "200",
+			RequestTime: "0.030",
+			BytesSent:   "300",
+			Method:      "GET",
+			Path:        "/foo",
+		},
+	} {
+		buildLogLine("JSON", line, &buffer)
+	}
+	buffer.WriteString("this is not json\n")
+	numBytes := buffer.Len()
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	// Every line read is either parsed or a parse error, while lines with a
+	// malformed request or path are parsed (and counted as responses), but
+	// skipped by path-based metrics.
+	const (
+		linesRead   = 6
+		linesParsed = 4
+		parseErrors = 2
+	)
+	if linesRead != linesParsed+parseErrors {
+		t.Fatalf("Inconsistent expected line counts")
+	}
+
+	source := map[string]string{"source": "access_log"}
+	for name, want := range map[string]float64{
+		consumer.LinesReadMetricName:   linesRead,
+		consumer.LinesParsedMetricName: linesParsed,
+		consumer.BytesReadMetricName:   float64(numBytes),
+	} {
+		gomock.InOrder(
+			metricsSet.exporterCounters[name].EXPECT().Add(source, FloatEq(want)).Return(nil),
+			metricsSet.exporterCounters[name].EXPECT().Add(source, FloatEq(0)).AnyTimes().Return(nil),
+		)
+	}
+	for _, reason := range []string{"before_startup", "malformed_request", "malformed_path"} {
+		metricsSet.exporterCounters[consumer.LinesSkippedMetricName].EXPECT().Add(map[string]string{
+			"source": "access_log",
+			"reason": reason,
+		}, FloatEq(1)).Return(nil)
+	}
+	metricsSet.exporterCounters[consumer.ParseErrorsMetricName].EXPECT().Add(map[string]string{
+		"source": "access_log",
+		"format": "JSON",
+		"reason": "bad_timestamp",
+	}, FloatEq(1)).Return(nil)
+	metricsSet.exporterCounters[consumer.ParseErrorsMetricName].EXPECT().Add(map[string]string{
+		"source": "access_log",
+		"format": "JSON",
+		"reason": "malformed_line",
+	}, FloatEq(1)).Return(nil)
+	metricsSet.exporterCounters[consumer.RotationsMetricName].EXPECT().Add(source, FloatEq(0)).AnyTimes().Return(nil)
+	metricsSet.exporterCounters[consumer.TruncationsMetricName].EXPECT().Add(source, FloatEq(0)).AnyTimes().Return(nil)
+	metricsSet.pollDuration.EXPECT().Observe(source, gomock.Any()).MinTimes(1).Return(nil)
+	metricsSet.lastConsumed.EXPECT().Set(source, gomock.Any()).Times(1).Return(nil)
+
+	newest, err := time.Parse(consumer.ISO8601, timeLate)
+	if err != nil {
+		t.Fatalf("Could not parse test timestamp: %v", err)
+	}
+	metricsSet.newestLog.EXPECT().Set(source, FloatEq(float64(newest.Unix()))).Times(1).Return(nil)
+	// The sole consumed line is timestamped one minute in the future, less up
+	// to one second lost to timestamp precision, plus time spent polling.
+	metricsSet.ingestionLag.EXPECT().Observe(source, FloatElementsInRange(-61, -58)).Times(1).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestExemplars(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		ExemplarField: "http_traceparent",
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, traceparent := range []string{
+		"\"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\"",
+		"\"some-request-id\"",
+		"\"\"",
+		"null",
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100, \"http_traceparent\": %s}\n", timeLate, traceparent)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(map[string]string{"status_code": "200"}, FloatEq(4)).Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(map[string]string{"status_code": "200"}, FloatElementsEq([]float64{100, 100, 100, 100})).Return(nil)
+
+	metricsSet.responseTime.EXPECT().Observe(map[string]string{"status_code": "200"}, FloatElementsEq([]float64{0.5, 0.5})).Return(nil)
+	metricsSet.responseTime.EXPECT().ObserveWithExemplar(map[string]string{"status_code": "200"}, FloatEq(0.5), map[string]string{
+		"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"span_id":  "00f067aa0ba902b7",
+	}).Return(nil)
+	metricsSet.responseTime.EXPECT().ObserveWithExemplar(map[string]string{"status_code": "200"}, FloatEq(0.5), map[string]string{
+		"http_traceparent": "some-request-id",
+	}).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestExemplarsUnsupportedFormat(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tailer := mock_tailer.NewMockTailerT(ctrl)
+	manager := mock_metrics.NewMockManagerT(ctrl)
+
+	for _, tc := range []struct {
+		format string
+		field  string
+	}{
+		{"CLF", "request_id"},
+		{"JSON", "not-a-label-name"},
+	} {
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, consumer.Options{
+			ExemplarField: tc.field,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for exemplar field %q in format %s", tc.field, tc.format)
+		}
+	}
+}
+
+func TestSLOs(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	slos, err := consumer.ParseSLOs([]byte(`[
+		{"name": "api", "route": "^/api/", "latency_threshold": "100ms", "error_statuses": ["5xx", "429"]},
+		{"name": "availability", "method": "GET"}
+	]`))
+	if err != nil {
+		t.Fatalf("Could not parse SLOs: %v", err)
+	}
+	opts := consumer.Options{SLOs: slos}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []logLine{
+		// Satisfied: Exactly at the threshold.
+		{
+			Time:        timeLate,
+			Status:      "200",
+			RequestTime: "0.100",
+			BytesSent:   "100",
+			Method:      "GET",
+			Path:        "/api/foo",
+		},
+		// Tolerating: Slow, but within 4x the threshold.
+		{
+			Time:        timeLate,
+			Status:      "200",
+			RequestTime: "0.250",
+			BytesSent:   "100",
+			Method:      "POST",
+			Path:        "/api/foo",
+		},
+		// Frustrated: Slower than 4x the threshold.
+		{
+			Time:        timeLate,
+			Status:      "200",
+			RequestTime: "0.500",
+			BytesSent:   "100",
+			Method:      "GET",
+			Path:        "/api/bar?baz=1",
+		},
+		// Frustrated: Error status (only for the api SLO).
+		{
+			Time:        timeLate,
+			Status:      "429",
+			RequestTime: "0.010",
+			BytesSent:   "100",
+			Method:      "GET",
+			Path:        "/api/bar",
+		},
+		// Not matching the api SLO route.
+		{
+			Time:        timeLate,
+			Status:      "503",
+			RequestTime: "0.010",
+			BytesSent:   "100",
+			Method:      "GET",
+			Path:        "/static/foo",
+		},
+	} {
+		buildLogLine("JSON", line, &buffer)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	events := metricsSet.sloCounters[consumer.SLOEventsMetricName]
+	events.EXPECT().Add(map[string]string{"slo": "api"}, FloatEq(4)).Return(nil)
+	events.EXPECT().Add(map[string]string{"slo": "availability"}, FloatEq(4)).Return(nil)
+
+	good := metricsSet.sloCounters[consumer.SLOGoodEventsMetricName]
+	good.EXPECT().Add(map[string]string{"slo": "api"}, FloatEq(1)).Return(nil)
+	good.EXPECT().Add(map[string]string{"slo": "availability"}, FloatEq(3)).Return(nil)
+
+	bad := metricsSet.sloCounters[consumer.SLOBadEventsMetricName]
+	bad.EXPECT().Add(map[string]string{"slo": "api", "reason": "latency"}, FloatEq(2)).Return(nil)
+	bad.EXPECT().Add(map[string]string{"slo": "api", "reason": "error"}, FloatEq(1)).Return(nil)
+	bad.EXPECT().Add(map[string]string{"slo": "availability", "reason": "error"}, FloatEq(1)).Return(nil)
+
+	apdex := metricsSet.sloCounters[consumer.SLOApdexMetricName]
+	apdex.EXPECT().Add(map[string]string{"slo": "api", "class": "satisfied"}, FloatEq(1)).Return(nil)
+	apdex.EXPECT().Add(map[string]string{"slo": "api", "class": "tolerating"}, FloatEq(1)).Return(nil)
+	apdex.EXPECT().Add(map[string]string{"slo": "api", "class": "frustrated"}, FloatEq(2)).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestDuplicateSLOs(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	slos, err := consumer.ParseSLOs([]byte(`[{"name": "api"}, {"name": "api"}]`))
+	if err != nil {
+		t.Fatalf("Could not parse SLOs: %v", err)
+	}
+
+	tailer := mock_tailer.NewMockTailerT(ctrl)
+	manager := mock_metrics.NewMockManagerT(ctrl)
+	manager.EXPECT().AddCounter(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	manager.EXPECT().AddHistogram(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	manager.EXPECT().GetCounter(gomock.Any()).AnyTimes().Return(mock_metrics.NewMockCounterT(ctrl), nil)
+	manager.EXPECT().GetHistogram(gomock.Any()).AnyTimes().Return(mock_metrics.NewMockHistogramT(ctrl), nil)
+	manager.EXPECT().AddGauge(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	manager.EXPECT().GetGauge(gomock.Any()).AnyTimes().Return(mock_metrics.NewMockGaugeT(ctrl), nil)
+
+	if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", consumer.Options{
+		SLOs: slos,
+	}); err == nil {
+		t.Errorf("Expected NewConsumer to fail for duplicate SLO names")
+	}
+}
+
+func TestTopClients(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		TopClients: &consumer.TopClientsOptions{
+			N:             2,
+			Field:         "http_x_forwarded_for",
+			Window:        time.Nanosecond,
+			IPv4PrefixLen: 24,
+			IPv6PrefixLen: 64,
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, client := range []string{
+		"\"10.0.0.1\"",
+		"\"10.0.0.2, 192.168.0.1\"",
+		"\"10.0.0.3\"",
+		"\"2001:db8::1\"",
+		"\"2001:db8::2\"",
+		"\"10.0.1.1\"",
+		"\"-\"",
+		"null",
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100, \"http_x_forwarded_for\": %s}\n", timeLate, client)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	// Only the top two clients (after truncation) are exported, and are
+	// deleted once the following (empty) window closes.
+	for client, count := range map[string]float64{
+		"10.0.0.0/24":   3,
+		"2001:db8::/64": 2,
+	} {
+		labels := map[string]string{"client": client}
+		gomock.InOrder(
+			metricsSet.topClients.EXPECT().Set(labels, FloatEq(count)).Return(nil),
+			metricsSet.topClients.EXPECT().Delete(labels).MaxTimes(1).Return(true),
+		)
+	}
+
+	testRunConsumer(t, c)
+}
+
+func TestTopClientsInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		format string
+		opts   consumer.TopClientsOptions
+	}{
+		{"JSON", consumer.TopClientsOptions{}},
+		{"JSON", consumer.TopClientsOptions{N: 10, Capacity: 5}},
+		{"JSON", consumer.TopClientsOptions{N: 10, IPv4PrefixLen: 33}},
+		{"JSON", consumer.TopClientsOptions{N: 10, IPv6PrefixLen: -1}},
+		{"CLF", consumer.TopClientsOptions{N: 10, Field: "http_x_forwarded_for"}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		opts := tc.opts
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, consumer.Options{
+			TopClients: &opts,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with top clients options: %+v", tc.format, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestTopPaths(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		TopPaths: &consumer.TopPathsOptions{
+			Capacity: 10,
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []logLine{
+		{
+			Status:      "200",
+			RequestTime: "0.010",
+			Path:        "/users/123",
+		},
+		{
+			Status:      "500",
+			RequestTime: "0.030",
+			Path:        "/users/456?foo=bar",
+		},
+		{
+			Status:      "200",
+			RequestTime: "0.020",
+			Path:        "/objects/0123456789abcdef0123/content",
+		},
+		{
+			Status:      "200",
+			RequestTime: "0.020",
+			Path:        "/users/123e4567-e89b-12d3-a456-426614174000",
+		},
+		{
+			Status:      "200",
+			RequestTime: "0.050",
+			Path:        "/users/123",
+		},
+	} {
+		line.Time = timeLate
+		line.Method = "GET"
+		line.BytesSent = "100"
+		buildLogLine("JSON", line, &buffer)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	testRunConsumer(t, c)
+
+	s := httptest.NewServer(c.TopPathsHandler())
+	defer s.Close()
+
+	resp, err := s.Client().Get(s.URL + "?n=2")
+	if err != nil {
+		t.Fatalf("Could not fetch top paths: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var got consumer.TopPaths
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Could not decode top paths: %v", err)
+	}
+
+	if want := uint64(5); got.Requests != want {
+		t.Errorf("Expected %d requests, got %d", want, got.Requests)
+	}
+	if len(got.Paths) != 2 {
+		t.Fatalf("Expected 2 paths, got: %+v", got.Paths)
+	}
+	if p := got.Paths[0]; p.Path != "/users/{id}" || p.Count != 3 || p.CountError != 0 || !floatEq(p.ErrorRate, 1.0/3) || !floatEq(p.MeanLatencySeconds, 0.03) || !floatEq(p.MaxLatencySeconds, 0.05) {
+		t.Errorf("Unexpected stats for top path: %+v", p)
+	}
+	// Remaining paths are tied, and thus ordered by path.
+	if p := got.Paths[1]; p.Path != "/objects/{hex}/content" || p.Count != 1 || p.ErrorRate != 0 {
+		t.Errorf("Unexpected stats for second path: %+v", p)
+	}
+
+	resp, err = s.Client().Get(s.URL + "?n=foo")
+	if err != nil {
+		t.Fatalf("Could not fetch top paths: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid path count, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestUniqueVisitors(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "unique_visitors")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := consumer.Options{
+		UniqueVisitors: &consumer.UniqueVisitorsOptions{
+			Dimensions:    []string{"host", "path"},
+			Windows:       []time.Duration{time.Minute, time.Hour},
+			StatePath:     filepath.Join(dir, "visitors.gob"),
+			PersistPeriod: time.Nanosecond,
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	// Note: Log timestamps are only used to place visits within windows.
+	timeNow := time.Now().Add(time.Second).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, visit := range []struct {
+		addr string
+		host string
+		path string
+	}{
+		{"10.0.0.1", "a.example.com", "/users/1"},
+		{"10.0.0.1", "a.example.com", "/users/2"},
+		{"10.0.0.2", "a.example.com", "/users/3"},
+		{"10.0.0.3", "a.example.com", "/users/4"},
+		{"10.0.0.1", "b.example.com", "/users/5"},
+		{"-", "b.example.com", "/users/6"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET %s HTTP/1.1\", \"bytes_sent\": 100, \"remote_addr\": \"%s\", \"host\": \"%s\"}\n", timeNow, visit.path, visit.addr, visit.host)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	expected := map[string]float64{
+		"a.example.com": 3,
+		"b.example.com": 1,
+	}
+	for host, count := range expected {
+		for _, window := range []string{"1m", "1h"} {
+			metricsSet.uniqueVisitors.EXPECT().Set(map[string]string{
+				"window": window,
+				"host":   host,
+				"path":   "/users/{id}",
+			}, FloatEq(count)).MinTimes(1).Return(nil)
+		}
+	}
+
+	testRunConsumer(t, c)
+
+	if _, err := os.Stat(opts.UniqueVisitors.StatePath); err != nil {
+		t.Fatalf("Expected unique visitor state to be persisted: %v", err)
+	}
+
+	// A new consumer restores the persisted sketches.
+	ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tailer, manager, metricsSet = mockInit(ctrl, opts)
+
+	c, err = consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil)
+	metricsSet.expectAnyExporterMetricUpdates()
+
+	for host, count := range expected {
+		for _, window := range []string{"1m", "1h"} {
+			metricsSet.uniqueVisitors.EXPECT().Set(map[string]string{
+				"window": window,
+				"host":   host,
+				"path":   "/users/{id}",
+			}, FloatEq(count)).MinTimes(1).Return(nil)
+		}
+	}
+
+	testRunConsumer(t, c)
+
+	// A consumer configured with a differing precision discards the
+	// persisted sketches.
+	rebuiltOpts := *opts.UniqueVisitors
+	rebuiltOpts.Precision = 10
+	opts.UniqueVisitors = &rebuiltOpts
+
+	ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tailer, manager, metricsSet = mockInit(ctrl, opts)
+
+	c, err = consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil)
+	metricsSet.expectAnyExporterMetricUpdates()
+
+	for host := range expected {
+		for _, window := range []string{"1m", "1h"} {
+			metricsSet.uniqueVisitors.EXPECT().Set(map[string]string{
+				"window": window,
+				"host":   host,
+				"path":   "/users/{id}",
+			}, FloatEq(0)).MinTimes(1).Return(nil)
+		}
+	}
+
+	testRunConsumer(t, c)
+}
+
+func TestUniqueVisitorsInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, opts := range []consumer.UniqueVisitorsOptions{
+		{Dimensions: []string{"window"}},
+		{Dimensions: []string{"not-a-label"}},
+		{Dimensions: []string{"host", "host"}},
+		{Windows: []time.Duration{time.Second}},
+		{Windows: []time.Duration{time.Hour, 60 * time.Minute}},
+		{Precision: 30},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		opts := opts
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", consumer.Options{
+			UniqueVisitors: &opts,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for unique visitors options: %+v", opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestAgentClassClf(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		AgentClass: &consumer.AgentClassOptions{},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{"/foo"}, "CLF", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.CLF)
+
+	var buffer bytes.Buffer
+	for _, agent := range []string{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+		"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)",
+		"curl/7.68.0",
+		"python-requests/2.31.0",
+		"Go-http-client/1.1",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:121.0) Gecko/20100101 Firefox/121.0",
+		"-",
+	} {
+		fmt.Fprintf(&buffer, "127.0.0.1 - - [%s] \"GET /foo HTTP/1.1\" 200 100 \"-\" \"%s\"\n", timeLate, agent)
+	}
+	// Lines in plain CLF (lacking a user agent) are classified as unknown.
+	fmt.Fprintf(&buffer, "127.0.0.1 - - [%s] \"GET /foo HTTP/1.1\" 200 100\n", timeLate)
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseSize.EXPECT().Observe(map[string]string{"status_code": "200"}, gomock.Any()).Return(nil)
+
+	for class, count := range map[string]float64{
+		"crawler":    1,
+		"monitoring": 1,
+		"library":    3,
+		"mobile":     1,
+		"desktop":    2,
+		"unknown":    2,
+	} {
+		metricsSet.responseCounts.EXPECT().Add(map[string]string{
+			"status_code": "200",
+			"agent_class": class,
+		}, FloatEq(count)).Return(nil)
+		metricsSet.responseCountsDetailed.EXPECT().Add(map[string]string{
+			"status_code": "200",
+			"path":        "/foo",
+			"method":      "GET",
+			"agent_class": class,
+		}, FloatEq(count)).Return(nil)
+	}
+
+	testRunConsumer(t, c)
+}
+
+func TestAgentClassRulesReload(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "agent_class")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rulesPath := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(rulesPath, []byte(`[{"class": "internal", "pattern": "^internal-client/"}]`), 0644); err != nil {
+		t.Fatalf("Could not write rules: %v", err)
+	}
+
+	opts := consumer.Options{
+		AgentClass: &consumer.AgentClassOptions{
+			Field:     "agent",
+			RulesPath: rulesPath,
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	// Rules modified after startup are reloaded prior to the next poll.
+	if err := ioutil.WriteFile(rulesPath, []byte(`[{"class": "service", "pattern": "^internal-client/"}]`), 0644); err != nil {
+		t.Fatalf("Could not write rules: %v", err)
+	}
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(rulesPath, modTime, modTime); err != nil {
+		t.Fatalf("Could not update rules modification time: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, agent := range []string{
+		"internal-client/1.0",
+		"internal-client/2.0",
+		"curl/7.68.0",
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100, \"agent\": \"%s\"}\n", timeLate, agent)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseTime.EXPECT().Observe(map[string]string{"status_code": "200"}, gomock.Any()).Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(map[string]string{"status_code": "200"}, gomock.Any()).Return(nil)
+
+	metricsSet.responseCounts.EXPECT().Add(map[string]string{
+		"status_code": "200",
+		"agent_class": "service",
+	}, FloatEq(2)).Return(nil)
+	metricsSet.responseCounts.EXPECT().Add(map[string]string{
+		"status_code": "200",
+		"agent_class": "unknown",
+	}, FloatEq(1)).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestAgentClassInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "agent_class")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalidPath := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalidPath, []byte(`[{"class": "broken", "pattern": "("}]`), 0644); err != nil {
+		t.Fatalf("Could not write rules: %v", err)
+	}
+
+	for _, tc := range []struct {
+		format string
+		opts   consumer.AgentClassOptions
+	}{
+		{"JSON", consumer.AgentClassOptions{RulesPath: filepath.Join(dir, "missing.json")}},
+		{"JSON", consumer.AgentClassOptions{RulesPath: invalidPath}},
+		{"CLF", consumer.AgentClassOptions{Field: "agent"}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		opts := tc.opts
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, consumer.Options{
+			AgentClass: &opts,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with agent class options: %+v", tc.format, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestProtocols(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		HTTPProtocols: &consumer.ProtocolDimensionOptions{},
+		TLSProtocols:  &consumer.ProtocolDimensionOptions{},
+		TLSCiphers: &consumer.ProtocolDimensionOptions{
+			Field:   "cipher",
+			Allowed: []string{"TLS_AES_128_GCM_SHA256"},
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		request  string
+		protocol string
+		cipher   string
+	}{
+		{"GET / HTTP/1.1", "TLSv1.3", "TLS_AES_128_GCM_SHA256"},
+		{"GET / HTTP/2.0", "TLSv1.3", "TLS_AES_256_GCM_SHA384"},
+		{"GET / HTTP/1.0", "TLSv1", "AES128-SHA"},
+		{"GET / HTTP/1.1", "", ""},
+		{"GET / SPDY/3", "TLSv1.2", "ECDHE-RSA-AES128-GCM-SHA256"},
+		{"malformed", "TLSv1.2", "ECDHE-RSA-AES128-GCM-SHA256"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"%s\", \"bytes_sent\": 100, \"ssl_protocol\": \"%s\", \"cipher\": \"%s\"}\n", timeLate, line.request, line.protocol, line.cipher)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	for _, expected := range []struct {
+		name  string
+		label string
+		value string
+		count float64
+	}{
+		// Malformed request lines are excluded from HTTP protocol counts.
+		{consumer.HTTPProtocolMetricName, "protocol", "HTTP/1.1", 2},
+		{consumer.HTTPProtocolMetricName, "protocol", "HTTP/2.0", 1},
+		{consumer.HTTPProtocolMetricName, "protocol", "HTTP/1.0", 1},
+		{consumer.HTTPProtocolMetricName, "protocol", "other", 1},
+		{consumer.TLSProtocolMetricName, "tls_protocol", "TLSv1.3", 2},
+		{consumer.TLSProtocolMetricName, "tls_protocol", "TLSv1.2", 2},
+		{consumer.TLSProtocolMetricName, "tls_protocol", "TLSv1", 1},
+		{consumer.TLSProtocolMetricName, "tls_protocol", "none", 1},
+		{consumer.TLSCipherMetricName, "tls_cipher", "TLS_AES_128_GCM_SHA256", 1},
+		{consumer.TLSCipherMetricName, "tls_cipher", "other", 4},
+		{consumer.TLSCipherMetricName, "tls_cipher", "none", 1},
+	} {
+		metricsSet.protocolCounters[expected.name].EXPECT().Add(map[string]string{
+			expected.label: expected.value,
+		}, FloatEq(expected.count)).Return(nil)
+	}
+
+	testRunConsumer(t, c)
+}
+
+func TestHTTPProtocolsClf(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		HTTPProtocols: &consumer.ProtocolDimensionOptions{
+			Allowed: []string{"HTTP/1.1"},
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "CLF", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.CLF)
+
+	var buffer bytes.Buffer
+	for _, protocol := range []string{"HTTP/1.1", "HTTP/1.1", "HTTP/1.0"} {
+		fmt.Fprintf(&buffer, "127.0.0.1 - - [%s] \"GET / %s\" 200 100\n", timeLate, protocol)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	counter := metricsSet.protocolCounters[consumer.HTTPProtocolMetricName]
+	counter.EXPECT().Add(map[string]string{"protocol": "HTTP/1.1"}, FloatEq(2)).Return(nil)
+	counter.EXPECT().Add(map[string]string{"protocol": "other"}, FloatEq(1)).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestProtocolsInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		format string
+		opts   consumer.Options
+	}{
+		{"JSON", consumer.Options{HTTPProtocols: &consumer.ProtocolDimensionOptions{Field: "protocol"}}},
+		{"JSON", consumer.Options{HTTPProtocols: &consumer.ProtocolDimensionOptions{Allowed: []string{"HTTP/1.1", "other"}}}},
+		{"JSON", consumer.Options{TLSProtocols: &consumer.ProtocolDimensionOptions{Allowed: []string{""}}}},
+		{"JSON", consumer.Options{TLSCiphers: &consumer.ProtocolDimensionOptions{Allowed: []string{"none"}}}},
+		{"CLF", consumer.Options{TLSProtocols: &consumer.ProtocolDimensionOptions{}}},
+		{"CLF", consumer.Options{TLSCiphers: &consumer.ProtocolDimensionOptions{}}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, tc.opts); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with options: %+v", tc.format, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestConnections(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		Connections: &consumer.ConnectionsOptions{
+			IdleTimeout: time.Minute,
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		offset      time.Duration
+		connection  string
+		connRequest string
+	}{
+		{0, "1", "1"},
+		{0, "1", "3"},
+		{0, "1", "2"},
+		{0, "2", "1"},
+		// Connections opened prior to startup are not counted as opened.
+		{0, "3", "5"},
+		// Connections idle for less than the timeout remain open.
+		{2 * time.Minute, "4", "1"},
+		{2 * time.Minute, "4", "2"},
+		{2 * time.Minute, "null", "null"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100, \"connection\": %s, \"connection_requests\": %s}\n", timeLate.Add(line.offset).Format(consumer.ISO8601), line.connection, line.connRequest)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	metricsSet.connectionsOpened.EXPECT().Add(map[string]string{}, FloatEq(3)).Return(nil)
+	metricsSet.requestsPerConnection.EXPECT().Observe(map[string]string{}, FloatElementsEq([]float64{3, 1, 5}).AnyOrder()).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestConnectionsInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		format string
+		opts   consumer.ConnectionsOptions
+	}{
+		{"JSON", consumer.ConnectionsOptions{IdleTimeout: -time.Second}},
+		{"JSON", consumer.ConnectionsOptions{MaxTracked: -1}},
+		{"CLF", consumer.ConnectionsOptions{}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		opts := tc.opts
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, consumer.Options{
+			Connections: &opts,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with connections options: %+v", tc.format, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestLabelExtractions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		LabelExtractions: []consumer.LabelExtraction{
+			{
+				Label:       "api_version",
+				QueryParam:  "api_version",
+				Pattern:     regexp.MustCompile(`^v?([0-9]+)$`),
+				Replacement: "v$1",
+				Families:    []string{consumer.ResponseCountMetricName, consumer.ResponseCountDetailedMetricName},
+			},
+			{
+				Label:    "tenant",
+				Field:    "http_x_tenant_id",
+				Allowed:  []string{"acme", "globex"},
+				Families: []string{consumer.ResponseCountMetricName, consumer.ResponseDurationMetricName},
+			},
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{"/api"}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		path   string
+		tenant string
+	}{
+		{"/api?api_version=2", "\"acme\""},
+		{"/api?api_version=v2&x=y", "\"acme\""},
+		{"/api?api_version=latest", "\"initech\""},
+		{"/api", "\"-\""},
+		{"/other?api_version=3", "null"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET %s HTTP/1.1\", \"bytes_sent\": 100, \"http_x_tenant_id\": %s}\n", timeLate, line.path, line.tenant)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseSize.EXPECT().Observe(map[string]string{"status_code": "200"}, gomock.Any()).Return(nil)
+
+	for _, expected := range []struct {
+		version string
+		tenant  string
+		count   float64
+	}{
+		{"v2", "acme", 2},
+		{"other", "other", 1},
+		{"", "", 1},
+		{"v3", "", 1},
+	} {
+		metricsSet.responseCounts.EXPECT().Add(map[string]string{
+			"status_code": "200",
+			"api_version": expected.version,
+			"tenant":      expected.tenant,
+		}, FloatEq(expected.count)).Return(nil)
+	}
+	for version, count := range map[string]float64{"v2": 2, "other": 1, "": 1} {
+		metricsSet.responseCountsDetailed.EXPECT().Add(map[string]string{
+			"status_code": "200",
+			"path":        "/api",
+			"method":      "GET",
+			"api_version": version,
+		}, FloatEq(count)).Return(nil)
+	}
+	for tenant, observed := range map[string][]float64{
+		"acme":  {0.5, 0.5},
+		"other": {0.5},
+		"":      {0.5, 0.5},
+	} {
+		metricsSet.responseTime.EXPECT().Observe(map[string]string{
+			"status_code": "200",
+			"tenant":      tenant,
+		}, FloatElementsEq(observed)).Return(nil)
+	}
+
+	testRunConsumer(t, c)
+}
+
+func TestLabelExtractionsOtherFamilies(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	slos, err := consumer.ParseSLOs([]byte(`[{"name": "api", "route": "^/api/"}]`))
+	if err != nil {
+		t.Fatalf("Could not parse SLOs: %v", err)
+	}
+	opts := consumer.Options{
+		SLOs:          slos,
+		HTTPProtocols: &consumer.ProtocolDimensionOptions{},
+		Limits:        &consumer.LimitsOptions{},
+		Connections: &consumer.ConnectionsOptions{
+			IdleTimeout: time.Minute,
+		},
+		LabelExtractions: []consumer.LabelExtraction{
+			{
+				Label:   "tenant",
+				Field:   "http_x_tenant_id",
+				Allowed: []string{"acme"},
+				Families: []string{
+					consumer.SLOEventsMetricName,
+					consumer.SLOBadEventsMetricName,
+					consumer.HTTPProtocolMetricName,
+					consumer.LimitedRequestsMetricName,
+					consumer.ConnectionsOpenedMetricName,
+					consumer.RequestsPerConnectionMetricName,
+				},
+			},
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		offset      time.Duration
+		tenant      string
+		status      string
+		request     string
+		connection  string
+		connRequest string
+		limitReq    string
+	}{
+		{0, "acme", "200", "GET /api/foo HTTP/1.1", "1", "1", "REJECTED"},
+		{0, "globex", "503", "GET /api/bar HTTP/2.0", "2", "1", "PASSED"},
+		{0, "acme", "200", "GET /api/baz HTTP/1.1", "1", "2", "PASSED"},
+		// Closes the above connections, while remaining open.
+		{2 * time.Minute, "acme", "200", "GET /static/foo HTTP/1.1", "3", "5", "PASSED"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"request_time\": 0.5, \"request\": \"%s\", \"bytes_sent\": 100, \"http_x_tenant_id\": \"%s\", \"connection\": %s, \"connection_requests\": %s, \"limit_req_status\": \"%s\", \"server_name\": \"example.com\"}\n", timeLate.Add(line.offset).Format(consumer.ISO8601), line.status, line.request, line.tenant, line.connection, line.connRequest, line.limitReq)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	events := metricsSet.sloCounters[consumer.SLOEventsMetricName]
+	events.EXPECT().Add(map[string]string{"slo": "api", "tenant": "acme"}, FloatEq(2)).Return(nil)
+	events.EXPECT().Add(map[string]string{"slo": "api", "tenant": "other"}, FloatEq(1)).Return(nil)
+	// Families not named are exported without the label.
+	metricsSet.sloCounters[consumer.SLOGoodEventsMetricName].EXPECT().Add(map[string]string{"slo": "api"}, FloatEq(2)).Return(nil)
+	metricsSet.sloCounters[consumer.SLOBadEventsMetricName].EXPECT().Add(map[string]string{"slo": "api", "reason": "error", "tenant": "other"}, FloatEq(1)).Return(nil)
+
+	protocols := metricsSet.protocolCounters[consumer.HTTPProtocolMetricName]
+	protocols.EXPECT().Add(map[string]string{"protocol": "HTTP/1.1", "tenant": "acme"}, FloatEq(3)).Return(nil)
+	protocols.EXPECT().Add(map[string]string{"protocol": "HTTP/2.0", "tenant": "other"}, FloatEq(1)).Return(nil)
+
+	metricsSet.limitedRequests.EXPECT().Add(map[string]string{"limit": "req", "status": "rejected", "server": "example.com", "tenant": "acme"}, FloatEq(1)).Return(nil)
+
+	metricsSet.connectionsOpened.EXPECT().Add(map[string]string{"tenant": "acme"}, FloatEq(1)).Return(nil)
+	metricsSet.connectionsOpened.EXPECT().Add(map[string]string{"tenant": "other"}, FloatEq(1)).Return(nil)
+	metricsSet.requestsPerConnection.EXPECT().Observe(map[string]string{"tenant": "acme"}, FloatElementsEq([]float64{2})).Return(nil)
+	metricsSet.requestsPerConnection.EXPECT().Observe(map[string]string{"tenant": "other"}, FloatElementsEq([]float64{1})).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestStreamLabelExtractions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		LabelExtractions: []consumer.LabelExtraction{
+			{
+				Label:    "tenant",
+				Field:    "tenant",
+				Allowed:  []string{"acme"},
+				Families: []string{consumer.StreamSessionsMetricName, consumer.StreamBytesSentMetricName},
+			},
+		},
+	}
+
+	tailer, manager, metricsSet := mockInitFormat(ctrl, consumer.StreamFormat, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, consumer.StreamFormat, opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		status string
+		sent   float64
+		tenant string
+	}{
+		{"200", 100, "\"acme\""},
+		{"200", 200, "\"globex\""},
+		{"502", 0, "null"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"session_time\": 1, \"bytes_sent\": %g, \"bytes_received\": 10, \"upstream_addr\": \"10.0.0.1:5432\", \"tenant\": %s}\n", timeLate, line.status, line.sent, line.tenant)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+
+	metricsSet.streamSessions.EXPECT().Add(map[string]string{"status_code": "200", "tenant": "acme"}, FloatEq(1)).Return(nil)
+	metricsSet.streamSessions.EXPECT().Add(map[string]string{"status_code": "200", "tenant": "other"}, FloatEq(1)).Return(nil)
+	metricsSet.streamSessions.EXPECT().Add(map[string]string{"status_code": "502", "tenant": ""}, FloatEq(1)).Return(nil)
+
+	metricsSet.streamDuration.EXPECT().Observe(map[string]string{"status_code": "200"}, FloatElementsEq([]float64{1, 1})).Return(nil)
+	metricsSet.streamDuration.EXPECT().Observe(map[string]string{"status_code": "502"}, FloatElementsEq([]float64{1})).Return(nil)
+
+	metricsSet.streamBytesSent.EXPECT().Add(map[string]string{"upstream": "10.0.0.1:5432", "tenant": "acme"}, FloatEq(100)).Return(nil)
+	metricsSet.streamBytesSent.EXPECT().Add(map[string]string{"upstream": "10.0.0.1:5432", "tenant": "other"}, FloatEq(200)).Return(nil)
+	metricsSet.streamBytesSent.EXPECT().Add(map[string]string{"upstream": "10.0.0.1:5432", "tenant": ""}, FloatEq(0)).Return(nil)
+
+	metricsSet.streamBytesReceived.EXPECT().Add(map[string]string{"upstream": "10.0.0.1:5432"}, FloatEq(30)).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestLabelExtractionsInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		format      string
+		extractions []consumer.LabelExtraction
+	}{
+		{"JSON", []consumer.LabelExtraction{{Label: "not-a-label", QueryParam: "v", Allowed: []string{"1"}}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "version", Allowed: []string{"1"}}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "version", QueryParam: "v", Field: "v", Allowed: []string{"1"}}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "version", QueryParam: "v"}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "version", QueryParam: "v", Allowed: []string{"1"}, Replacement: "$1"}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "status_code", QueryParam: "v", Allowed: []string{"1"}}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "version", QueryParam: "v", Allowed: []string{"1"}, Families: []string{consumer.ParseErrorsMetricName}}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "version", QueryParam: "v", Allowed: []string{"1"}, Families: []string{consumer.TopClientRequestsMetricName}}}},
+		{"JSON", []consumer.LabelExtraction{
+			{Label: "version", QueryParam: "v", Allowed: []string{"1"}},
+			{Label: "version", Field: "version", Allowed: []string{"1"}},
+		}},
+		{"CLF", []consumer.LabelExtraction{{Label: "tenant", Field: "http_x_tenant_id", Allowed: []string{"acme"}}}},
+		{"JSON", []consumer.LabelExtraction{{Label: "reason", QueryParam: "v", Allowed: []string{"1"}, Families: []string{consumer.SLOBadEventsMetricName}}}},
+		{consumer.ErrorLogFormat, []consumer.LabelExtraction{{Label: "tenant", Field: "tenant", Allowed: []string{"acme"}, Families: []string{consumer.ErrorLogMessagesMetricName}}}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, consumer.Options{
+			LabelExtractions: tc.extractions,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with label extractions: %+v", tc.format, tc.extractions)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestStream(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{}
+
+	tailer, manager, metricsSet := mockInitFormat(ctrl, consumer.StreamFormat, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, consumer.StreamFormat, opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		status   string
+		duration float64
+		sent     float64
+		received float64
+		upstream string
+	}{
+		{"200", 1.5, 100, 10, "10.0.0.1:5432"},
+		{"200", 30, 200, 20, "10.0.0.1:5432"},
+		// The last of several upstreams tried served the session.
+		{"200", 0.5, 300, 30, "10.0.0.2:5432, 10.0.0.1:5432"},
+		{"502", 0.01, 0, 5, "10.0.0.2:5432"},
+		{"403", 0, 0, 0, ""},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"session_time\": %g, \"bytes_sent\": %g, \"bytes_received\": %g, \"upstream_addr\": \"%s\"}\n", timeLate, line.status, line.duration, line.sent, line.received, line.upstream)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	// Lines lacking a request are not parse errors.
+	for name, counter := range metricsSet.exporterCounters {
+		if name != consumer.ParseErrorsMetricName {
+			counter.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+		}
+	}
+	metricsSet.pollDuration.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.ingestionLag.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.lastConsumed.EXPECT().Set(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.newestLog.EXPECT().Set(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	metricsSet.streamSessions.EXPECT().Add(map[string]string{"status_code": "200"}, FloatEq(3)).Return(nil)
+	metricsSet.streamSessions.EXPECT().Add(map[string]string{"status_code": "502"}, FloatEq(1)).Return(nil)
+	metricsSet.streamSessions.EXPECT().Add(map[string]string{"status_code": "403"}, FloatEq(1)).Return(nil)
+
+	metricsSet.streamDuration.EXPECT().Observe(map[string]string{"status_code": "200"}, FloatElementsEq([]float64{1.5, 30, 0.5})).Return(nil)
+	metricsSet.streamDuration.EXPECT().Observe(map[string]string{"status_code": "502"}, FloatElementsEq([]float64{0.01})).Return(nil)
+	metricsSet.streamDuration.EXPECT().Observe(map[string]string{"status_code": "403"}, FloatElementsEq([]float64{0})).Return(nil)
+
+	metricsSet.streamBytesSent.EXPECT().Add(map[string]string{"upstream": "10.0.0.1:5432"}, FloatEq(600)).Return(nil)
+	metricsSet.streamBytesSent.EXPECT().Add(map[string]string{"upstream": "10.0.0.2:5432"}, FloatEq(0)).Return(nil)
+	metricsSet.streamBytesSent.EXPECT().Add(map[string]string{"upstream": "none"}, FloatEq(0)).Return(nil)
+
+	metricsSet.streamBytesReceived.EXPECT().Add(map[string]string{"upstream": "10.0.0.1:5432"}, FloatEq(60)).Return(nil)
+	metricsSet.streamBytesReceived.EXPECT().Add(map[string]string{"upstream": "10.0.0.2:5432"}, FloatEq(5)).Return(nil)
+	metricsSet.streamBytesReceived.EXPECT().Add(map[string]string{"upstream": "none"}, FloatEq(0)).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestStreamInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		paths []string
+		opts  consumer.Options
+	}{
+		{[]string{"/foo"}, consumer.Options{}},
+		{[]string{}, consumer.Options{ExemplarField: "request_id"}},
+		{[]string{}, consumer.Options{TopPaths: &consumer.TopPathsOptions{Capacity: 10}}},
+		{[]string{}, consumer.Options{Connections: &consumer.ConnectionsOptions{}}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, tc.paths, consumer.StreamFormat, tc.opts); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with paths %v and options: %+v", consumer.StreamFormat, tc.paths, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestErrorLog(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		ErrorEvents: []consumer.ErrorEventRule{
+			// Custom rules take precedence over the built-in rules.
+			{"backend_timeout", regexp.MustCompile(`upstream timed out .* upstream: "http://10\.0\.0\.1`)},
+			{"auth_failed", regexp.MustCompile(`user "[^"]*" was not found`)},
+		},
+	}
+
+	tailer, manager, metricsSet := mockInitFormat(ctrl, consumer.ErrorLogFormat, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, consumer.ErrorLogFormat, opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeEarly := time.Now().Add(-time.Minute).Format(consumer.ErrorLogTime)
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ErrorLogTime)
+
+	var buffer bytes.Buffer
+	for _, line := range []string{
+		timeLate + ` [error] 1234#1234: *10 upstream timed out (110: Connection timed out) while reading response header from upstream, client: 192.0.2.1, server: example.com, request: "GET / HTTP/1.1", upstream: "http://10.0.0.2:8080/", host: "example.com"`,
+		timeLate + ` [error] 1234#1234: *11 upstream timed out (110: Connection timed out) while reading response header from upstream, client: 192.0.2.1, server: example.com, request: "GET / HTTP/1.1", upstream: "http://10.0.0.1:8080/", host: "example.com"`,
+		timeLate + ` [error] 1234#1234: *12 no live upstreams while connecting to upstream, client: 192.0.2.1, server: example.com, request: "GET / HTTP/1.1", upstream: "http://backend/", host: "example.com"`,
+		timeLate + ` [error] 1234#1234: *13 limiting requests, excess: 10.500 by zone "api", client: 192.0.2.1, server: example.com, request: "GET /api HTTP/1.1", host: "example.com"`,
+		timeLate + ` [error] 1234#1234: *14 user "admin" was not found in "/etc/nginx/.htpasswd", client: 192.0.2.1, server: example.com, request: "GET /admin HTTP/1.1", host: "example.com"`,
+		timeLate + ` [info] 1234#1234: *15 SSL_do_handshake() failed (SSL: error:0A00006C:SSL routines::bad key share) while SSL handshaking, client: 192.0.2.1, server: 0.0.0.0:443`,
+		timeLate + ` [alert] 1200#1200: worker process 1234 exited on signal 11 (core dumped)`,
+		timeLate + ` [notice] 1200#1200: signal process started`,
+		// Lines predating startup are skipped.
+		timeEarly + ` [error] 1234#1234: *9 no live upstreams while connecting to upstream`,
+		// Malformed lines are parse errors.
+		`not an error log line`,
+	} {
+		fmt.Fprintln(&buffer, line)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+
+	for level, count := range map[string]float64{
+		"error":  5,
+		"info":   1,
+		"alert":  1,
+		"notice": 1,
+	} {
+		metricsSet.errorLogMessages.EXPECT().Add(map[string]string{"level": level}, FloatEq(count)).Return(nil)
+	}
+	for _, event := range []string{
+		"upstream_timeout",
+		"backend_timeout",
+		"no_live_upstreams",
+		"limit_req",
+		"auth_failed",
+		"ssl_handshake_failed",
+		"worker_crashed",
+	} {
+		metricsSet.errorLogEvents.EXPECT().Add(map[string]string{"event": event}, FloatEq(1)).Return(nil)
+	}
+	metricsSet.errorLogLimited.EXPECT().Add(map[string]string{
+		"limit":  "req",
+		"status": "rejected",
+		"zone":   "api",
+		"server": "example.com",
+	}, FloatEq(1)).Return(nil)
+
+	testRunConsumer(t, c)
+}
+
+func TestErrorLogInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		format string
+		opts   consumer.Options
+	}{
+		{"JSON", consumer.Options{ErrorEvents: []consumer.ErrorEventRule{{"auth_failed", regexp.MustCompile(`was not found`)}}}},
+		{consumer.ErrorLogFormat, consumer.Options{ErrorEvents: []consumer.ErrorEventRule{{"auth failed", regexp.MustCompile(`was not found`)}}}},
+		{consumer.ErrorLogFormat, consumer.Options{ErrorEvents: []consumer.ErrorEventRule{{"auth_failed", nil}}}},
+		{consumer.ErrorLogFormat, consumer.Options{TopPaths: &consumer.TopPathsOptions{Capacity: 10}}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, tc.opts); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with options: %+v", tc.format, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestLimits(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{
+		Limits: &consumer.LimitsOptions{
+			ServerField: "host",
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		status     string
+		host       string
+		reqStatus  string
+		connStatus string
+	}{
+		{"200", "a.example.com", "PASSED", "PASSED"},
+		{"200", "a.example.com", "DELAYED", "PASSED"},
+		{"503", "a.example.com", "REJECTED", "-"},
+		{"503", "a.example.com", "REJECTED", "-"},
+		{"503", "b.example.com", "-", "REJECTED"},
+		{"200", "b.example.com", "REJECTED_DRY_RUN", "-"},
+		{"200", "b.example.com", "", ""},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100, \"host\": \"%s\", \"limit_req_status\": \"%s\", \"limit_conn_status\": \"%s\"}\n", timeLate, line.status, line.host, line.reqStatus, line.connStatus)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	for _, expected := range []struct {
+		limit  string
+		status string
+		server string
+		count  float64
+	}{
+		{"req", "delayed", "a.example.com", 1},
+		{"req", "rejected", "a.example.com", 2},
+		{"conn", "rejected", "b.example.com", 1},
+		{"req", "rejected_dry_run", "b.example.com", 1},
+	} {
+		metricsSet.limitedRequests.EXPECT().Add(map[string]string{
+			"limit":  expected.limit,
+			"status": expected.status,
+			"server": expected.server,
+		}, FloatEq(expected.count)).Return(nil)
+	}
+
+	testRunConsumer(t, c)
+}
+
+func TestErrorLogLimits(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	opts := consumer.Options{}
+
+	tailer, manager, metricsSet := mockInitFormat(ctrl, consumer.ErrorLogFormat, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, consumer.ErrorLogFormat, opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ErrorLogTime)
+
+	var buffer bytes.Buffer
+	for _, message := range []string{
+		`limiting requests, excess: 10.500 by zone "api", client: 192.0.2.1, server: a.example.com, request: "GET /api HTTP/1.1", host: "a.example.com"`,
+		`limiting requests, excess: 11.000 by zone "api", client: 192.0.2.2, server: a.example.com, request: "GET /api HTTP/1.1", host: "a.example.com"`,
+		`limiting requests, dry run, excess: 5.000 by zone "login", client: 192.0.2.1, server: b.example.com, request: "POST /login HTTP/1.1", host: "b.example.com"`,
+		`delaying request, excess: 0.500, by zone "api", client: 192.0.2.1, server: a.example.com, request: "GET /api HTTP/1.1", host: "a.example.com"`,
+		`limiting connections by zone "addr", client: 192.0.2.3, server: b.example.com, request: "GET / HTTP/1.1", host: "b.example.com"`,
+		`limiting connections, dry run, by zone "addr", client: 192.0.2.3, server: b.example.com, request: "GET / HTTP/1.1", host: "b.example.com"`,
+	} {
+		fmt.Fprintf(&buffer, "%s [error] 1234#1234: *10 %s\n", timeLate, message)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.errorLogMessages.EXPECT().Add(map[string]string{"level": "error"}, FloatEq(6)).Return(nil)
+	metricsSet.errorLogEvents.EXPECT().Add(map[string]string{"event": "limit_req"}, FloatEq(3)).Return(nil)
+	metricsSet.errorLogEvents.EXPECT().Add(map[string]string{"event": "limit_conn"}, FloatEq(2)).Return(nil)
+
+	for _, expected := range []struct {
+		limit  string
+		status string
+		zone   string
+		server string
+		count  float64
+	}{
+		{"req", "rejected", "api", "a.example.com", 2},
+		{"req", "rejected_dry_run", "login", "b.example.com", 1},
+		{"req", "delayed", "api", "a.example.com", 1},
+		{"conn", "rejected", "addr", "b.example.com", 1},
+		{"conn", "rejected_dry_run", "addr", "b.example.com", 1},
+	} {
+		metricsSet.errorLogLimited.EXPECT().Add(map[string]string{
+			"limit":  expected.limit,
+			"status": expected.status,
+			"zone":   expected.zone,
+			"server": expected.server,
+		}, FloatEq(expected.count)).Return(nil)
+	}
+
+	testRunConsumer(t, c)
+}
+
+// fakeWindowSink records the windows written to it.
+type fakeWindowSink struct {
+	mu      sync.Mutex
+	ends    []time.Time
+	windows [][]openmetrics.Family
+}
+
+func (s *fakeWindowSink) WriteWindow(end time.Time, families []openmetrics.Family) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ends = append(s.ends, end)
+	s.windows = append(s.windows, families)
+	return nil
+}
+
+// windowResponseCounts returns the response count samples by status code in the
+// supplied window.
+func windowResponseCounts(families []openmetrics.Family) map[string]float64 {
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.Name != "nginx_http_response" {
+			continue
+		}
+		for _, sample := range family.Samples {
+			counts[sample.Labels["status_code"]] = sample.Value
+		}
+	}
+	return counts
+}
+
+func TestWindows(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sink := &fakeWindowSink{}
+	opts := consumer.Options{
+		Windows: &consumer.WindowOptions{
+			Width: time.Hour,
+			Sink:  sink,
+		},
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	// Log timestamps must follow consumer initialization, but may not exceed
+	// the current time by more than the window width, and so lines are logged
+	// within the current window (avoiding its last few seconds).
+	now := time.Now()
+	if end := now.Truncate(time.Hour).Add(time.Hour); end.Sub(now) < 10*time.Second {
+		time.Sleep(end.Sub(now))
+		now = time.Now()
+	}
+	start := now.Truncate(time.Hour)
+	logLine := func(buffer *bytes.Buffer, t time.Time, status string) {
+		fmt.Fprintf(buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100}\n", t.Format(consumer.ISO8601), status)
+	}
+
+	// The first poll closes the current window, while the second logs a line
+	// within the (closed) window. The far-future line is dropped, rather than
+	// closing all windows preceding it.
+	var first, second bytes.Buffer
+	logLine(&first, now.Add(2*time.Second), "200")
+	logLine(&first, now.Add(3*time.Second), "200")
+	logLine(&first, now.Add(4*time.Second), "500")
+	logLine(&first, start.Add(time.Hour), "200")
+	logLine(&first, time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC), "200")
+	logLine(&second, now.Add(5*time.Second), "200")
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(first.Bytes(), nil),
+		tailer.EXPECT().Next().Times(1).Return(second.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.windowDroppedLines.EXPECT().Add(map[string]string{"source": "access_log", "reason": "future"}, FloatEq(1)).Return(nil)
+	metricsSet.windowDroppedLines.EXPECT().Add(map[string]string{"source": "access_log", "reason": "late"}, FloatEq(1)).Return(nil)
+
+	testRunConsumerPeriods(t, c, 5)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if got, want := len(sink.ends), 1; got != want {
+		t.Fatalf("Expected %d windows to be written, got %d: %v", want, got, sink.ends)
+	}
+	end := start.Add(time.Hour)
+	if !sink.ends[0].Equal(end) {
+		t.Errorf("Expected window to end at %v, got %v", end, sink.ends[0])
+	}
+	expected := map[string]float64{"200": 2, "500": 1}
+	got := windowResponseCounts(sink.windows[0])
+	if len(got) != len(expected) {
+		t.Errorf("Expected response counts %v, got %v", expected, got)
+	} else {
+		for status, count := range expected {
+			if !floatEq(got[status], count) {
+				t.Errorf("Expected response counts %v, got %v", expected, got)
+				break
+			}
+		}
+	}
+	for _, family := range sink.windows[0] {
+		for _, sample := range family.Samples {
+			if !sample.Time.Equal(end) {
+				t.Errorf("Expected sample %s to be timestamped %v, got %v", sample.Name, end, sample.Time)
+			}
+		}
+	}
+}
+
+func TestWindowsInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		format string
+		opts   consumer.WindowOptions
+	}{
+		{"JSON", consumer.WindowOptions{}},
+		{"JSON", consumer.WindowOptions{Width: -time.Minute, Sink: &fakeWindowSink{}}},
+		{"JSON", consumer.WindowOptions{AllowedLateness: -time.Minute, Sink: &fakeWindowSink{}}},
+		{"JSON", consumer.WindowOptions{Sink: &fakeWindowSink{}, Labels: map[string]string{"not-a-label": "web1"}}},
+		{consumer.StreamFormat, consumer.WindowOptions{Sink: &fakeWindowSink{}}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		opts := tc.opts
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, consumer.Options{
+			Windows: &opts,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with window options: %+v", tc.format, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sink := &fakeWindowSink{}
+	opts := consumer.Options{
+		Windows: &consumer.WindowOptions{
+			Width:           time.Minute,
+			AllowedLateness: time.Minute,
+			Sink:            sink,
+			Labels:          map[string]string{"instance": "web1"},
+		},
+		Backfill: true,
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	// Historical lines are consumed, despite preceding consumer creation.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	logLine := func(buffer *bytes.Buffer, offset time.Duration, status string) {
+		fmt.Fprintf(buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100}\n", start.Add(offset).Format(consumer.ISO8601), status)
+	}
+
+	// The first log closes the first two windows, such that the first line of
+	// the second log is late, while the second is not. The far-future line is
+	// dropped, rather than closing all windows preceding it on flush. No lines
+	// are logged within the fifth window, which is therefore not written.
+	var first, second bytes.Buffer
+	logLine(&first, 5*time.Second, "200")
+	logLine(&first, 30*time.Second, "200")
+	logLine(&first, 65*time.Second, "500")
+	logLine(&first, 200*time.Second, "200")
+	logLine(&first, 80*365*24*time.Hour, "200")
+	logLine(&second, 10*time.Second, "200")
+	logLine(&second, 130*time.Second, "200")
+	logLine(&second, 320*time.Second, "200")
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.windowDroppedLines.EXPECT().Add(map[string]string{"source": "access_log", "reason": "future"}, FloatEq(1)).Return(nil)
+	metricsSet.windowDroppedLines.EXPECT().Add(map[string]string{"source": "access_log", "reason": "late"}, FloatEq(1)).Return(nil)
+
+	for _, b := range []*bytes.Buffer{&first, &second} {
+		if err := c.ConsumeReader(b); err != nil {
+			t.Fatalf("ConsumeReader() returned unexpected error: %v", err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush() returned unexpected error: %v", err)
+	}
+
+	expected := []struct {
+		end    time.Time
+		counts map[string]float64
+	}{
+		// Only series updated within each window are written.
+		{start.Add(time.Minute), map[string]float64{"200": 2}},
+		{start.Add(2 * time.Minute), map[string]float64{"500": 1}},
+		{start.Add(3 * time.Minute), map[string]float64{"200": 3}},
+		{start.Add(4 * time.Minute), map[string]float64{"200": 4}},
+		{start.Add(6 * time.Minute), map[string]float64{"200": 5}},
+	}
+	if len(sink.ends) != len(expected) {
+		t.Fatalf("Expected %d windows to be written, got %d: %v", len(expected), len(sink.ends), sink.ends)
+	}
+	for i, e := range expected {
+		if !sink.ends[i].Equal(e.end) {
+			t.Errorf("Expected window %d to end at %v, got %v", i, e.end, sink.ends[i])
+		}
+		got := windowResponseCounts(sink.windows[i])
+		if len(got) != len(e.counts) {
+			t.Errorf("Expected response counts %v in window %d, got %v", e.counts, i, got)
+			continue
+		}
+		for status, count := range e.counts {
+			if !floatEq(got[status], count) {
+				t.Errorf("Expected response counts %v in window %d, got %v", e.counts, i, got)
+				break
+			}
+		}
+		for _, family := range sink.windows[i] {
+			for _, sample := range family.Samples {
+				if sample.Labels["instance"] != "web1" {
+					t.Errorf("Expected sample %s in window %d to have window labels, got %v", sample.Name, i, sample.Labels)
+				}
+			}
+		}
+	}
+}
+
+func TestBackfillLogOrder(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sink := &fakeWindowSink{}
+	opts := consumer.Options{
+		Windows: &consumer.WindowOptions{
+			Width:           time.Minute,
+			AllowedLateness: time.Minute,
+			Sink:            sink,
+		},
+		Backfill: true,
+	}
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	logLine := func(buffer *bytes.Buffer, offset time.Duration, status string) {
+		fmt.Fprintf(buffer, "{\"time\": \"%s\", \"status\": \"%s\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100}\n", start.Add(offset).Format(consumer.ISO8601), status)
+	}
+
+	// Logs are supplied newest first, as rotated by logrotate. The newest log
+	// spans more than the allowed lateness, such that all lines of the older
+	// log would be dropped if it were consumed first.
+	var newer, older bytes.Buffer
+	newer.WriteString("not a log line\n")
+	logLine(&newer, 300*time.Second, "200")
+	logLine(&newer, 400*time.Second, "200")
+	logLine(&newer, 500*time.Second, "200")
+	logLine(&older, 5*time.Second, "200")
+	logLine(&older, 65*time.Second, "500")
+	logs := map[string][]byte{
+		"access.log":   newer.Bytes(),
+		"access.log.1": older.Bytes(),
+	}
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseCounts.EXPECT().Add(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseTime.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	metricsSet.responseSize.EXPECT().Observe(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+
+	var opened []string
+	if err := c.ConsumeLogs([]string{"access.log", "access.log.1"}, func(path string) (io.ReadCloser, error) {
+		opened = append(opened, path)
+		return ioutil.NopCloser(bytes.NewReader(logs[path])), nil
+	}); err != nil {
+		t.Fatalf("ConsumeLogs() returned unexpected error: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush() returned unexpected error: %v", err)
+	}
+
+	if want := []string{"access.log", "access.log.1", "access.log.1", "access.log"}; !reflect.DeepEqual(opened, want) {
+		t.Errorf("Expected logs to be opened in order %v, got %v", want, opened)
+	}
+
+	expected := []struct {
+		end    time.Time
+		counts map[string]float64
+	}{
+		{start.Add(time.Minute), map[string]float64{"200": 1}},
+		{start.Add(2 * time.Minute), map[string]float64{"500": 1}},
+		{start.Add(6 * time.Minute), map[string]float64{"200": 2}},
+		{start.Add(7 * time.Minute), map[string]float64{"200": 3}},
+		{start.Add(9 * time.Minute), map[string]float64{"200": 4}},
+	}
+	if len(sink.ends) != len(expected) {
+		t.Fatalf("Expected %d windows to be written, got %d: %v", len(expected), len(sink.ends), sink.ends)
+	}
+	for i, e := range expected {
+		if !sink.ends[i].Equal(e.end) {
+			t.Errorf("Expected window %d to end at %v, got %v", i, e.end, sink.ends[i])
+		}
+		got := windowResponseCounts(sink.windows[i])
+		if len(got) != len(e.counts) {
+			t.Errorf("Expected response counts %v in window %d, got %v", e.counts, i, got)
+			continue
+		}
+		for status, count := range e.counts {
+			if !floatEq(got[status], count) {
+				t.Errorf("Expected response counts %v in window %d, got %v", e.counts, i, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// ErrorLogFormat is the log format of the nginx error log.
+	ErrorLogFormat = "ERROR_LOG"
+
+	// ErrorLogTime contains a time.Parse reference timestamp for the (local
+	// time) timestamps of the nginx error log.
+	ErrorLogTime = "2006/01/02 15:04:05"
+
+	// ErrorLogMessagesMetricName is the name of the metric reporting the
+	// total number of error log messages by level.
+	ErrorLogMessagesMetricName = "nginx_error_log_messages_total"
+	// ErrorLogEventsMetricName is the name of the metric reporting the total
+	// number of error log messages by event class (see ErrorEventRule).
+	ErrorLogEventsMetricName = "nginx_error_log_events_total"
+)
+
+const (
+	// Fields extracted from error log lines into parsedLogLine.Fields.
+	errorLogLevelField      = "level"
+	errorLogPIDField        = "pid"
+	errorLogTIDField        = "tid"
+	errorLogConnectionField = "connection"
+	errorLogMessageField    = "message"
+)
+
+var (
+	// Matches an error log line, capturing timestamp, level, pid, tid,
+	// connection (if any), and message.
+	errorLogRE = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[([a-z]+)\] (\d+)#(\d+): (?:\*(\d+) )?(.*)$`)
+
+	// Matches a valid error event class.
+	errorEventRE = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+// ErrorEventRule maps error log messages matching Pattern to the event class
+// Event.
+type ErrorEventRule struct {
+	Event   string
+	Pattern *regexp.Regexp
+}
+
+// DefaultErrorEventRules are the built-in error log classification rules.
+// Rules are evaluated in order, and messages matching no rule are counted by
+// level only.
+var DefaultErrorEventRules = []ErrorEventRule{
+	{"upstream_timeout", regexp.MustCompile(`upstream timed out`)},
+	{"no_live_upstreams", regexp.MustCompile(`no live upstreams`)},
+	{"upstream_connect_failed", regexp.MustCompile(`connect\(\) (to .* )?failed .* while connecting to upstream`)},
+	{"upstream_closed", regexp.MustCompile(`upstream prematurely closed connection`)},
+	{"limit_req", regexp.MustCompile(`limiting requests`)},
+	{"limit_conn", regexp.MustCompile(`limiting connections`)},
+	{"ssl_handshake_failed", regexp.MustCompile(`SSL_do_handshake\(\) failed`)},
+	{"worker_crashed", regexp.MustCompile(`worker process \d+ exited on signal`)},
+	{"worker_connections_exhausted", regexp.MustCompile(`worker_connections are not enough`)},
+	{"too_many_open_files", regexp.MustCompile(`Too many open files`)},
+	{"client_body_too_large", regexp.MustCompile(`client intended to send too large body`)},
+	{"file_not_found", regexp.MustCompile(`open\(\) ".*" failed \(2: No such file or directory\)`)},
+}
+
+// errorEventRuleConfig is the JSON representation of an ErrorEventRule.
+type errorEventRuleConfig struct {
+	Event   string `json:"event"`
+	Pattern string `json:"pattern"`
+}
+
+// ParseErrorEventRules parses a JSON list of error log classification rules
+// (see README.md), e.g.:
+//
+//	[{"event": "auth_failed", "pattern": "user \"[^\"]*\" was not found"}]
+func ParseErrorEventRules(b []byte) ([]ErrorEventRule, error) {
+	var configs []errorEventRuleConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("could not parse error event rules: %v", err)
+	}
+
+	var rules []ErrorEventRule
+	for _, config := range configs {
+		if !errorEventRE.MatchString(config.Event) {
+			return nil, fmt.Errorf("error event must be non-empty and contain only letters, digits, and underscores: \"%s\"", config.Event)
+		}
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse pattern for error event %s: %v", config.Event, err)
+		}
+		rules = append(rules, ErrorEventRule{
+			Event:   config.Event,
+			Pattern: pattern,
+		})
+	}
+
+	return rules, nil
+}
+
+// parseErrorLog parses an error log line. The level, process and thread IDs,
+// connection serial number (if any), and message are stored in Fields.
+func parseErrorLog(b []byte) (*parsedLogLine, error) {
+	m := errorLogRE.FindSubmatch(b)
+	if m == nil {
+		return nil, newParseError(reasonMalformedLine, "could not parse error log line: \"%s\"", string(b))
+	}
+
+	t, err := time.ParseInLocation(ErrorLogTime, string(m[1]), time.Local)
+	if err != nil {
+		return nil, newParseError(reasonBadTimestamp, "could not parse log line timestamp: %v", err)
+	}
+
+	fields := map[string]string{
+		errorLogLevelField:   string(m[2]),
+		errorLogPIDField:     string(m[3]),
+		errorLogTIDField:     string(m[4]),
+		errorLogMessageField: string(m[6]),
+	}
+	if len(m[5]) > 0 {
+		fields[errorLogConnectionField] = string(m[5])
+	}
+
+	return &parsedLogLine{
+		Time:        t,
+		RequestTime: -1,
+		BytesSent:   -1,
+		Fields:      fields,
+	}, nil
+}
+
+// errorLog classifies error log messages, exporting counts by level and event
+// class.
+type errorLog struct {
+	rules    []ErrorEventRule
+	messages metrics.CounterT
+	events   metrics.CounterT
+	limited  metrics.CounterT
+}
+
+func (c *Consumer) addErrorLog(rules []ErrorEventRule) (*errorLog, error) {
+	for _, rule := range rules {
+		if !errorEventRE.MatchString(rule.Event) || rule.Pattern == nil {
+			return nil, fmt.Errorf("invalid error event rule: %+v", rule)
+		}
+	}
+
+	e := &errorLog{
+		rules: append(append([]ErrorEventRule{}, rules...), DefaultErrorEventRules...),
+	}
+
+	var err error
+
+	if err = c.manager.AddCounter(ErrorLogMessagesMetricName, "Total number of error log messages by level", []string{"level"}); err != nil {
+		return nil, err
+	}
+	if e.messages, err = c.manager.GetCounter(ErrorLogMessagesMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.manager.AddCounter(ErrorLogEventsMetricName, "Total number of error log messages by event class", []string{"event"}); err != nil {
+		return nil, err
+	}
+	if e.events, err = c.manager.GetCounter(ErrorLogEventsMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.manager.AddCounter(ErrorLogLimitedRequestsMetricName, "Total number of requests delayed or rejected by limit_req or limit_conn, by zone and server", []string{"limit", "status", "zone", "server"}); err != nil {
+		return nil, err
+	}
+	if e.limited, err = c.manager.GetCounter(ErrorLogLimitedRequestsMetricName); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// classify returns the event class of the supplied message, or the empty
+// string if it matches no rule.
+func (e *errorLog) classify(message string) string {
+	for _, rule := range e.rules {
+		if rule.Pattern.MatchString(message) {
+			return rule.Event
+		}
+	}
+	return ""
+}
+
+// errorLogStats holds per-poll error log message counts.
+type errorLogStats struct {
+	levels  *keyedCounter
+	events  *keyedCounter
+	limited *keyedCounter
+}
+
+func newErrorLogStats() *errorLogStats {
+	return &errorLogStats{
+		levels:  newKeyedCounter(),
+		events:  newKeyedCounter(),
+		limited: newKeyedCounter(),
+	}
+}
+
+// consume records the message of the supplied line.
+func (e *errorLog) consume(line *parsedLogLine, stats *errorLogStats) {
+	level := line.Fields[errorLogLevelField]
+	stats.levels.inc(level, map[string]string{
+		"level": level,
+	})
+	message := line.Fields[errorLogMessageField]
+	if event := e.classify(message); event != "" {
+		stats.events.inc(event, map[string]string{
+			"event": event,
+		})
+	}
+	if labels := limitEvent(message); labels != nil {
+		stats.limited.inc(withLabels(labels, nil))
+	}
+}
+
+// record exports the supplied per-poll error log stats.
+func (e *errorLog) record(stats *errorLogStats) error {
+	for _, count := range stats.levels.counts {
+		if err := e.messages.Add(count.annotations, count.total); err != nil {
+			return err
+		}
+	}
+	for _, export := range []struct {
+		metric metrics.CounterT
+		counts *keyedCounter
+	}{
+		{e.events, stats.events},
+		{e.limited, stats.limited},
+	} {
+		for _, count := range export.counts.counts {
+			if err := export.metric.Add(count.annotations, count.total); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
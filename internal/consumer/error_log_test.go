@@ -0,0 +1,64 @@
+package consumer_test
+
+import (
+	"testing"
+
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+)
+
+func TestParseErrorEventRules(t *testing.T) {
+	rules, err := consumer.ParseErrorEventRules([]byte(`[
+		{"event": "auth_failed", "pattern": "user \"[^\"]*\" was not found"},
+		{"event": "cache_locked", "pattern": "cache lock timeout"}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseErrorEventRules returned unexpected error: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d: %v", len(rules), rules)
+	}
+	if rules[0].Event != "auth_failed" || !rules[0].Pattern.MatchString(`user "admin" was not found in "/etc/nginx/.htpasswd"`) {
+		t.Errorf("Unexpected rule: %+v", rules[0])
+	}
+	if rules[1].Event != "cache_locked" || !rules[1].Pattern.MatchString("cache lock timeout") {
+		t.Errorf("Unexpected rule: %+v", rules[1])
+	}
+}
+
+func TestParseErrorEventRulesInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"event": "auth_failed"}`,
+		`[{"pattern": "was not found"}]`,
+		`[{"event": "auth failed", "pattern": "was not found"}]`,
+		`[{"event": "auth_failed", "pattern": "("}]`,
+	} {
+		if rules, err := consumer.ParseErrorEventRules([]byte(config)); err == nil {
+			t.Errorf("Expected ParseErrorEventRules to fail for config %s, got: %v", config, rules)
+		}
+	}
+}
+
+func TestDefaultErrorEventRules(t *testing.T) {
+	classify := func(message string) string {
+		for _, rule := range consumer.DefaultErrorEventRules {
+			if rule.Pattern.MatchString(message) {
+				return rule.Event
+			}
+		}
+		return ""
+	}
+	for message, want := range map[string]string{
+		`connect() failed (111: Connection refused) while connecting to upstream, client: 192.0.2.1`:            "upstream_connect_failed",
+		`upstream prematurely closed connection while reading response header from upstream, client: 192.0.2.1`: "upstream_closed",
+		`limiting connections by zone "addr", client: 192.0.2.1`:                                                "limit_conn",
+		`1024 worker_connections are not enough`:                                                                "worker_connections_exhausted",
+		`accept4() failed (24: Too many open files)`:                                                            "too_many_open_files",
+		`client intended to send too large body: 2000000 bytes, client: 192.0.2.1`:                              "client_body_too_large",
+		`open() "/var/www/html/favicon.ico" failed (2: No such file or directory), client: 192.0.2.1`:           "file_not_found",
+		`signal process started`: "",
+	} {
+		if got := classify(message); got != want {
+			t.Errorf("Expected message %q to be classified as %q, got %q", message, want, got)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package consumer
+
+import (
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// LinesReadMetricName is the name of the metric reporting the total
+	// number of log lines read by the exporter.
+	LinesReadMetricName = "nginx_log_exporter_lines_read_total"
+	// LinesParsedMetricName is the name of the metric reporting the total
+	// number of log lines successfully parsed by the exporter.
+	LinesParsedMetricName = "nginx_log_exporter_lines_parsed_total"
+	// ParseErrorsMetricName is the name of the metric reporting the total
+	// number of errors encountered while parsing log lines, by format and
+	// reason.
+	ParseErrorsMetricName = "nginx_log_exporter_parse_errors_total"
+	// LinesSkippedMetricName is the name of the metric reporting the total
+	// number of parsed log lines skipped, by reason: Either entirely, due to
+	// predating exporter startup, or by path-based metrics, due to a
+	// malformed request or path.
+	LinesSkippedMetricName = "nginx_log_exporter_lines_skipped_total"
+	// BytesReadMetricName is the name of the metric reporting the total
+	// number of bytes read from logs by the exporter.
+	BytesReadMetricName = "nginx_log_exporter_bytes_read_total"
+	// RotationsMetricName is the name of the metric reporting the total
+	// number of log rotations detected.
+	RotationsMetricName = "nginx_log_exporter_log_rotations_total"
+	// TruncationsMetricName is the name of the metric reporting the total
+	// number of log truncations detected.
+	TruncationsMetricName = "nginx_log_exporter_log_truncations_total"
+	// PollDurationMetricName is the name of the metric reporting the
+	// distribution of time spent reading and processing new log content on
+	// each poll.
+	PollDurationMetricName = "nginx_log_exporter_poll_duration_seconds"
+	// LastConsumedMetricName is the name of the metric reporting the time
+	// (seconds since the epoch) at which a log line was last consumed.
+	LastConsumedMetricName = "nginx_log_exporter_last_consumed_line_timestamp_seconds"
+	// NewestLogTimestampMetricName is the name of the metric reporting the
+	// newest log line timestamp (seconds since the epoch) consumed.
+	NewestLogTimestampMetricName = "nginx_log_exporter_newest_log_timestamp_seconds"
+	// IngestionLagMetricName is the name of the metric reporting the
+	// distribution of the difference between the time at which each log line
+	// was consumed and its logged timestamp.
+	IngestionLagMetricName = "nginx_log_exporter_ingestion_lag_seconds"
+)
+
+var (
+	// Default buckets used with the ingestion lag distribution metric.
+	ingestionLagBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+// ExporterMetrics holds metrics describing the operation of the exporter
+// itself, rather than that of nginx. These may be shared by multiple Consumers
+// (see Options), each distinguished by the "source" label.
+type ExporterMetrics struct {
+	linesRead    metrics.CounterT
+	linesParsed  metrics.CounterT
+	parseErrors  metrics.CounterT
+	linesSkipped metrics.CounterT
+	bytesRead    metrics.CounterT
+	rotations    metrics.CounterT
+	truncations  metrics.CounterT
+	pollDuration metrics.HistogramT
+	lastConsumed metrics.GaugeT
+	newestLog    metrics.GaugeT
+	ingestionLag metrics.HistogramT
+}
+
+func (c *Consumer) addExporterMetrics() (*ExporterMetrics, error) {
+	e := &ExporterMetrics{}
+
+	for _, counter := range []struct {
+		name   string
+		help   string
+		labels []string
+		metric *metrics.CounterT
+	}{
+		{LinesReadMetricName, "Total number of log lines read", []string{"source"}, &e.linesRead},
+		{LinesParsedMetricName, "Total number of log lines successfully parsed", []string{"source"}, &e.linesParsed},
+		{ParseErrorsMetricName, "Total number of log line parse errors by format and reason", []string{"source", "format", "reason"}, &e.parseErrors},
+		{LinesSkippedMetricName, "Total number of parsed log lines skipped (entirely, or by path-based metrics) by reason", []string{"source", "reason"}, &e.linesSkipped},
+		{BytesReadMetricName, "Total number of bytes read from logs", []string{"source"}, &e.bytesRead},
+		{RotationsMetricName, "Total number of log rotations detected", []string{"source"}, &e.rotations},
+		{TruncationsMetricName, "Total number of log truncations detected", []string{"source"}, &e.truncations},
+	} {
+		if err := c.manager.AddCounter(counter.name, counter.help, counter.labels); err != nil {
+			return nil, err
+		}
+		m, err := c.manager.GetCounter(counter.name)
+		if err != nil {
+			return nil, err
+		}
+		*counter.metric = m
+	}
+
+	var err error
+
+	if err = c.addHistogram(PollDurationMetricName, "Distribution of time (seconds) spent reading and processing new log content per poll", []string{
+		"source",
+	}, nil); err != nil {
+		return nil, err
+	}
+	if e.pollDuration, err = c.manager.GetHistogram(PollDurationMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.addHistogram(IngestionLagMetricName, "Distribution of the delay (seconds) between the logged timestamp of each line and its consumption", []string{
+		"source",
+	}, ingestionLagBuckets); err != nil {
+		return nil, err
+	}
+	if e.ingestionLag, err = c.manager.GetHistogram(IngestionLagMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.manager.AddGauge(LastConsumedMetricName, "Time (seconds since the epoch) at which a log line was last consumed", []string{
+		"source",
+	}); err != nil {
+		return nil, err
+	}
+	if e.lastConsumed, err = c.manager.GetGauge(LastConsumedMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.manager.AddGauge(NewestLogTimestampMetricName, "Newest logged timestamp (seconds since the epoch) of any consumed log line", []string{
+		"source",
+	}); err != nil {
+		return nil, err
+	}
+	if e.newestLog, err = c.manager.GetGauge(NewestLogTimestampMetricName); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// recordLines exports line-level counts and timing from the supplied stats,
+// collected at time now.
+func (c *Consumer) recordLines(stats *logStats, numBytes int, now time.Time) error {
+	labels := map[string]string{
+		"source": c.source,
+	}
+	for _, count := range []struct {
+		metric metrics.CounterT
+		value  float64
+	}{
+		{c.exporterMetrics.linesRead, stats.linesRead},
+		{c.exporterMetrics.linesParsed, stats.linesParsed},
+		{c.exporterMetrics.bytesRead, float64(numBytes)},
+	} {
+		if err := count.metric.Add(labels, count.value); err != nil {
+			return err
+		}
+	}
+	for _, count := range stats.linesSkipped.counts {
+		if err := c.exporterMetrics.linesSkipped.Add(map[string]string{
+			"source": c.source,
+			"reason": count.annotations["reason"],
+		}, count.total); err != nil {
+			return err
+		}
+	}
+	for _, count := range stats.parseErrors.counts {
+		if err := c.exporterMetrics.parseErrors.Add(map[string]string{
+			"source": c.source,
+			"format": c.format,
+			"reason": count.annotations["reason"],
+		}, count.total); err != nil {
+			return err
+		}
+	}
+	if stats.linesConsumed > 0 {
+		if err := c.exporterMetrics.lastConsumed.Set(labels, unixSeconds(now)); err != nil {
+			return err
+		}
+	}
+	if stats.newestLogTime.After(c.newestLogTime) {
+		c.newestLogTime = stats.newestLogTime
+		if err := c.exporterMetrics.newestLog.Set(labels, unixSeconds(c.newestLogTime)); err != nil {
+			return err
+		}
+	}
+	if len(stats.ingestionLags) > 0 {
+		if err := c.exporterMetrics.ingestionLag.Observe(labels, stats.ingestionLags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// recordPoll exports poll-level stats, given the time at which the poll
+// started.
+func (c *Consumer) recordPoll(start time.Time) error {
+	labels := map[string]string{
+		"source": c.source,
+	}
+	stats := c.tailer.Stats()
+	if err := c.exporterMetrics.rotations.Add(labels, float64(stats.Rotations-c.tailerStats.Rotations)); err != nil {
+		return err
+	}
+	if err := c.exporterMetrics.truncations.Add(labels, float64(stats.Truncations-c.tailerStats.Truncations)); err != nil {
+		return err
+	}
+	c.tailerStats = stats
+	return c.exporterMetrics.pollDuration.Observe(labels, []float64{time.Since(start).Seconds()})
+}
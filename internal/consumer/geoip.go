@@ -0,0 +1,240 @@
+package consumer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// Labels which may be added to HTTP response metrics by GeoIP lookups.
+	geoIPCountryLabel = "country"
+	geoIPASNLabel     = "asn"
+
+	// Value reported for addresses which cannot be resolved (e.g. private
+	// addresses, or those absent from the database).
+	geoIPUnknown = "unknown"
+
+	// Log field containing the address of the connecting client (or proxy).
+	remoteAddrField = "remote_addr"
+)
+
+var (
+	// Default labels and metric families for GeoIPOptions.
+	defaultGeoIPLabels   = []string{geoIPCountryLabel, geoIPASNLabel}
+	defaultGeoIPFamilies = []string{ResponseCountMetricName}
+)
+
+// GeoIPOptions configures labeling of HTTP response metrics with the country
+// and / or autonomous system of the client, as resolved via local MaxMind
+// (MMDB) databases such as GeoLite2-Country and GeoLite2-ASN.
+type GeoIPOptions struct {
+	// Databases are the paths of the MMDB databases consulted, in order. The
+	// country is taken from the first database providing "country.iso_code",
+	// and the ASN from the first providing "autonomous_system_number". Each
+	// database is reloaded when modified.
+	Databases []string
+	// Labels are the labels added, a subset of "country" and "asn". Defaults
+	// to both.
+	Labels []string
+	// Families name the metrics to which labels are added (as for
+	// LabelExtraction, other than stream metrics). Defaults to
+	// ResponseCountMetricName.
+	Families []string
+	// ForwardedField, if non-empty, names a log field containing a
+	// comma-separated list of forwarded client addresses (e.g.
+	// "http_x_forwarded_for"), consulted when the connecting address
+	// (remote_addr) is a trusted proxy.
+	ForwardedField string
+	// TrustedProxies are the networks of proxies whose forwarded addresses
+	// are trusted. The client address is the last address in ForwardedField
+	// (if any) which is not that of a trusted proxy.
+	TrustedProxies []*net.IPNet
+}
+
+func (o *GeoIPOptions) setDefaults() {
+	if len(o.Labels) == 0 {
+		o.Labels = defaultGeoIPLabels
+	}
+	if len(o.Families) == 0 {
+		o.Families = defaultGeoIPFamilies
+	}
+}
+
+func (o *GeoIPOptions) validate() error {
+	if len(o.Databases) == 0 {
+		return fmt.Errorf("at least one GeoIP database must be specified")
+	}
+	seen := make(map[string]bool)
+	for _, label := range o.Labels {
+		if label != geoIPCountryLabel && label != geoIPASNLabel {
+			return fmt.Errorf("unsupported GeoIP label: \"%s\"", label)
+		} else if seen[label] {
+			return fmt.Errorf("duplicate GeoIP label: %s", label)
+		}
+		seen[label] = true
+	}
+	for _, family := range o.Families {
+		// Note: Stream access logs do not support GeoIP labels.
+		if _, ok := labeledFamilies[family]; !ok || streamFamilies[family] {
+			return fmt.Errorf("GeoIP labels are not supported for metric: %s", family)
+		}
+	}
+	return nil
+}
+
+// fields returns the log fields required by the configured options.
+func (o *GeoIPOptions) fields() []string {
+	fields := []string{remoteAddrField}
+	if o.ForwardedField != "" {
+		fields = append(fields, o.ForwardedField)
+	}
+	return fields
+}
+
+// geoIPRecord holds the subset of MMDB record fields used for labels.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoIPDatabase is an MMDB database, reloaded when modified.
+type geoIPDatabase struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+// load (re)loads the database if it has been modified since last loaded,
+// returning true if so.
+func (d *geoIPDatabase) load() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(d.modTime) {
+		return false, nil
+	}
+	// Note: The database is read into memory (rather than mapped), such that
+	// it may be safely replaced on disk.
+	b, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return false, err
+	}
+	d.reader = reader
+	d.modTime = info.ModTime()
+	return true, nil
+}
+
+// geoIP is a labeler resolving the country and / or ASN of the client of each
+// line.
+type geoIP struct {
+	opts      GeoIPOptions
+	databases []*geoIPDatabase
+}
+
+func newGeoIP(opts GeoIPOptions) (*geoIP, error) {
+	g := &geoIP{
+		opts: opts,
+	}
+	for _, path := range opts.Databases {
+		d := &geoIPDatabase{
+			path: path,
+		}
+		if _, err := d.load(); err != nil {
+			return nil, fmt.Errorf("could not load GeoIP database %s: %v", path, err)
+		}
+		g.databases = append(g.databases, d)
+	}
+	return g, nil
+}
+
+// trusted returns true if the supplied address is that of a trusted proxy.
+func (g *geoIP) trusted(ip net.IP) bool {
+	for _, network := range g.opts.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client of the supplied line, or nil
+// if it cannot be determined.
+func (g *geoIP) clientAddr(line *parsedLogLine) net.IP {
+	ip := net.ParseIP(line.Fields[remoteAddrField])
+	if ip == nil || g.opts.ForwardedField == "" || !g.trusted(ip) {
+		return ip
+	}
+	forwarded, ok := line.Fields[g.opts.ForwardedField]
+	if !ok || forwarded == "" || forwarded == "-" {
+		return ip
+	}
+	addrs := strings.Split(forwarded, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if ip = net.ParseIP(strings.TrimSpace(addrs[i])); ip == nil || !g.trusted(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func (g *geoIP) labelNames() []string {
+	return g.opts.Labels
+}
+
+func (g *geoIP) labels(line *parsedLogLine) map[string]string {
+	labels := make(map[string]string)
+	for _, label := range g.opts.Labels {
+		labels[label] = geoIPUnknown
+	}
+	ip := g.clientAddr(line)
+	if ip == nil {
+		return labels
+	}
+	var country string
+	var asn uint
+	for _, d := range g.databases {
+		var record geoIPRecord
+		if err := d.reader.Lookup(ip, &record); err != nil {
+			continue
+		}
+		if country == "" {
+			country = record.Country.ISOCode
+		}
+		if asn == 0 {
+			asn = record.ASN
+		}
+	}
+	if _, ok := labels[geoIPCountryLabel]; ok && country != "" {
+		labels[geoIPCountryLabel] = country
+	}
+	if _, ok := labels[geoIPASNLabel]; ok && asn != 0 {
+		labels[geoIPASNLabel] = strconv.FormatUint(uint64(asn), 10)
+	}
+	return labels
+}
+
+func (g *geoIP) refresh() {
+	for _, d := range g.databases {
+		if loaded, err := d.load(); err != nil {
+			// Note: The previously loaded database remains in effect.
+			log.Printf("Could not reload GeoIP database %s: %v", d.path, err)
+		} else if loaded {
+			log.Printf("Reloaded GeoIP database %s", d.path)
+		}
+	}
+}
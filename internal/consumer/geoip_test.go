@@ -0,0 +1,327 @@
+package consumer_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+	"github.com/swfrench/nginx-log-exporter/internal/file/mock_tailer"
+	"github.com/swfrench/nginx-log-exporter/internal/metrics/mock_metrics"
+)
+
+// MMDB data section types used by encodeMMDB.
+const (
+	mmdbTypeString = 2
+	mmdbTypeUint16 = 5
+	mmdbTypeUint32 = 6
+	mmdbTypeMap    = 7
+	mmdbTypeUint64 = 9
+	mmdbTypeArray  = 11
+)
+
+// mmdbUint16 and mmdbUint64 distinguish the encoded type of integer values.
+type mmdbUint16 uint16
+type mmdbUint64 uint64
+
+func encodeMMDBControl(b *bytes.Buffer, t, size int) {
+	if t <= 7 {
+		b.WriteByte(byte(t<<5 | size))
+	} else {
+		b.WriteByte(byte(size))
+		b.WriteByte(byte(t - 7))
+	}
+}
+
+func encodeMMDBUint(b *bytes.Buffer, t int, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	n := 0
+	for n < 8 && buf[n] == 0 {
+		n++
+	}
+	encodeMMDBControl(b, t, 8-n)
+	b.Write(buf[n:])
+}
+
+// encodeMMDB encodes the supplied value into the MMDB data section format.
+// Only the types needed for test databases are supported, and sizes must be
+// less than 29.
+func encodeMMDB(b *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		encodeMMDBControl(b, mmdbTypeString, len(v))
+		b.WriteString(v)
+	case mmdbUint16:
+		encodeMMDBUint(b, mmdbTypeUint16, uint64(v))
+	case uint32:
+		encodeMMDBUint(b, mmdbTypeUint32, uint64(v))
+	case mmdbUint64:
+		encodeMMDBUint(b, mmdbTypeUint64, uint64(v))
+	case []interface{}:
+		encodeMMDBControl(b, mmdbTypeArray, len(v))
+		for _, e := range v {
+			encodeMMDB(b, e)
+		}
+	case map[string]interface{}:
+		encodeMMDBControl(b, mmdbTypeMap, len(v))
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeMMDB(b, k)
+			encodeMMDB(b, v[k])
+		}
+	default:
+		panic(fmt.Sprintf("unsupported MMDB value type: %T", value))
+	}
+}
+
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     [2]interface{}
+}
+
+// writeTestMMDB writes an IPv4 MMDB database to the supplied path, mapping
+// each network (in CIDR notation) to the corresponding record.
+func writeTestMMDB(t *testing.T, path string, networks map[string]map[string]interface{}) {
+	root := &mmdbNode{}
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Could not parse network %s: %v", cidr, err)
+		}
+		ip := network.IP.To4()
+		ones, _ := network.Mask.Size()
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				node.data[bit] = record
+			} else {
+				if node.children[bit] == nil {
+					node.children[bit] = &mmdbNode{}
+				}
+				node = node.children[bit]
+			}
+		}
+	}
+
+	// Number nodes in breadth-first order.
+	nodes := []*mmdbNode{root}
+	index := map[*mmdbNode]int{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				index[child] = len(nodes)
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	var data bytes.Buffer
+	var tree bytes.Buffer
+	for _, node := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := len(nodes)
+			if node.children[bit] != nil {
+				record = index[node.children[bit]]
+			} else if node.data[bit] != nil {
+				record = len(nodes) + 16 + data.Len()
+				encodeMMDB(&data, node.data[bit])
+			}
+			tree.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(tree.Bytes())
+	b.Write(make([]byte, 16))
+	b.Write(data.Bytes())
+	b.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDB(&b, map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 mmdbUint16(24),
+		"ip_version":                  mmdbUint16(4),
+		"database_type":               "Test",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": mmdbUint16(2),
+		"binary_format_minor_version": mmdbUint16(0),
+		"build_epoch":                 mmdbUint64(time.Now().Unix()),
+		"description":                 map[string]interface{}{"en": "Test database"},
+	})
+
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write database %s: %v", path, err)
+	}
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": code,
+		},
+	}
+}
+
+func asn(number uint32) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number": number,
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	countryPath := filepath.Join(dir, "country.mmdb")
+	writeTestMMDB(t, countryPath, map[string]map[string]interface{}{
+		"10.0.0.0/8":      country("US"),
+		"203.0.113.0/24":  country("FR"),
+		"198.51.100.0/24": country("JP"),
+	})
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, asnPath, map[string]map[string]interface{}{
+		"10.0.0.0/8": asn(64500),
+	})
+
+	_, proxies, _ := net.ParseCIDR("172.16.0.0/12")
+	opts := consumer.Options{
+		GeoIP: &consumer.GeoIPOptions{
+			Databases:      []string{countryPath, asnPath},
+			Families:       []string{consumer.ResponseCountMetricName, consumer.ResponseDurationMetricName},
+			ForwardedField: "http_x_forwarded_for",
+			TrustedProxies: []*net.IPNet{proxies},
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tailer, manager, metricsSet := mockInit(ctrl, opts)
+
+	c, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, "JSON", opts)
+	if err != nil {
+		t.Fatalf("Could not build new consumer: %v", err)
+	}
+
+	// Databases modified after startup are reloaded prior to the next poll.
+	writeTestMMDB(t, countryPath, map[string]map[string]interface{}{
+		"10.0.0.0/8":     country("US"),
+		"203.0.113.0/24": country("DE"),
+	})
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(countryPath, modTime, modTime); err != nil {
+		t.Fatalf("Could not update database modification time: %v", err)
+	}
+
+	timeLate := time.Now().Add(time.Minute).Format(consumer.ISO8601)
+
+	var buffer bytes.Buffer
+	for _, client := range []struct {
+		addr      string
+		forwarded string
+	}{
+		{"10.1.2.3", "-"},
+		{"10.4.5.6", "-"},
+		{"203.0.113.5", "-"},
+		// Addresses forwarded by trusted proxies are used, up to the
+		// first untrusted address.
+		{"172.16.0.1", "198.51.100.1, 203.0.113.7, 172.16.0.2"},
+		// Addresses forwarded by untrusted clients are ignored.
+		{"192.0.2.1", "10.0.0.1"},
+		{"2001:db8::1", "-"},
+	} {
+		fmt.Fprintf(&buffer, "{\"time\": \"%s\", \"status\": \"200\", \"request_time\": 0.5, \"request\": \"GET / HTTP/1.1\", \"bytes_sent\": 100, \"remote_addr\": \"%s\", \"http_x_forwarded_for\": \"%s\"}\n", timeLate, client.addr, client.forwarded)
+	}
+
+	gomock.InOrder(
+		tailer.EXPECT().Next().Times(1).Return(buffer.Bytes(), nil),
+		tailer.EXPECT().Next().AnyTimes().Return([]byte{}, nil),
+	)
+
+	metricsSet.expectAnyExporterMetricUpdates()
+	metricsSet.responseSize.EXPECT().Observe(map[string]string{"status_code": "200"}, gomock.Any()).Return(nil)
+
+	for _, expected := range []struct {
+		country string
+		asn     string
+		count   float64
+	}{
+		{"US", "64500", 2},
+		{"DE", "unknown", 2},
+		{"unknown", "unknown", 2},
+	} {
+		labels := map[string]string{
+			"status_code": "200",
+			"country":     expected.country,
+			"asn":         expected.asn,
+		}
+		metricsSet.responseCounts.EXPECT().Add(labels, FloatEq(expected.count)).Return(nil)
+		metricsSet.responseTime.EXPECT().Observe(labels, FloatElementsEq([]float64{0.5, 0.5})).Return(nil)
+	}
+
+	testRunConsumer(t, c)
+}
+
+func TestGeoIPInvalidOptions(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	validPath := filepath.Join(dir, "valid.mmdb")
+	writeTestMMDB(t, validPath, map[string]map[string]interface{}{
+		"10.0.0.0/8": country("US"),
+	})
+	invalidPath := filepath.Join(dir, "invalid.mmdb")
+	if err := ioutil.WriteFile(invalidPath, []byte("not a database"), 0644); err != nil {
+		t.Fatalf("Could not write database: %v", err)
+	}
+
+	for _, tc := range []struct {
+		format string
+		opts   consumer.GeoIPOptions
+	}{
+		{"JSON", consumer.GeoIPOptions{}},
+		{"JSON", consumer.GeoIPOptions{Databases: []string{filepath.Join(dir, "missing.mmdb")}}},
+		{"JSON", consumer.GeoIPOptions{Databases: []string{invalidPath}}},
+		{"JSON", consumer.GeoIPOptions{Databases: []string{validPath}, Labels: []string{"city"}}},
+		{"JSON", consumer.GeoIPOptions{Databases: []string{validPath}, Labels: []string{"asn", "asn"}}},
+		{"JSON", consumer.GeoIPOptions{Databases: []string{validPath}, Families: []string{consumer.ParseErrorsMetricName}}},
+		{"JSON", consumer.GeoIPOptions{Databases: []string{validPath}, Families: []string{consumer.StreamSessionsMetricName}}},
+		{"CLF", consumer.GeoIPOptions{Databases: []string{validPath}, ForwardedField: "http_x_forwarded_for"}},
+	} {
+		ctrl := gomock.NewController(t)
+
+		tailer := mock_tailer.NewMockTailerT(ctrl)
+		manager := mock_metrics.NewMockManagerT(ctrl)
+
+		opts := tc.opts
+		if _, err := consumer.NewConsumer(testPeriod, tailer, manager, []string{}, tc.format, consumer.Options{
+			GeoIP: &opts,
+		}); err == nil {
+			t.Errorf("Expected NewConsumer to fail for %s format with GeoIP options: %+v", tc.format, tc.opts)
+		}
+
+		ctrl.Finish()
+	}
+}
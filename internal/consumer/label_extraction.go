@@ -0,0 +1,170 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// Value reported for extracted values matching neither the pattern nor
+	// the allowlist of a LabelExtraction.
+	extractedOther = "other"
+)
+
+// LabelExtraction defines a label added to access log metrics, whose value
+// is extracted from a request query parameter or a log field (e.g. a logged
+// request header such as $http_x_tenant_id). Requests lacking the parameter or
+// field (or for which it is empty or "-") are exported with an empty label
+// value.
+type LabelExtraction struct {
+	// Label is the name of the exported label.
+	Label string
+	// QueryParam names the query parameter from which the value is
+	// extracted. Exactly one of QueryParam and Field must be specified.
+	QueryParam string
+	// Field names the log field from which the value is extracted (JSON
+	// format only).
+	Field string
+	// Pattern, if non-nil, normalizes extracted values: Values matching the
+	// pattern are replaced with Replacement (expanded as in
+	// regexp.Regexp.Expand, e.g. "v$1"), while others are reported as
+	// "other".
+	Pattern *regexp.Regexp
+	// Replacement is the template used with Pattern. Defaults to "$0" (i.e.
+	// the matched text).
+	Replacement string
+	// Allowed, if non-empty, lists the (normalized) values exported verbatim,
+	// while others are reported as "other". At least one of Pattern and
+	// Allowed must be specified.
+	Allowed []string
+	// Families name the metrics to which the label is added: Any of the
+	// HTTP response, SLO, protocol, limited request, connection, and stream
+	// metrics. Defaults to ResponseCountMetricName.
+	Families []string
+}
+
+// labelExtractionConfig is the JSON representation of a LabelExtraction.
+type labelExtractionConfig struct {
+	Label       string   `json:"label"`
+	QueryParam  string   `json:"query_param"`
+	Field       string   `json:"field"`
+	Pattern     string   `json:"pattern"`
+	Replacement string   `json:"replacement"`
+	Allowed     []string `json:"allowed"`
+	Metrics     []string `json:"metrics"`
+}
+
+// ParseLabelExtractions parses a JSON list of label extractions (see
+// README.md), e.g.:
+//
+//	[{"label": "api_version", "query_param": "api_version", "pattern": "^v?([0-9]+)$", "replacement": "v$1"}]
+func ParseLabelExtractions(b []byte) ([]LabelExtraction, error) {
+	var configs []labelExtractionConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("could not parse label config: %v", err)
+	}
+
+	var extractions []LabelExtraction
+	for _, config := range configs {
+		e := LabelExtraction{
+			Label:       config.Label,
+			QueryParam:  config.QueryParam,
+			Field:       config.Field,
+			Replacement: config.Replacement,
+			Allowed:     config.Allowed,
+			Families:    config.Metrics,
+		}
+
+		if config.Pattern != "" {
+			var err error
+			if e.Pattern, err = regexp.Compile(config.Pattern); err != nil {
+				return nil, fmt.Errorf("could not parse pattern for label %s: %v", config.Label, err)
+			}
+		}
+
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+		extractions = append(extractions, e)
+	}
+
+	return extractions, nil
+}
+
+func (e *LabelExtraction) validate() error {
+	if !labelNameRE.MatchString(e.Label) {
+		return fmt.Errorf("extracted label name must be a valid label name: \"%s\"", e.Label)
+	}
+	if (e.QueryParam == "") == (e.Field == "") {
+		return fmt.Errorf("exactly one of query parameter and field must be specified for label %s", e.Label)
+	}
+	if e.Pattern == nil && len(e.Allowed) == 0 {
+		return fmt.Errorf("a pattern or allowlist must be specified for label %s", e.Label)
+	}
+	if e.Replacement != "" && e.Pattern == nil {
+		return fmt.Errorf("replacement requires a pattern for label %s", e.Label)
+	}
+	return nil
+}
+
+// labelExtractor is a labeler extracting a single label.
+type labelExtractor struct {
+	extraction  LabelExtraction
+	replacement string
+	allowed     map[string]bool
+}
+
+func newLabelExtractor(e LabelExtraction) *labelExtractor {
+	x := &labelExtractor{
+		extraction:  e,
+		replacement: e.Replacement,
+	}
+	if x.replacement == "" {
+		x.replacement = "$0"
+	}
+	if len(e.Allowed) > 0 {
+		x.allowed = make(map[string]bool)
+		for _, value := range e.Allowed {
+			x.allowed[value] = true
+		}
+	}
+	return x
+}
+
+// value returns the normalized label value for the supplied raw value.
+func (x *labelExtractor) value(raw string) string {
+	if raw == "" || raw == "-" {
+		return ""
+	}
+	value := raw
+	if x.extraction.Pattern != nil {
+		m := x.extraction.Pattern.FindStringSubmatchIndex(raw)
+		if m == nil {
+			return extractedOther
+		}
+		value = string(x.extraction.Pattern.ExpandString(nil, x.replacement, raw, m))
+	}
+	if x.allowed != nil && !x.allowed[value] {
+		return extractedOther
+	}
+	return value
+}
+
+func (x *labelExtractor) labelNames() []string {
+	return []string{x.extraction.Label}
+}
+
+func (x *labelExtractor) labels(line *parsedLogLine) map[string]string {
+	var raw string
+	if x.extraction.QueryParam != "" {
+		raw = line.query().Get(x.extraction.QueryParam)
+	} else {
+		raw = line.Fields[x.extraction.Field]
+	}
+	return map[string]string{
+		x.extraction.Label: x.value(raw),
+	}
+}
+
+func (x *labelExtractor) refresh() {}
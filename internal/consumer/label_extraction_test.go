@@ -0,0 +1,52 @@
+package consumer_test
+
+import (
+	"testing"
+
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+)
+
+func TestParseLabelExtractions(t *testing.T) {
+	extractions, err := consumer.ParseLabelExtractions([]byte(`[
+		{"label": "api_version", "query_param": "api_version", "pattern": "^v?([0-9]+)$", "replacement": "v$1", "metrics": ["nginx_http_response_total", "nginx_http_response_duration_seconds"]},
+		{"label": "tenant", "field": "http_x_tenant_id", "allowed": ["acme", "globex"]}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseLabelExtractions returned unexpected error: %v", err)
+	}
+	if len(extractions) != 2 {
+		t.Fatalf("Expected 2 label extractions, got %d: %v", len(extractions), extractions)
+	}
+
+	version := extractions[0]
+	if version.Label != "api_version" || version.QueryParam != "api_version" || version.Field != "" || version.Replacement != "v$1" {
+		t.Errorf("Unexpected label extraction: %+v", version)
+	}
+	if version.Pattern == nil || !version.Pattern.MatchString("v2") {
+		t.Errorf("Unexpected pattern for label %s: %v", version.Label, version.Pattern)
+	}
+	if want, got := []string{consumer.ResponseCountMetricName, consumer.ResponseDurationMetricName}, version.Families; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected metrics %v for label %s, got %v", want, version.Label, got)
+	}
+
+	tenant := extractions[1]
+	if tenant.Label != "tenant" || tenant.Field != "http_x_tenant_id" || tenant.Pattern != nil || len(tenant.Families) != 0 {
+		t.Errorf("Unexpected label extraction: %+v", tenant)
+	}
+	if want, got := []string{"acme", "globex"}, tenant.Allowed; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected allowed values %v for label %s, got %v", want, tenant.Label, got)
+	}
+}
+
+func TestParseLabelExtractionsInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"label": "tenant"}`,
+		`[{"label": "tenant", "field": "http_x_tenant_id", "pattern": "("}]`,
+		`[{"label": "tenant", "field": "http_x_tenant_id"}]`,
+		`[{"label": "tenant-id", "field": "http_x_tenant_id", "allowed": ["acme"]}]`,
+	} {
+		if extractions, err := consumer.ParseLabelExtractions([]byte(config)); err == nil {
+			t.Errorf("Expected ParseLabelExtractions to fail for config %s, got: %v", config, extractions)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+var (
+	// Metric families to which labelers may contribute labels, mapped to
+	// their own labels, which labelers may not contribute. Other families
+	// (e.g. top clients, unique visitors, and error log and exporter metrics)
+	// do not support additional labels.
+	labeledFamilies = map[string][]string{
+		ResponseCountMetricName:         {"status_code"},
+		ResponseCountDetailedMetricName: {"status_code", "path", "method"},
+		ResponseDurationMetricName:      {"status_code"},
+		ResponseSizeMetricName:          {"status_code"},
+		SLOEventsMetricName:             {"slo"},
+		SLOGoodEventsMetricName:         {"slo"},
+		SLOBadEventsMetricName:          {"slo", "reason"},
+		SLOApdexMetricName:              {"slo", "class"},
+		HTTPProtocolMetricName:          {httpProtocolSpec.label},
+		TLSProtocolMetricName:           {tlsProtocolSpec.label},
+		TLSCipherMetricName:             {tlsCipherSpec.label},
+		LimitedRequestsMetricName:       {"limit", "status", "server"},
+		ConnectionsOpenedMetricName:     nil,
+		RequestsPerConnectionMetricName: nil,
+		StreamSessionsMetricName:        {"status_code"},
+		StreamSessionDurationMetricName: {"status_code"},
+		StreamBytesSentMetricName:       {"upstream"},
+		StreamBytesReceivedMetricName:   {"upstream"},
+	}
+)
+
+// labeler derives additional labels for metrics from each consumed log line
+// (e.g. by classifying a field value).
+type labeler interface {
+	// labelNames returns the names of the labels derived.
+	labelNames() []string
+	// labels returns the values of the derived labels for the supplied
+	// line. Labels absent from the result are exported with an empty value.
+	labels(line *parsedLogLine) map[string]string
+	// refresh is called once per poll, prior to consuming new lines, e.g.
+	// to reload configuration that has changed on disk.
+	refresh()
+}
+
+// extraLabeler associates a labeler with the metric families to whose label
+// sets it contributes.
+type extraLabeler struct {
+	labeler  labeler
+	families map[string]bool
+}
+
+// addLabeler configures the supplied labeler to contribute labels to the
+// named metric families. Must be called prior to registering those metrics.
+// Returns an error if any family does not support additional labels, or if
+// any label is already present in one of the families.
+func (c *Consumer) addLabeler(l labeler, families []string) error {
+	e := extraLabeler{
+		labeler:  l,
+		families: make(map[string]bool),
+	}
+	for _, family := range families {
+		base, ok := labeledFamilies[family]
+		if !ok {
+			return fmt.Errorf("additional labels are not supported for metric: %s", family)
+		}
+		existing := make(map[string]bool)
+		for _, name := range c.labelNames(family, base...) {
+			existing[name] = true
+		}
+		for _, name := range l.labelNames() {
+			if existing[name] {
+				return fmt.Errorf("label %s is already present for metric: %s", name, family)
+			}
+		}
+		e.families[family] = true
+	}
+	c.labelers = append(c.labelers, e)
+	return nil
+}
+
+// labelNames returns the supplied base label names for the named metric
+// family, followed by those contributed by any labelers.
+func (c *Consumer) labelNames(family string, base ...string) []string {
+	var names []string
+	names = append(names, base...)
+	for _, e := range c.labelers {
+		if e.families[family] {
+			names = append(names, e.labeler.labelNames()...)
+		}
+	}
+	return names
+}
+
+// extraLabels returns the values of all labels contributed by labelers for
+// the supplied line, keyed by metric family.
+func (c *Consumer) extraLabels(line *parsedLogLine) map[string]map[string]string {
+	if len(c.labelers) == 0 {
+		return nil
+	}
+	extra := make(map[string]map[string]string)
+	for _, e := range c.labelers {
+		values := e.labeler.labels(line)
+		for family := range e.families {
+			if extra[family] == nil {
+				extra[family] = make(map[string]string)
+			}
+			for _, name := range e.labeler.labelNames() {
+				extra[family][name] = values[name]
+			}
+		}
+	}
+	return extra
+}
+
+// withLabels returns the union of the supplied label sets, along with a
+// canonical key for the result suitable for keyed aggregation.
+func withLabels(base map[string]string, extra map[string]string) (string, map[string]string) {
+	labels := make(map[string]string)
+	for k, v := range base {
+		labels[k] = v
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return metrics.LabelsKey(labels), labels
+}
@@ -0,0 +1,171 @@
+package consumer
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// LimitedRequestsMetricName is the name of the metric reporting the total
+	// number of requests delayed or rejected by limit_req or limit_conn, by
+	// server, as logged in the access log.
+	LimitedRequestsMetricName = "nginx_http_limited_requests_total"
+	// ErrorLogLimitedRequestsMetricName is the name of the metric reporting
+	// the total number of requests delayed or rejected by limit_req or
+	// limit_conn, by zone and server, as logged in the error log.
+	ErrorLogLimitedRequestsMetricName = "nginx_error_log_limited_requests_total"
+)
+
+const (
+	// Values of the "limit" label on limited request metrics.
+	limitReq  = "req"
+	limitConn = "conn"
+
+	// Defaults for LimitsOptions.
+	defaultLimitReqStatusField  = "limit_req_status"
+	defaultLimitConnStatusField = "limit_conn_status"
+	defaultLimitServerField     = "server_name"
+)
+
+var (
+	// Values of $limit_req_status and $limit_conn_status counted as limited
+	// requests, mapped to the corresponding "status" label value. Requests
+	// having other values (e.g. PASSED) are not counted.
+	limitStatuses = map[string]string{
+		"DELAYED":          "delayed",
+		"REJECTED":         "rejected",
+		"DELAYED_DRY_RUN":  "delayed_dry_run",
+		"REJECTED_DRY_RUN": "rejected_dry_run",
+	}
+
+	// Match error log messages of limit_req and limit_conn, capturing the
+	// dry run marker (if any) and zone.
+	limitReqRejectedRE = regexp.MustCompile(`^limiting requests(, dry run)?, excess: [0-9.]+ by zone "([^"]*)"`)
+	limitReqDelayedRE  = regexp.MustCompile(`^delaying request(, dry run)?, excess: [0-9.]+, by zone "([^"]*)"`)
+	limitConnRE        = regexp.MustCompile(`^limiting connections(, dry run,)? by zone "([^"]*)"`)
+
+	// Matches the server appended to error log messages for requests.
+	errorLogServerRE = regexp.MustCompile(`, server: ([^,]*)`)
+)
+
+// LimitsOptions configures export of counts of requests delayed or rejected
+// by limit_req and limit_conn, as logged in the access log via
+// $limit_req_status and $limit_conn_status (JSON format only).
+type LimitsOptions struct {
+	// ReqStatusField names the log field containing $limit_req_status.
+	// Defaults to "limit_req_status".
+	ReqStatusField string
+	// ConnStatusField names the log field containing $limit_conn_status.
+	// Defaults to "limit_conn_status".
+	ConnStatusField string
+	// ServerField names the log field identifying the server (e.g.
+	// $server_name). Defaults to "server_name".
+	ServerField string
+}
+
+func (o *LimitsOptions) setDefaults() {
+	if o.ReqStatusField == "" {
+		o.ReqStatusField = defaultLimitReqStatusField
+	}
+	if o.ConnStatusField == "" {
+		o.ConnStatusField = defaultLimitConnStatusField
+	}
+	if o.ServerField == "" {
+		o.ServerField = defaultLimitServerField
+	}
+}
+
+// fields returns the log fields required by the configured options.
+func (o *LimitsOptions) fields() []string {
+	return []string{o.ReqStatusField, o.ConnStatusField, o.ServerField}
+}
+
+// limits counts limited requests logged in the access log.
+type limits struct {
+	opts    LimitsOptions
+	counter metrics.CounterT
+}
+
+func (c *Consumer) addLimits(opts LimitsOptions) (*limits, error) {
+	if err := c.manager.AddCounter(LimitedRequestsMetricName, "Total number of requests delayed or rejected by limit_req or limit_conn, by server", c.labelNames(LimitedRequestsMetricName, "limit", "status", "server")); err != nil {
+		return nil, err
+	}
+	counter, err := c.manager.GetCounter(LimitedRequestsMetricName)
+	if err != nil {
+		return nil, err
+	}
+	return &limits{
+		opts:    opts,
+		counter: counter,
+	}, nil
+}
+
+// consume records the supplied line, having the supplied additional labels, in
+// the supplied per-poll counts, if it was limited.
+func (l *limits) consume(line *parsedLogLine, extra map[string]string, counts *keyedCounter) {
+	server := line.Fields[l.opts.ServerField]
+	for _, limit := range []struct {
+		name  string
+		field string
+	}{
+		{limitReq, l.opts.ReqStatusField},
+		{limitConn, l.opts.ConnStatusField},
+	} {
+		status, ok := limitStatuses[line.Fields[limit.field]]
+		if !ok {
+			continue
+		}
+		counts.inc(withLabels(map[string]string{
+			"limit":  limit.name,
+			"status": status,
+			"server": server,
+		}, extra))
+	}
+}
+
+// export exports the supplied per-poll counts.
+func (l *limits) export(counts *keyedCounter) error {
+	for _, count := range counts.counts {
+		if err := l.counter.Add(count.annotations, count.total); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitEvent returns the labels describing the limited request logged in the
+// supplied error log message, or nil if the message is not from limit_req or
+// limit_conn.
+func limitEvent(message string) map[string]string {
+	for _, event := range []struct {
+		re     *regexp.Regexp
+		limit  string
+		status string
+	}{
+		{limitReqRejectedRE, limitReq, "rejected"},
+		{limitReqDelayedRE, limitReq, "delayed"},
+		{limitConnRE, limitConn, "rejected"},
+	} {
+		m := event.re.FindStringSubmatch(message)
+		if m == nil {
+			continue
+		}
+		status := event.status
+		if m[1] != "" {
+			status += "_dry_run"
+		}
+		server := ""
+		if s := errorLogServerRE.FindStringSubmatch(message); s != nil {
+			server = strings.TrimSpace(s[1])
+		}
+		return map[string]string{
+			"limit":  event.limit,
+			"status": status,
+			"zone":   m[2],
+			"server": server,
+		}
+	}
+	return nil
+}
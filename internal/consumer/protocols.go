@@ -0,0 +1,190 @@
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// HTTPProtocolMetricName is the name of the metric reporting the total
+	// number of requests by HTTP protocol version (e.g. "HTTP/1.1").
+	HTTPProtocolMetricName = "nginx_http_requests_by_protocol_total"
+	// TLSProtocolMetricName is the name of the metric reporting the total
+	// number of requests by TLS protocol version (e.g. "TLSv1.3").
+	TLSProtocolMetricName = "nginx_http_requests_by_tls_protocol_total"
+	// TLSCipherMetricName is the name of the metric reporting the total
+	// number of requests by TLS cipher suite.
+	TLSCipherMetricName = "nginx_http_requests_by_tls_cipher_total"
+)
+
+const (
+	// Value reported for values not in the allowlist of a protocol
+	// dimension.
+	protocolOther = "other"
+
+	// Value reported for requests not using TLS (i.e. for which nginx logs
+	// an empty $ssl_protocol or $ssl_cipher).
+	protocolNone = "none"
+
+	// Default log fields containing TLS protocol and cipher.
+	defaultTLSProtocolField = "ssl_protocol"
+	defaultTLSCipherField   = "ssl_cipher"
+)
+
+var (
+	// Default allowlists for each protocol dimension.
+	defaultHTTPProtocols = []string{"HTTP/0.9", "HTTP/1.0", "HTTP/1.1", "HTTP/2.0", "HTTP/3.0"}
+	defaultTLSProtocols  = []string{"SSLv3", "TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+	defaultTLSCiphers    = []string{
+		// TLS 1.3
+		"TLS_AES_128_GCM_SHA256",
+		"TLS_AES_256_GCM_SHA384",
+		"TLS_CHACHA20_POLY1305_SHA256",
+		// TLS 1.2 (and earlier), per OpenSSL naming
+		"ECDHE-ECDSA-AES128-GCM-SHA256",
+		"ECDHE-RSA-AES128-GCM-SHA256",
+		"ECDHE-ECDSA-AES256-GCM-SHA384",
+		"ECDHE-RSA-AES256-GCM-SHA384",
+		"ECDHE-ECDSA-CHACHA20-POLY1305",
+		"ECDHE-RSA-CHACHA20-POLY1305",
+		"ECDHE-RSA-AES128-SHA",
+		"ECDHE-RSA-AES256-SHA",
+		"AES128-GCM-SHA256",
+		"AES256-GCM-SHA384",
+		"AES128-SHA",
+		"AES256-SHA",
+		"DES-CBC3-SHA",
+	}
+)
+
+// ProtocolDimensionOptions configures export of request counts by a single
+// protocol dimension (see Options).
+type ProtocolDimensionOptions struct {
+	// Field names the log field containing the dimension value (e.g.
+	// "ssl_protocol"). Must be empty for HTTP protocol versions, which are
+	// taken from the request line.
+	Field string
+	// Allowed lists the values exported verbatim, while others are exported
+	// as "other", bounding cardinality. Defaults to well-known values for the
+	// dimension.
+	Allowed []string
+}
+
+// protocolDimensionSpec describes a protocol dimension and its defaults.
+type protocolDimensionSpec struct {
+	name  string
+	help  string
+	label string
+	// defaultField is empty for dimensions not taken from a log field.
+	defaultField   string
+	defaultAllowed []string
+}
+
+var (
+	httpProtocolSpec = protocolDimensionSpec{HTTPProtocolMetricName, "Total number of requests by HTTP protocol version", "protocol", "", defaultHTTPProtocols}
+	tlsProtocolSpec  = protocolDimensionSpec{TLSProtocolMetricName, "Total number of requests by TLS protocol version", "tls_protocol", defaultTLSProtocolField, defaultTLSProtocols}
+	tlsCipherSpec    = protocolDimensionSpec{TLSCipherMetricName, "Total number of requests by TLS cipher suite", "tls_cipher", defaultTLSCipherField, defaultTLSCiphers}
+)
+
+// protocolDimension exports request counts by the values of a single protocol
+// dimension.
+type protocolDimension struct {
+	spec    protocolDimensionSpec
+	field   string
+	allowed map[string]bool
+	counter metrics.CounterT
+}
+
+func newProtocolDimension(spec protocolDimensionSpec, opts ProtocolDimensionOptions) (*protocolDimension, error) {
+	d := &protocolDimension{
+		spec:    spec,
+		field:   opts.Field,
+		allowed: make(map[string]bool),
+	}
+	if spec.defaultField == "" && d.field != "" {
+		return nil, fmt.Errorf("log field may not be configured for %s", spec.name)
+	} else if d.field == "" {
+		d.field = spec.defaultField
+	}
+
+	allowed := opts.Allowed
+	if len(allowed) == 0 {
+		allowed = spec.defaultAllowed
+	}
+	for _, value := range allowed {
+		if value == "" || value == protocolOther || value == protocolNone {
+			return nil, fmt.Errorf("invalid allowed value for %s: \"%s\"", spec.name, value)
+		}
+		d.allowed[value] = true
+	}
+
+	return d, nil
+}
+
+// register adds the metric for the dimension, having the supplied labels, to
+// the supplied manager.
+func (d *protocolDimension) register(manager metrics.ManagerT, labels []string) error {
+	if err := manager.AddCounter(d.spec.name, d.spec.help, labels); err != nil {
+		return err
+	}
+	var err error
+	d.counter, err = manager.GetCounter(d.spec.name)
+	return err
+}
+
+// value returns the value of the dimension for the supplied line, having the
+// supplied (HTTP) protocol, subject to the allowlist.
+func (d *protocolDimension) value(line *parsedLogLine, protocol string) string {
+	value := protocol
+	if d.field != "" {
+		value = line.Fields[d.field]
+		if value == "" || value == "-" {
+			return protocolNone
+		}
+	}
+	if !d.allowed[value] {
+		return protocolOther
+	}
+	return value
+}
+
+// consumeProtocols records the values of all configured protocol dimensions
+// for the supplied line, having the supplied request fields (the HTTP protocol
+// version being the third, if well formed) and additional labels.
+func (c *Consumer) consumeProtocols(line *parsedLogLine, requestFields []string, extra map[string]map[string]string, stats *logStats) {
+	for _, d := range c.protocolDimensions {
+		protocol := ""
+		if d.field == "" {
+			if len(requestFields) != 3 {
+				continue
+			}
+			protocol = requestFields[2]
+		}
+		value := d.value(line, protocol)
+		counts, ok := stats.protocols[d.spec.name]
+		if !ok {
+			counts = newKeyedCounter()
+			stats.protocols[d.spec.name] = counts
+		}
+		counts.inc(withLabels(map[string]string{
+			d.spec.label: value,
+		}, extra[d.spec.name]))
+	}
+}
+
+// recordProtocols exports the supplied per-poll protocol dimension counts.
+func (c *Consumer) recordProtocols(stats *logStats) error {
+	for _, d := range c.protocolDimensions {
+		counts, ok := stats.protocols[d.spec.name]
+		if !ok {
+			continue
+		}
+		for _, count := range counts.counts {
+			if err := d.counter.Add(count.annotations, count.total); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
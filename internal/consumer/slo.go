@@ -0,0 +1,285 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// SLOEventsMetricName is the name of the metric reporting the total
+	// number of requests evaluated against each SLO.
+	SLOEventsMetricName = "nginx_http_slo_events_total"
+	// SLOGoodEventsMetricName is the name of the metric reporting the total
+	// number of requests meeting each SLO.
+	SLOGoodEventsMetricName = "nginx_http_slo_good_events_total"
+	// SLOBadEventsMetricName is the name of the metric reporting the total
+	// number of requests failing each SLO, by reason ("error" or "latency").
+	SLOBadEventsMetricName = "nginx_http_slo_bad_events_total"
+	// SLOApdexMetricName is the name of the metric reporting the total
+	// number of requests in each Apdex class ("satisfied", "tolerating", or
+	// "frustrated") for each SLO.
+	SLOApdexMetricName = "nginx_http_slo_apdex_total"
+)
+
+const (
+	// Reasons for which a request may fail an SLO, used as values of the
+	// "reason" label on SLOBadEventsMetricName.
+	sloReasonError   = "error"
+	sloReasonLatency = "latency"
+
+	// Apdex classes, used as values of the "class" label on
+	// SLOApdexMetricName.
+	apdexSatisfied  = "satisfied"
+	apdexTolerating = "tolerating"
+	apdexFrustrated = "frustrated"
+
+	// Requests slower than this multiple of the threshold are considered
+	// frustrated, per the Apdex specification.
+	apdexToleratingFactor = 4
+)
+
+var (
+	// Error statuses used for SLOs which do not specify any.
+	defaultSLOErrorStatuses = []string{"5xx"}
+
+	// Matches an SLO error status: Either a specific status code or a status
+	// class (e.g. 5xx).
+	sloStatusRE = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+)
+
+// SLO defines a service level objective evaluated against each request
+// matching its route (and method, if specified). A matching request is good
+// if its status is not an error status and (if a latency threshold is
+// specified) its response duration does not exceed the threshold.
+type SLO struct {
+	// Name identifies the SLO in exported metrics (the "slo" label).
+	Name string
+	// Route matches the request paths to which the SLO applies.
+	Route *regexp.Regexp
+	// Method, if non-empty, restricts the SLO to requests with that method.
+	Method string
+	// LatencyThreshold, if non-zero, is the response duration above which
+	// requests fail the SLO. This also serves as the Apdex threshold T.
+	LatencyThreshold time.Duration
+	// ErrorStatuses are the status codes (e.g. "503") or classes (e.g.
+	// "5xx") which fail the SLO.
+	ErrorStatuses []string
+}
+
+// sloConfig is the JSON representation of an SLO.
+type sloConfig struct {
+	Name             string   `json:"name"`
+	Route            string   `json:"route"`
+	Method           string   `json:"method"`
+	LatencyThreshold string   `json:"latency_threshold"`
+	ErrorStatuses    []string `json:"error_statuses"`
+}
+
+// ParseSLOs parses a JSON list of SLO definitions (see README.md), e.g.:
+//
+//	[{"name": "api", "route": "^/api/", "latency_threshold": "300ms", "error_statuses": ["5xx", "429"]}]
+//
+// Route defaults to matching all paths, and error statuses default to 5xx.
+func ParseSLOs(b []byte) ([]SLO, error) {
+	var configs []sloConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("could not parse SLO config: %v", err)
+	}
+
+	var slos []SLO
+	for _, config := range configs {
+		slo := SLO{
+			Name:          config.Name,
+			Method:        config.Method,
+			ErrorStatuses: config.ErrorStatuses,
+		}
+
+		var err error
+		if slo.Route, err = regexp.Compile(config.Route); err != nil {
+			return nil, fmt.Errorf("could not parse route for SLO %s: %v", config.Name, err)
+		}
+
+		if config.LatencyThreshold != "" {
+			if slo.LatencyThreshold, err = time.ParseDuration(config.LatencyThreshold); err != nil {
+				return nil, fmt.Errorf("could not parse latency threshold for SLO %s: %v", config.Name, err)
+			}
+		}
+
+		if err := slo.validate(); err != nil {
+			return nil, err
+		}
+		slos = append(slos, slo)
+	}
+
+	return slos, nil
+}
+
+func (s *SLO) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("SLO name must be non-empty")
+	}
+	if s.Route == nil {
+		return fmt.Errorf("route must be specified for SLO %s", s.Name)
+	}
+	if s.LatencyThreshold < 0 {
+		return fmt.Errorf("latency threshold for SLO %s must be non-negative", s.Name)
+	}
+	for _, status := range s.ErrorStatuses {
+		if !sloStatusRE.MatchString(status) {
+			return fmt.Errorf("invalid error status for SLO %s: \"%s\"", s.Name, status)
+		}
+	}
+	return nil
+}
+
+// isError returns true if the supplied status is an error status for the SLO.
+func (s *SLO) isError(status string) bool {
+	statuses := s.ErrorStatuses
+	if len(statuses) == 0 {
+		statuses = defaultSLOErrorStatuses
+	}
+	for _, pattern := range statuses {
+		if pattern == status {
+			return true
+		} else if strings.HasSuffix(pattern, "xx") && len(status) == 3 && status[0] == pattern[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the SLO applies to a request with the supplied
+// method and path.
+func (s *SLO) matches(method, path string) bool {
+	return (s.Method == "" || s.Method == method) && s.Route.MatchString(path)
+}
+
+// sloMetrics holds the metrics exported for SLOs configured via Options.
+type sloMetrics struct {
+	events     metrics.CounterT
+	goodEvents metrics.CounterT
+	badEvents  metrics.CounterT
+	apdex      metrics.CounterT
+}
+
+func (c *Consumer) addSLOMetrics() (*sloMetrics, error) {
+	s := &sloMetrics{}
+
+	for _, counter := range []struct {
+		name   string
+		help   string
+		labels []string
+		metric *metrics.CounterT
+	}{
+		{SLOEventsMetricName, "Total number of requests evaluated against each SLO", []string{"slo"}, &s.events},
+		{SLOGoodEventsMetricName, "Total number of requests meeting each SLO", []string{"slo"}, &s.goodEvents},
+		{SLOBadEventsMetricName, "Total number of requests failing each SLO by reason", []string{"slo", "reason"}, &s.badEvents},
+		{SLOApdexMetricName, "Total number of requests in each Apdex class for each SLO with a latency threshold", []string{"slo", "class"}, &s.apdex},
+	} {
+		if err := c.manager.AddCounter(counter.name, counter.help, c.labelNames(counter.name, counter.labels...)); err != nil {
+			return nil, err
+		}
+		m, err := c.manager.GetCounter(counter.name)
+		if err != nil {
+			return nil, err
+		}
+		*counter.metric = m
+	}
+
+	return s, nil
+}
+
+// sloStats holds per-poll SLO event counts.
+type sloStats struct {
+	events     *keyedCounter
+	goodEvents *keyedCounter
+	badEvents  *keyedCounter
+	apdex      *keyedCounter
+}
+
+func newSLOStats() *sloStats {
+	return &sloStats{
+		events:     newKeyedCounter(),
+		goodEvents: newKeyedCounter(),
+		badEvents:  newKeyedCounter(),
+		apdex:      newKeyedCounter(),
+	}
+}
+
+// consumeSLOs evaluates the supplied line, having the supplied method, path,
+// and additional labels, against all matching SLOs. Lines lacking a response
+// duration are not evaluated against SLOs having a latency threshold.
+func (c *Consumer) consumeSLOs(line *parsedLogLine, method, path string, extra map[string]map[string]string, stats *sloStats) {
+	for i := range c.opts.SLOs {
+		slo := &c.opts.SLOs[i]
+		if !slo.matches(method, path) {
+			continue
+		}
+		threshold := slo.LatencyThreshold.Seconds()
+		if threshold > 0 && line.RequestTime < 0 {
+			continue
+		}
+
+		labels := map[string]string{"slo": slo.Name}
+		stats.events.inc(withLabels(labels, extra[SLOEventsMetricName]))
+
+		isError := slo.isError(line.Status)
+		if isError {
+			stats.badEvents.inc(withLabels(map[string]string{
+				"slo":    slo.Name,
+				"reason": sloReasonError,
+			}, extra[SLOBadEventsMetricName]))
+		} else if threshold > 0 && line.RequestTime > threshold {
+			stats.badEvents.inc(withLabels(map[string]string{
+				"slo":    slo.Name,
+				"reason": sloReasonLatency,
+			}, extra[SLOBadEventsMetricName]))
+		} else {
+			stats.goodEvents.inc(withLabels(labels, extra[SLOGoodEventsMetricName]))
+		}
+
+		if threshold > 0 {
+			var class string
+			switch {
+			case isError:
+				// Errors are always considered frustrated.
+				class = apdexFrustrated
+			case line.RequestTime <= threshold:
+				class = apdexSatisfied
+			case line.RequestTime <= apdexToleratingFactor*threshold:
+				class = apdexTolerating
+			default:
+				class = apdexFrustrated
+			}
+			stats.apdex.inc(withLabels(map[string]string{
+				"slo":   slo.Name,
+				"class": class,
+			}, extra[SLOApdexMetricName]))
+		}
+	}
+}
+
+// recordSLOs exports the supplied per-poll SLO event counts.
+func (c *Consumer) recordSLOs(stats *sloStats) error {
+	for _, counter := range []struct {
+		counts *keyedCounter
+		metric metrics.CounterT
+	}{
+		{stats.events, c.sloMetrics.events},
+		{stats.goodEvents, c.sloMetrics.goodEvents},
+		{stats.badEvents, c.sloMetrics.badEvents},
+		{stats.apdex, c.sloMetrics.apdex},
+	} {
+		for _, count := range counter.counts.counts {
+			if err := counter.metric.Add(count.annotations, count.total); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package consumer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/consumer"
+)
+
+func TestParseSLOs(t *testing.T) {
+	slos, err := consumer.ParseSLOs([]byte(`[
+		{"name": "api", "route": "^/api/", "method": "GET", "latency_threshold": "300ms", "error_statuses": ["5xx", "429"]},
+		{"name": "all"}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseSLOs returned unexpected error: %v", err)
+	}
+	if len(slos) != 2 {
+		t.Fatalf("Expected 2 SLOs, got %d: %v", len(slos), slos)
+	}
+
+	api := slos[0]
+	if api.Name != "api" || api.Method != "GET" || api.LatencyThreshold != 300*time.Millisecond {
+		t.Errorf("Unexpected SLO: %+v", api)
+	}
+	if !api.Route.MatchString("/api/foo") || api.Route.MatchString("/foo") {
+		t.Errorf("Unexpected route for SLO %s: %v", api.Name, api.Route)
+	}
+	if want, got := []string{"5xx", "429"}, api.ErrorStatuses; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected error statuses %v for SLO %s, got %v", want, api.Name, got)
+	}
+
+	all := slos[1]
+	if all.Name != "all" || all.Method != "" || all.LatencyThreshold != 0 || len(all.ErrorStatuses) != 0 {
+		t.Errorf("Unexpected SLO: %+v", all)
+	}
+	if !all.Route.MatchString("/anything") {
+		t.Errorf("Expected default route for SLO %s to match all paths", all.Name)
+	}
+}
+
+func TestParseSLOsErrors(t *testing.T) {
+	for _, config := range []string{
+		`not json`,
+		`{"name": "api"}`,
+		`[{"route": "^/api/"}]`,
+		`[{"name": "api", "route": "("}]`,
+		`[{"name": "api", "latency_threshold": "fast"}]`,
+		`[{"name": "api", "latency_threshold": "-1s"}]`,
+		`[{"name": "api", "error_statuses": ["5XX"]}]`,
+		`[{"name": "api", "error_statuses": ["600"]}]`,
+	} {
+		if slos, err := consumer.ParseSLOs([]byte(config)); err == nil {
+			t.Errorf("Expected ParseSLOs(%q) to fail, got: %v", config, slos)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package consumer
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// StreamFormat is the log format of nginx stream (TCP / UDP proxy) access
+	// logs, written as JSON (see README.md).
+	StreamFormat = "STREAM"
+
+	// StreamSessionsMetricName is the name of the metric reporting the total
+	// number of stream sessions by status.
+	StreamSessionsMetricName = "nginx_stream_sessions_total"
+	// StreamSessionDurationMetricName is the name of the metric reporting the
+	// distribution of stream session durations by status.
+	StreamSessionDurationMetricName = "nginx_stream_session_duration_seconds"
+	// StreamBytesSentMetricName is the name of the metric reporting the total
+	// number of bytes sent to stream clients, by upstream.
+	StreamBytesSentMetricName = "nginx_stream_bytes_sent_total"
+	// StreamBytesReceivedMetricName is the name of the metric reporting the
+	// total number of bytes received from stream clients, by upstream.
+	StreamBytesReceivedMetricName = "nginx_stream_bytes_received_total"
+)
+
+const (
+	// Value of the "upstream" label for sessions not proxied to an upstream
+	// (e.g. those rejected by access rules).
+	streamNoUpstream = "none"
+
+	// Log field containing the upstream address(es) of a stream session.
+	upstreamAddrField = "upstream_addr"
+)
+
+var (
+	// Metric families exported for stream access logs.
+	streamFamilies = map[string]bool{
+		StreamSessionsMetricName:        true,
+		StreamSessionDurationMetricName: true,
+		StreamBytesSentMetricName:       true,
+		StreamBytesReceivedMetricName:   true,
+	}
+
+	// Default buckets used with the session duration distribution metric.
+	// Stream sessions (e.g. pooled database connections) may be much longer
+	// lived than HTTP requests.
+	streamSessionDurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60, 300, 900, 3600}
+)
+
+// newStreamParser returns a parser for JSON stream access log lines, which
+// additionally stores the named fields (if present) in Fields.
+func newStreamParser(fields []string) func([]byte) (*parsedLogLine, error) {
+	if len(fields) == 0 {
+		return parseStream
+	}
+	return func(b []byte) (*parsedLogLine, error) {
+		line, err := parseStream(b)
+		if err != nil {
+			return nil, err
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, newParseError(reasonMalformedLine, "could not parse log line: %v", err)
+		}
+		addJSONFields(line.Fields, raw, fields)
+		return line, nil
+	}
+}
+
+// parseStream parses a JSON stream access log line. Session duration and bytes
+// received are stored in RequestTime and BytesReceived, respectively, while
+// the upstream address is stored in Fields.
+func parseStream(b []byte) (*parsedLogLine, error) {
+	line := &struct {
+		Time          string  `json:"time"`
+		Status        string  `json:"status"`
+		SessionTime   float64 `json:"session_time"`
+		BytesSent     float64 `json:"bytes_sent"`
+		BytesReceived float64 `json:"bytes_received"`
+		UpstreamAddr  string  `json:"upstream_addr"`
+	}{
+		SessionTime:   -1,
+		BytesSent:     -1,
+		BytesReceived: -1,
+	}
+
+	if err := json.Unmarshal(b, line); err != nil {
+		return nil, newParseError(reasonMalformedLine, "could not parse log line: %v", err)
+	}
+
+	t, err := time.Parse(ISO8601, line.Time)
+	if err != nil {
+		return nil, newParseError(reasonBadTimestamp, "could not parse log line timestamp: %v", err)
+	}
+
+	return &parsedLogLine{
+		Time:          t,
+		Status:        line.Status,
+		RequestTime:   line.SessionTime,
+		BytesSent:     line.BytesSent,
+		BytesReceived: line.BytesReceived,
+		Fields: map[string]string{
+			upstreamAddrField: line.UpstreamAddr,
+		},
+	}, nil
+}
+
+// streamUpstream returns the upstream label value for the supplied
+// $upstream_addr value. Where several upstreams were tried, the last (i.e.
+// that which served the session) is used.
+func streamUpstream(addrs string) string {
+	if i := strings.LastIndex(addrs, ","); i >= 0 {
+		addrs = addrs[i+1:]
+	}
+	addr := strings.TrimSpace(addrs)
+	if addr == "" || addr == "-" {
+		return streamNoUpstream
+	}
+	return addr
+}
+
+type streamMetrics struct {
+	sessions      metrics.CounterT
+	duration      metrics.HistogramT
+	bytesSent     metrics.CounterT
+	bytesReceived metrics.CounterT
+}
+
+func (c *Consumer) addStreamMetrics() (*streamMetrics, error) {
+	m := &streamMetrics{}
+
+	var err error
+
+	if err = c.manager.AddCounter(StreamSessionsMetricName, "Total number of stream sessions by status", c.labelNames(StreamSessionsMetricName, "status_code")); err != nil {
+		return nil, err
+	}
+	if m.sessions, err = c.manager.GetCounter(StreamSessionsMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.addHistogram(StreamSessionDurationMetricName, "Distribution of stream session duration (seconds) by status", c.labelNames(StreamSessionDurationMetricName, "status_code"), streamSessionDurationBuckets); err != nil {
+		return nil, err
+	}
+	if m.duration, err = c.manager.GetHistogram(StreamSessionDurationMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.manager.AddCounter(StreamBytesSentMetricName, "Total number of bytes sent to stream clients by upstream", c.labelNames(StreamBytesSentMetricName, "upstream")); err != nil {
+		return nil, err
+	}
+	if m.bytesSent, err = c.manager.GetCounter(StreamBytesSentMetricName); err != nil {
+		return nil, err
+	}
+
+	if err = c.manager.AddCounter(StreamBytesReceivedMetricName, "Total number of bytes received from stream clients by upstream", c.labelNames(StreamBytesReceivedMetricName, "upstream")); err != nil {
+		return nil, err
+	}
+	if m.bytesReceived, err = c.manager.GetCounter(StreamBytesReceivedMetricName); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// streamStats holds per-poll stream session counts and byte totals.
+type streamStats struct {
+	sessions      *keyedCounter
+	durations     *keyedAccumulator
+	bytesSent     *keyedCounter
+	bytesReceived *keyedCounter
+}
+
+func newStreamStats() *streamStats {
+	return &streamStats{
+		sessions:      newKeyedCounter(),
+		durations:     newKeyedAccumulator(),
+		bytesSent:     newKeyedCounter(),
+		bytesReceived: newKeyedCounter(),
+	}
+}
+
+// consumeStream records the session described by the supplied line.
+func (c *Consumer) consumeStream(line *parsedLogLine, stats *streamStats) {
+	extra := c.extraLabels(line)
+	status := map[string]string{
+		"status_code": line.Status,
+	}
+	stats.sessions.inc(withLabels(status, extra[StreamSessionsMetricName]))
+	if line.RequestTime >= 0 {
+		key, labels := withLabels(status, extra[StreamSessionDurationMetricName])
+		stats.durations.record(key, line.RequestTime, labels)
+	}
+
+	upstream := map[string]string{
+		"upstream": streamUpstream(line.Fields[upstreamAddrField]),
+	}
+	if line.BytesSent >= 0 {
+		key, labels := withLabels(upstream, extra[StreamBytesSentMetricName])
+		stats.bytesSent.add(key, line.BytesSent, labels)
+	}
+	if line.BytesReceived >= 0 {
+		key, labels := withLabels(upstream, extra[StreamBytesReceivedMetricName])
+		stats.bytesReceived.add(key, line.BytesReceived, labels)
+	}
+}
+
+// recordStream exports the supplied per-poll stream stats.
+func (c *Consumer) recordStream(stats *streamStats) error {
+	for _, count := range stats.sessions.counts {
+		if err := c.streamMetrics.sessions.Add(count.annotations, count.total); err != nil {
+			return err
+		}
+	}
+	for _, observations := range stats.durations.observations {
+		if err := c.streamMetrics.duration.Observe(observations.annotations, observations.seen); err != nil {
+			return err
+		}
+	}
+	for _, totals := range []struct {
+		metric metrics.CounterT
+		bytes  *keyedCounter
+	}{
+		{c.streamMetrics.bytesSent, stats.bytesSent},
+		{c.streamMetrics.bytesReceived, stats.bytesReceived},
+	} {
+		for _, total := range totals.bytes.counts {
+			if err := totals.metric.Add(total.annotations, total.total); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package consumer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+	"github.com/swfrench/nginx-log-exporter/internal/sketch"
+)
+
+const (
+	// TopClientRequestsMetricName is the name of the metric reporting the
+	// (approximate) number of requests issued by each of the top clients
+	// during the last complete window.
+	TopClientRequestsMetricName = "nginx_http_top_client_requests"
+)
+
+const (
+	// Defaults for TopClientsOptions.
+	defaultTopClientsField          = "remote_addr"
+	defaultTopClientsWindow         = time.Minute
+	defaultTopClientsCapacityFactor = 10
+)
+
+// TopClientsOptions configures export of the clients issuing the most
+// requests (i.e. "top talkers"), as identified by a heavy-hitters sketch of
+// bounded size.
+type TopClientsOptions struct {
+	// N is the number of top clients exported per window, and thus the
+	// maximum number of exported series.
+	N int
+	// Capacity is the number of distinct clients tracked by the sketch,
+	// which must be at least N. Larger values improve accuracy. Defaults to
+	// 10 * N.
+	Capacity int
+	// Field names the log field identifying the client. Defaults to
+	// "remote_addr", which is always available in CLF format. Where the
+	// value contains a list of addresses (e.g. $http_x_forwarded_for), the
+	// first is used.
+	Field string
+	// Window is the period over which requests are counted. Defaults to one
+	// minute. Note that windows are only closed on polling, and thus may be
+	// extended by up to one polling period.
+	Window time.Duration
+	// IPv4PrefixLen, if non-zero, is the prefix length to which IPv4
+	// client addresses are truncated (e.g. 24).
+	IPv4PrefixLen int
+	// IPv6PrefixLen, if non-zero, is the prefix length to which IPv6
+	// client addresses are truncated (e.g. 64).
+	IPv6PrefixLen int
+}
+
+func (o *TopClientsOptions) setDefaults() {
+	if o.Capacity == 0 {
+		o.Capacity = defaultTopClientsCapacityFactor * o.N
+	}
+	if o.Field == "" {
+		o.Field = defaultTopClientsField
+	}
+	if o.Window == 0 {
+		o.Window = defaultTopClientsWindow
+	}
+}
+
+func (o *TopClientsOptions) validate() error {
+	if o.N <= 0 {
+		return fmt.Errorf("number of top clients must be positive, got %d", o.N)
+	}
+	if o.Capacity < o.N {
+		return fmt.Errorf("top clients capacity (%d) must be at least the number exported (%d)", o.Capacity, o.N)
+	}
+	if o.Window < 0 {
+		return fmt.Errorf("top clients window must be positive, got %v", o.Window)
+	}
+	if o.IPv4PrefixLen < 0 || o.IPv4PrefixLen > 32 {
+		return fmt.Errorf("IPv4 prefix length must be in [0, 32], got %d", o.IPv4PrefixLen)
+	}
+	if o.IPv6PrefixLen < 0 || o.IPv6PrefixLen > 128 {
+		return fmt.Errorf("IPv6 prefix length must be in [0, 128], got %d", o.IPv6PrefixLen)
+	}
+	return nil
+}
+
+// topClients tracks the clients issuing the most requests in the current
+// window.
+type topClients struct {
+	opts        TopClientsOptions
+	sketch      *sketch.SpaceSaving
+	windowStart time.Time
+	exported    map[string]bool
+	gauge       metrics.GaugeT
+}
+
+func (c *Consumer) addTopClients(opts TopClientsOptions, now time.Time) (*topClients, error) {
+	if err := c.manager.AddGauge(TopClientRequestsMetricName, "Approximate number of requests issued by each of the top clients during the last complete window", []string{
+		"client",
+	}); err != nil {
+		return nil, err
+	}
+	gauge, err := c.manager.GetGauge(TopClientRequestsMetricName)
+	if err != nil {
+		return nil, err
+	}
+	return &topClients{
+		opts:        opts,
+		sketch:      sketch.NewSpaceSaving(opts.Capacity),
+		windowStart: now,
+		exported:    make(map[string]bool),
+		gauge:       gauge,
+	}, nil
+}
+
+// client returns the client identified by the supplied field value,
+// truncating IP addresses if so configured.
+func (t *topClients) client(value string) string {
+	if i := strings.IndexByte(value, ','); i >= 0 {
+		value = value[:i]
+	}
+	value = strings.TrimSpace(value)
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return value
+	}
+	if v4 := ip.To4(); v4 != nil {
+		if t.opts.IPv4PrefixLen > 0 {
+			return fmt.Sprintf("%s/%d", v4.Mask(net.CIDRMask(t.opts.IPv4PrefixLen, 32)), t.opts.IPv4PrefixLen)
+		}
+		return v4.String()
+	}
+	if t.opts.IPv6PrefixLen > 0 {
+		return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(t.opts.IPv6PrefixLen, 128)), t.opts.IPv6PrefixLen)
+	}
+	return ip.String()
+}
+
+// consume records a request from the client identified in the supplied line
+// (if any).
+func (t *topClients) consume(line *parsedLogLine) {
+	value, ok := line.Fields[t.opts.Field]
+	if !ok || value == "" || value == "-" {
+		return
+	}
+	t.sketch.Add(t.client(value))
+}
+
+// export exports the top clients and starts a new window if the current one
+// has elapsed as of now. Clients no longer among the top are deleted.
+func (t *topClients) export(now time.Time) error {
+	if now.Sub(t.windowStart) < t.opts.Window {
+		return nil
+	}
+	current := make(map[string]bool)
+	for _, counter := range t.sketch.Top(t.opts.N) {
+		if err := t.gauge.Set(map[string]string{
+			"client": counter.Key,
+		}, float64(counter.Count)); err != nil {
+			return err
+		}
+		current[counter.Key] = true
+	}
+	for client := range t.exported {
+		if !current[client] {
+			t.gauge.Delete(map[string]string{
+				"client": client,
+			})
+		}
+	}
+	t.exported = current
+	t.sketch.Reset()
+	t.windowStart = now
+	return nil
+}
@@ -0,0 +1,182 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/swfrench/nginx-log-exporter/internal/sketch"
+)
+
+const (
+	// Placeholders substituted for variable path segments by normalizePath.
+	pathPlaceholderID   = "{id}"
+	pathPlaceholderUUID = "{uuid}"
+	pathPlaceholderHex  = "{hex}"
+)
+
+var (
+	// Matches path segments consisting solely of digits.
+	numericSegmentRE = regexp.MustCompile(`^[0-9]+$`)
+
+	// Matches path segments consisting of a UUID.
+	uuidSegmentRE = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+	// Matches path segments consisting of a long hex string (e.g. a hash or
+	// object ID).
+	hexSegmentRE = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// normalizePath replaces variable segments of the supplied path (numeric IDs,
+// UUIDs, and long hex strings) with placeholders, such that requests for the
+// same route are aggregated.
+func normalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case numericSegmentRE.MatchString(segment):
+			segments[i] = pathPlaceholderID
+		case uuidSegmentRE.MatchString(segment):
+			segments[i] = pathPlaceholderUUID
+		case hexSegmentRE.MatchString(segment):
+			segments[i] = pathPlaceholderHex
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// TopPathsOptions configures tracking of the most frequently requested
+// (normalized) paths, served via Consumer.TopPathsHandler.
+type TopPathsOptions struct {
+	// Capacity is the number of distinct paths tracked, and thus the maximum
+	// number reported.
+	Capacity int
+}
+
+// PathStats reports approximate request statistics for a single normalized
+// path.
+type PathStats struct {
+	Path string `json:"path"`
+	// Count is an upper bound on the number of requests for the path.
+	Count uint64 `json:"count"`
+	// CountError is the maximum amount by which Count overestimates the
+	// true number of requests.
+	CountError uint64 `json:"count_error"`
+	// The following are computed over the requests observed since the path
+	// was last (re)admitted to the set of tracked paths.
+	ErrorRate          float64 `json:"error_rate"`
+	MeanLatencySeconds float64 `json:"mean_latency_seconds,omitempty"`
+	MaxLatencySeconds  float64 `json:"max_latency_seconds,omitempty"`
+}
+
+// TopPaths is the JSON document served by Consumer.TopPathsHandler.
+type TopPaths struct {
+	// Requests is the total number of requests consumed.
+	Requests uint64      `json:"requests"`
+	Paths    []PathStats `json:"paths"`
+}
+
+// pathData holds statistics associated with a tracked path.
+type pathData struct {
+	requests     uint64
+	errors       uint64
+	latencyCount uint64
+	latencySum   float64
+	latencyMax   float64
+}
+
+// topPaths tracks the most frequently requested paths. Unlike other state
+// updated by the Consumer, this is also read by HTTP handlers, and so is
+// guarded by mu.
+type topPaths struct {
+	mu       sync.Mutex
+	sketch   *sketch.SpaceSaving
+	requests uint64
+}
+
+func newTopPaths(opts TopPathsOptions) (*topPaths, error) {
+	if opts.Capacity <= 0 {
+		return nil, fmt.Errorf("top paths capacity must be positive, got %d", opts.Capacity)
+	}
+	return &topPaths{
+		sketch: sketch.NewSpaceSaving(opts.Capacity),
+	}, nil
+}
+
+// consume records a request for the supplied path.
+func (t *topPaths) consume(line *parsedLogLine, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	counter := t.sketch.Add(normalizePath(path))
+	data, ok := counter.Data.(*pathData)
+	if !ok {
+		data = &pathData{}
+		counter.Data = data
+	}
+	data.requests++
+	if strings.HasPrefix(line.Status, "5") {
+		data.errors++
+	}
+	if line.RequestTime >= 0 {
+		data.latencyCount++
+		data.latencySum += line.RequestTime
+		if line.RequestTime > data.latencyMax {
+			data.latencyMax = line.RequestTime
+		}
+	}
+}
+
+// top returns statistics for the n most frequently requested paths, or all
+// tracked paths if n is negative.
+func (t *topPaths) top(n int) *TopPaths {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n < 0 {
+		n = t.sketch.Len()
+	}
+	result := &TopPaths{
+		Requests: t.requests,
+		Paths:    []PathStats{},
+	}
+	for _, counter := range t.sketch.Top(n) {
+		stats := PathStats{
+			Path:       counter.Key,
+			Count:      counter.Count,
+			CountError: counter.Error,
+		}
+		if data, ok := counter.Data.(*pathData); ok {
+			stats.ErrorRate = float64(data.errors) / float64(data.requests)
+			if data.latencyCount > 0 {
+				stats.MeanLatencySeconds = data.latencySum / float64(data.latencyCount)
+				stats.MaxLatencySeconds = data.latencyMax
+			}
+		}
+		result.Paths = append(result.Paths, stats)
+	}
+	return result
+}
+
+// ServeHTTP serves the top paths as JSON. The number of paths reported may be
+// limited via the "n" query parameter.
+func (t *topPaths) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := -1
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid number of paths: \"%s\"", s), http.StatusBadRequest)
+			return
+		}
+	}
+	b, err := json.Marshal(t.top(n))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
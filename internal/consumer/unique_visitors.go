@@ -0,0 +1,328 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+	"github.com/swfrench/nginx-log-exporter/internal/sketch"
+)
+
+const (
+	// UniqueVisitorsMetricName is the name of the metric reporting the
+	// estimated number of distinct visitors within each rolling window, by
+	// configured dimensions.
+	UniqueVisitorsMetricName = "nginx_http_unique_visitors"
+)
+
+const (
+	// Dimension name denoting the normalized request path (see
+	// normalizePath), rather than a log field.
+	pathDimension = "path"
+
+	// Number of slots into which each rolling window is divided, and thus
+	// the granularity with which visitors expire from the window.
+	uniqueVisitorsSlotsPerWindow = 12
+
+	// Defaults for UniqueVisitorsOptions.
+	defaultUniqueVisitorsField         = "remote_addr"
+	defaultUniqueVisitorsPrecision     = 12
+	defaultUniqueVisitorsMaxKeys       = 100
+	defaultUniqueVisitorsPersistPeriod = time.Minute
+)
+
+var (
+	// Default rolling windows over which visitors are counted.
+	defaultUniqueVisitorsWindows = []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+)
+
+// UniqueVisitorsOptions configures estimation of the number of distinct
+// visitors using HyperLogLog sketches, such that visitor identifiers (e.g. IP
+// addresses) are never retained.
+type UniqueVisitorsOptions struct {
+	// Field names the log field identifying visitors, e.g. a client address
+	// or (hashed) user ID. Defaults to "remote_addr", which is always
+	// available in CLF format.
+	Field string
+	// Dimensions name the log fields by which visitors are counted
+	// separately (e.g. "host"), each exported as a label of the same name.
+	// The special dimension "path" denotes the normalized request path.
+	Dimensions []string
+	// Windows are the rolling windows over which visitors are counted.
+	// Defaults to one minute, one hour, and one day.
+	Windows []time.Duration
+	// Precision is the precision of each HyperLogLog sketch (see
+	// sketch.NewHyperLogLog). Defaults to 12 (approx. 1.6% error, using 4KiB
+	// per sketch).
+	Precision uint8
+	// MaxKeys is the maximum number of distinct combinations of dimension
+	// values tracked, beyond which lines with new combinations are ignored.
+	// Defaults to 100.
+	MaxKeys int
+	// StatePath, if non-empty, is a file to which sketches are persisted, so
+	// that estimates survive restarts. Sketches are loaded from the file (if
+	// present) on startup.
+	StatePath string
+	// PersistPeriod is the minimum period between writes to StatePath.
+	// Defaults to one minute.
+	PersistPeriod time.Duration
+}
+
+func (o *UniqueVisitorsOptions) setDefaults() {
+	if o.Field == "" {
+		o.Field = defaultUniqueVisitorsField
+	}
+	if len(o.Windows) == 0 {
+		o.Windows = defaultUniqueVisitorsWindows
+	}
+	if o.Precision == 0 {
+		o.Precision = defaultUniqueVisitorsPrecision
+	}
+	if o.MaxKeys == 0 {
+		o.MaxKeys = defaultUniqueVisitorsMaxKeys
+	}
+	if o.PersistPeriod == 0 {
+		o.PersistPeriod = defaultUniqueVisitorsPersistPeriod
+	}
+}
+
+func (o *UniqueVisitorsOptions) validate() error {
+	seen := make(map[string]bool)
+	for _, dimension := range o.Dimensions {
+		if !labelNameRE.MatchString(dimension) || dimension == "window" {
+			return fmt.Errorf("unique visitor dimension must be a valid label name other than \"window\": \"%s\"", dimension)
+		} else if seen[dimension] {
+			return fmt.Errorf("duplicate unique visitor dimension: %s", dimension)
+		}
+		seen[dimension] = true
+	}
+	windows := make(map[string]bool)
+	for _, window := range o.Windows {
+		if window < time.Duration(uniqueVisitorsSlotsPerWindow)*time.Second {
+			return fmt.Errorf("unique visitor window must be at least %ds, got %v", uniqueVisitorsSlotsPerWindow, window)
+		} else if windows[formatWindow(window)] {
+			return fmt.Errorf("duplicate unique visitor window: %v", window)
+		}
+		windows[formatWindow(window)] = true
+	}
+	if o.Precision < sketch.MinPrecision || o.Precision > sketch.MaxPrecision {
+		return fmt.Errorf("unique visitor precision must be in [%d, %d], got %d", sketch.MinPrecision, sketch.MaxPrecision, o.Precision)
+	}
+	if o.MaxKeys < 0 {
+		return fmt.Errorf("maximum number of unique visitor keys must be positive, got %d", o.MaxKeys)
+	}
+	return nil
+}
+
+// formatWindow returns a compact representation of the supplied window
+// duration, e.g. "1h" rather than "1h0m0s".
+func formatWindow(window time.Duration) string {
+	s := window.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// visitorKey holds the sketches for a single combination of dimension values.
+type visitorKey struct {
+	Labels map[string]string
+	// Sketches maps each window to the corresponding sketch.
+	Sketches map[time.Duration]*sketch.WindowedHyperLogLog
+}
+
+// uniqueVisitors tracks the estimated number of distinct visitors by
+// dimension.
+type uniqueVisitors struct {
+	opts        UniqueVisitorsOptions
+	keys        map[string]*visitorKey
+	gauge       metrics.GaugeT
+	lastPersist time.Time
+}
+
+func (c *Consumer) addUniqueVisitors(opts UniqueVisitorsOptions, now time.Time) (*uniqueVisitors, error) {
+	if err := c.manager.AddGauge(UniqueVisitorsMetricName, "Estimated number of distinct visitors within each rolling window", append([]string{
+		"window",
+	}, opts.Dimensions...)); err != nil {
+		return nil, err
+	}
+	gauge, err := c.manager.GetGauge(UniqueVisitorsMetricName)
+	if err != nil {
+		return nil, err
+	}
+	u := &uniqueVisitors{
+		opts:        opts,
+		keys:        make(map[string]*visitorKey),
+		gauge:       gauge,
+		lastPersist: now,
+	}
+	if opts.StatePath != "" {
+		if err := u.load(); err != nil {
+			// Note: Losing visitor state is not worth failing to start.
+			log.Printf("Could not load unique visitor state from %s: %v", opts.StatePath, err)
+		}
+	}
+	return u, nil
+}
+
+// fields returns the log fields required by the configured options.
+func (o *UniqueVisitorsOptions) fields() []string {
+	fields := []string{o.Field}
+	for _, dimension := range o.Dimensions {
+		if dimension != pathDimension {
+			fields = append(fields, dimension)
+		}
+	}
+	return fields
+}
+
+func (u *uniqueVisitors) newKey(labels map[string]string) (*visitorKey, error) {
+	k := &visitorKey{
+		Labels:   labels,
+		Sketches: make(map[time.Duration]*sketch.WindowedHyperLogLog),
+	}
+	for _, window := range u.opts.Windows {
+		s, err := sketch.NewWindowedHyperLogLog(window, uniqueVisitorsSlotsPerWindow, u.opts.Precision)
+		if err != nil {
+			return nil, err
+		}
+		k.Sketches[window] = s
+	}
+	return k, nil
+}
+
+// consume records a visit by the visitor identified in the supplied line (if
+// any), for a request with the supplied path.
+func (u *uniqueVisitors) consume(line *parsedLogLine, path string) {
+	visitor, ok := line.Fields[u.opts.Field]
+	if !ok || visitor == "" || visitor == "-" {
+		return
+	}
+
+	labels := make(map[string]string)
+	var values []string
+	for _, dimension := range u.opts.Dimensions {
+		var value string
+		if dimension == pathDimension {
+			value = normalizePath(path)
+		} else {
+			value = line.Fields[dimension]
+		}
+		labels[dimension] = value
+		values = append(values, value)
+	}
+	key := strings.Join(values, "\xff")
+
+	k, ok := u.keys[key]
+	if !ok {
+		if len(u.keys) >= u.opts.MaxKeys {
+			return
+		}
+		var err error
+		if k, err = u.newKey(labels); err != nil {
+			// Note: Options have already been validated.
+			log.Printf("Could not create unique visitor sketches: %v", err)
+			return
+		}
+		u.keys[key] = k
+	}
+	for _, s := range k.Sketches {
+		s.Add(visitor, line.Time)
+	}
+}
+
+// export exports estimates as of now, persisting state if due.
+func (u *uniqueVisitors) export(now time.Time) error {
+	for _, k := range u.keys {
+		for window, s := range k.Sketches {
+			labels := map[string]string{
+				"window": formatWindow(window),
+			}
+			for name, value := range k.Labels {
+				labels[name] = value
+			}
+			if err := u.gauge.Set(labels, float64(s.Estimate(now))); err != nil {
+				return err
+			}
+		}
+	}
+	if u.opts.StatePath != "" && now.Sub(u.lastPersist) >= u.opts.PersistPeriod {
+		if err := u.persist(); err != nil {
+			log.Printf("Could not persist unique visitor state to %s: %v", u.opts.StatePath, err)
+		}
+		u.lastPersist = now
+	}
+	return nil
+}
+
+// persist writes all sketches to the configured state file, replacing it
+// atomically.
+func (u *uniqueVisitors) persist() error {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(u.keys); err != nil {
+		return err
+	}
+	tmp := u.opts.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.opts.StatePath)
+}
+
+// load restores sketches from the configured state file, if present. Sketches
+// for keys with differing dimensions, for windows no longer configured, or of
+// a differing precision are discarded.
+func (u *uniqueVisitors) load() error {
+	b, err := ioutil.ReadFile(u.opts.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var keys map[string]*visitorKey
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&keys); err != nil {
+		return err
+	}
+	for key, loaded := range keys {
+		if len(u.keys) >= u.opts.MaxKeys {
+			break
+		}
+		if !u.hasDimensions(loaded.Labels) {
+			continue
+		}
+		k, err := u.newKey(loaded.Labels)
+		if err != nil {
+			return err
+		}
+		for window := range k.Sketches {
+			if s, ok := loaded.Sketches[window]; ok && s.Window() == window && s.Precision() == u.opts.Precision {
+				k.Sketches[window] = s
+			}
+		}
+		u.keys[key] = k
+	}
+	return nil
+}
+
+// hasDimensions returns true if the supplied labels correspond exactly to the
+// configured dimensions.
+func (u *uniqueVisitors) hasDimensions(labels map[string]string) bool {
+	if len(labels) != len(u.opts.Dimensions) {
+		return false
+	}
+	for _, dimension := range u.opts.Dimensions {
+		if _, ok := labels[dimension]; !ok {
+			return false
+		}
+	}
+	return true
+}
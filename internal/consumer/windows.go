@@ -0,0 +1,429 @@
+package consumer
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+	"github.com/swfrench/nginx-log-exporter/internal/openmetrics"
+)
+
+const (
+	// WindowDroppedLinesMetricName is the name of the metric reporting the
+	// total number of log lines dropped from windowed aggregation, by reason
+	// ("late" if arriving after their window was closed, or "future" if
+	// logged beyond the current time by more than the window width and
+	// allowed lateness).
+	WindowDroppedLinesMetricName = "nginx_log_exporter_window_dropped_lines_total"
+)
+
+const (
+	// Reasons for which lines are dropped from windowed aggregation.
+	reasonWindowLate   = "late"
+	reasonWindowFuture = "future"
+)
+
+const (
+	// Default window width for WindowOptions.
+	defaultWindowWidth = time.Minute
+)
+
+// WindowSink receives the samples of each closed window (see WindowOptions).
+// Implementations might e.g. write OpenMetrics files (see
+// openmetrics.DirSink) or push samples to remote storage.
+type WindowSink interface {
+	// WriteWindow is called with the cumulative samples as of the end of
+	// each closed window, in order, each timestamped with end. Only series
+	// updated within the window are included, and windows in which no series
+	// were updated are not written (i.e. consumers should treat series as
+	// unchanged until their next sample). Sample label maps are shared across
+	// windows and must not be modified.
+	WriteWindow(end time.Time, families []openmetrics.Family) error
+}
+
+// WindowOptions configures aggregation of the HTTP response metrics into
+// fixed windows by logged timestamp (rather than by the time at which lines
+// are consumed), with timestamped samples of each window written to a sink.
+// This is in addition to the usual export to the metrics manager.
+type WindowOptions struct {
+	// Width is the width of each window. Defaults to one minute.
+	Width time.Duration
+	// AllowedLateness is the period following the end of a window during
+	// which lines logged within the window are still accepted. A window is
+	// closed once the newest logged timestamp (or the current time, if later)
+	// exceeds its end by AllowedLateness, after which lines within it are
+	// dropped. Lines logged more than Width plus AllowedLateness beyond the
+	// current time are also dropped, so that they do not close later windows
+	// prematurely.
+	AllowedLateness time.Duration
+	// Sink receives the samples of each closed window.
+	Sink WindowSink
+	// Labels, if non-empty, are added to every series (e.g. custom labels
+	// when backfilling), unless already present.
+	Labels map[string]string
+}
+
+func (o *WindowOptions) setDefaults() {
+	if o.Width == 0 {
+		o.Width = defaultWindowWidth
+	}
+}
+
+func (o *WindowOptions) validate() error {
+	if o.Width < 0 {
+		return fmt.Errorf("window width must be positive, got %v", o.Width)
+	}
+	if o.AllowedLateness < 0 {
+		return fmt.Errorf("allowed lateness must be non-negative, got %v", o.AllowedLateness)
+	}
+	if o.Sink == nil {
+		return fmt.Errorf("a window sink must be specified")
+	}
+	for name := range o.Labels {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("window label name must be a valid label name: \"%s\"", name)
+		}
+	}
+	return nil
+}
+
+// windowFamily describes a metric family aggregated into windows.
+type windowFamily struct {
+	name string
+	help string
+	// buckets is nil for counters.
+	buckets []float64
+}
+
+// windowSeries holds the cumulative state of a single series.
+type windowSeries struct {
+	family string
+	labels map[string]string
+	// total is the counter value, or the number of histogram observations.
+	total float64
+	// Histograms only: the sum of observations, and non-cumulative counts for
+	// each bucket (excluding +Inf).
+	sum          float64
+	bucketCounts []float64
+	// updated is true if the series has been updated since the last closed
+	// window.
+	updated bool
+	// bucketLabels holds the labels of each bucket (including +Inf), i.e.
+	// labels with "le" added.
+	bucketLabels []map[string]string
+}
+
+// windowDelta holds the increments to each series within an open window.
+type windowDelta struct {
+	counts       map[string]float64
+	observations map[string][]float64
+	// labels holds the family and labels of each series key.
+	labels map[string]*windowSeries
+}
+
+// windows aggregates response metrics into fixed windows by logged timestamp.
+type windows struct {
+	opts     WindowOptions
+	source   string
+	families []windowFamily
+	byName   map[string]*windowFamily
+	series   map[string]*windowSeries
+	pending  map[int64]*windowDelta
+	// closedUntil is the end of the last closed window, or zero if no window
+	// has been closed.
+	closedUntil time.Time
+	newest      time.Time
+	// horizon is the latest logged timestamp accepted, as of the current
+	// poll.
+	horizon time.Time
+	// logTimeOnly, if true, causes windows to be closed by logged timestamp
+	// alone (see Options.Backfill).
+	logTimeOnly  bool
+	dropped      metrics.CounterT
+	droppedCount map[string]float64
+}
+
+func (c *Consumer) addWindows(opts WindowOptions) (*windows, error) {
+	w := &windows{
+		opts:         opts,
+		source:       c.source,
+		logTimeOnly:  c.opts.Backfill,
+		byName:       make(map[string]*windowFamily),
+		series:       make(map[string]*windowSeries),
+		pending:      make(map[int64]*windowDelta),
+		droppedCount: make(map[string]float64),
+	}
+
+	w.families = []windowFamily{
+		{ResponseCountMetricName, responseCountHelp, nil},
+		{ResponseCountDetailedMetricName, responseCountDetailedHelp, nil},
+		{ResponseDurationMetricName, responseDurationHelp, c.histogramBuckets(ResponseDurationMetricName)},
+		{ResponseSizeMetricName, responseSizeHelp, c.histogramBuckets(ResponseSizeMetricName)},
+	}
+	for i := range w.families {
+		w.byName[w.families[i].name] = &w.families[i]
+	}
+
+	if err := c.manager.AddCounter(WindowDroppedLinesMetricName, "Total number of log lines dropped from windowed aggregation, by reason", []string{"source", "reason"}); err != nil {
+		return nil, err
+	}
+	var err error
+	if w.dropped, err = c.manager.GetCounter(WindowDroppedLinesMetricName); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// histogramBuckets returns the bucket layout of the named histogram, as
+// registered via addHistogram.
+func (c *Consumer) histogramBuckets(name string) []float64 {
+	if buckets := c.histograms[name]; buckets != nil {
+		return buckets
+	}
+	return prometheus.DefBuckets
+}
+
+// begin sets the horizon beyond which lines are dropped for a poll at now.
+func (w *windows) begin(now time.Time) {
+	w.horizon = now.Add(w.opts.Width + w.opts.AllowedLateness)
+}
+
+// accept returns whether lines logged at t are aggregated, i.e. whether t is
+// within the horizon and the window containing t remains open, counting those
+// which are not as dropped.
+func (w *windows) accept(t time.Time) bool {
+	if t.After(w.horizon) {
+		w.droppedCount[reasonWindowFuture]++
+		return false
+	}
+	if t.After(w.newest) {
+		w.newest = t
+	}
+	if !w.closedUntil.IsZero() && t.Before(w.closedUntil) {
+		w.droppedCount[reasonWindowLate]++
+		return false
+	}
+	return true
+}
+
+// delta returns the increments of the (open) window containing t.
+func (w *windows) delta(t time.Time) *windowDelta {
+	start := t.Truncate(w.opts.Width)
+	d, ok := w.pending[start.UnixNano()]
+	if !ok {
+		d = &windowDelta{
+			counts:       make(map[string]float64),
+			observations: make(map[string][]float64),
+			labels:       make(map[string]*windowSeries),
+		}
+		w.pending[start.UnixNano()] = d
+	}
+	return d
+}
+
+// windowKey returns the series key for the supplied family and label key (as
+// returned by withLabels).
+func windowKey(family, key string) string {
+	return family + "\xff" + key
+}
+
+// count records a counter increment for the series of the supplied family
+// with the supplied key and labels, within the window containing t, which
+// must have been accepted.
+func (w *windows) count(t time.Time, family, key string, labels map[string]string) {
+	d := w.delta(t)
+	k := windowKey(family, key)
+	d.counts[k]++
+	if _, ok := d.labels[k]; !ok {
+		d.labels[k] = &windowSeries{family: family, labels: labels}
+	}
+}
+
+// observe records a histogram observation as in count.
+func (w *windows) observe(t time.Time, family, key string, value float64, labels map[string]string) {
+	d := w.delta(t)
+	k := windowKey(family, key)
+	d.observations[k] = append(d.observations[k], value)
+	if _, ok := d.labels[k]; !ok {
+		d.labels[k] = &windowSeries{family: family, labels: labels}
+	}
+}
+
+// get returns the cumulative state of the series with the supplied key,
+// creating it from the supplied template if necessary.
+func (w *windows) get(key string, template *windowSeries) *windowSeries {
+	s, ok := w.series[key]
+	if !ok {
+		s = &windowSeries{
+			family: template.family,
+			labels: template.labels,
+		}
+		if len(w.opts.Labels) > 0 {
+			s.labels = make(map[string]string)
+			for k, v := range w.opts.Labels {
+				s.labels[k] = v
+			}
+			for k, v := range template.labels {
+				s.labels[k] = v
+			}
+		}
+		if buckets := w.byName[template.family].buckets; buckets != nil {
+			s.bucketCounts = make([]float64, len(buckets))
+			for _, bound := range buckets {
+				s.bucketLabels = append(s.bucketLabels, withLe(s.labels, openmetrics.FormatFloat(bound)))
+			}
+			s.bucketLabels = append(s.bucketLabels, withLe(s.labels, "+Inf"))
+		}
+		w.series[key] = s
+	}
+	return s
+}
+
+// apply applies the supplied window increments to the cumulative state.
+func (w *windows) apply(d *windowDelta) {
+	for key, n := range d.counts {
+		s := w.get(key, d.labels[key])
+		s.total += n
+		s.updated = true
+	}
+	for key, values := range d.observations {
+		s := w.get(key, d.labels[key])
+		s.updated = true
+		buckets := w.byName[s.family].buckets
+		for _, v := range values {
+			s.total++
+			s.sum += v
+			i := sort.SearchFloat64s(buckets, v)
+			if i < len(buckets) {
+				s.bucketCounts[i]++
+			}
+		}
+	}
+}
+
+// samples returns the cumulative samples of all series updated since the last
+// closed window, timestamped t.
+func (w *windows) samples(t time.Time) []openmetrics.Family {
+	var keys []string
+	for key := range w.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var families []openmetrics.Family
+	for _, family := range w.families {
+		f := openmetrics.Family{
+			Name: family.name,
+			Type: "histogram",
+			Help: family.help,
+		}
+		if family.buckets == nil {
+			f.Name = strings.TrimSuffix(family.name, "_total")
+			f.Type = "counter"
+		}
+		for _, key := range keys {
+			s := w.series[key]
+			if s.family != family.name || !s.updated {
+				continue
+			}
+			s.updated = false
+			if family.buckets == nil {
+				f.Samples = append(f.Samples, openmetrics.Sample{Name: family.name, Labels: s.labels, Value: s.total, Time: t})
+				continue
+			}
+			cumulative := 0.0
+			for i := range family.buckets {
+				cumulative += s.bucketCounts[i]
+				f.Samples = append(f.Samples, openmetrics.Sample{Name: family.name + "_bucket", Labels: s.bucketLabels[i], Value: cumulative, Time: t})
+			}
+			f.Samples = append(f.Samples,
+				openmetrics.Sample{Name: family.name + "_bucket", Labels: s.bucketLabels[len(family.buckets)], Value: s.total, Time: t},
+				openmetrics.Sample{Name: family.name + "_count", Labels: s.labels, Value: s.total, Time: t},
+				openmetrics.Sample{Name: family.name + "_sum", Labels: s.labels, Value: s.sum, Time: t})
+		}
+		if len(f.Samples) > 0 {
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// withLe returns a copy of the supplied labels with the "le" label added.
+func withLe(labels map[string]string, le string) map[string]string {
+	l := map[string]string{
+		"le": le,
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return l
+}
+
+// closeUntil closes all windows ending at or before t, writing the samples of
+// each (if any) to the sink.
+func (w *windows) closeUntil(t time.Time) error {
+	next := w.closedUntil
+	if next.IsZero() {
+		for start := range w.pending {
+			if s := time.Unix(0, start); next.IsZero() || s.Before(next) {
+				next = s
+			}
+		}
+		if next.IsZero() {
+			return nil
+		}
+	}
+	for end := next.Add(w.opts.Width); !end.After(t); end = end.Add(w.opts.Width) {
+		if d, ok := w.pending[next.UnixNano()]; ok {
+			w.apply(d)
+			delete(w.pending, next.UnixNano())
+		}
+		if samples := w.samples(end); len(samples) > 0 {
+			if err := w.opts.Sink.WriteWindow(end, samples); err != nil {
+				return fmt.Errorf("could not write window ending %v: %v", end, err)
+			}
+		}
+		next = end
+		w.closedUntil = end
+	}
+	return nil
+}
+
+// export closes all windows ending at least AllowedLateness before now (or the
+// newest logged timestamp, if later or if logTimeOnly), and exports the number
+// of dropped lines.
+func (w *windows) export(now time.Time) error {
+	if w.logTimeOnly || w.newest.After(now) {
+		now = w.newest
+	}
+	if err := w.closeUntil(now.Add(-w.opts.AllowedLateness)); err != nil {
+		return err
+	}
+	return w.exportDropped()
+}
+
+// flush closes all windows, regardless of lateness, and exports the number of
+// dropped lines.
+func (w *windows) flush() error {
+	if err := w.closeUntil(w.newest.Truncate(w.opts.Width).Add(w.opts.Width)); err != nil {
+		return err
+	}
+	return w.exportDropped()
+}
+
+// exportDropped exports the number of dropped lines.
+func (w *windows) exportDropped() error {
+	for reason, count := range w.droppedCount {
+		log.Printf("Dropped %v lines from windowed aggregation (%s)", count, reason)
+		if err := w.dropped.Add(map[string]string{"source": w.source, "reason": reason}, count); err != nil {
+			return err
+		}
+		delete(w.droppedCount, reason)
+	}
+	return nil
+}
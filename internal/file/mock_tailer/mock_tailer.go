@@ -6,6 +6,7 @@ package mock_tailer
 
 import (
 	gomock "github.com/golang/mock/gomock"
+	file "github.com/swfrench/nginx-log-exporter/internal/file"
 	reflect "reflect"
 )
 
@@ -46,3 +47,17 @@ func (mr *MockTailerTMockRecorder) Next() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockTailerT)(nil).Next))
 }
+
+// Stats mocks base method
+func (m *MockTailerT) Stats() file.Stats {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats")
+	ret0, _ := ret[0].(file.Stats)
+	return ret0
+}
+
+// Stats indicates an expected call of Stats
+func (mr *MockTailerTMockRecorder) Stats() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockTailerT)(nil).Stats))
+}
@@ -1,14 +1,26 @@
 package file
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"time"
 )
 
+// Stats holds cumulative counts of events observed by a Tailer.
+type Stats struct {
+	// Rotations is the number of times the file was found to have been
+	// replaced (e.g. renamed and recreated by logrotate).
+	Rotations uint64
+	// Truncations is the number of times the file was found to have been
+	// truncated in place (e.g. by logrotate's copytruncate).
+	Truncations uint64
+}
+
 // TailerT is an interface representing a Tailer (useful for mocks).
 type TailerT interface {
 	Next() ([]byte, error)
+	Stats() Stats
 }
 
 // Tailer is an abstraction for reading newly appended content from a file,
@@ -21,6 +33,10 @@ type Tailer struct {
 	fileInfo     os.FileInfo
 	lastContent  time.Time
 	idleDuration time.Duration
+	stats        Stats
+	// truncated is true if the file was last found to be truncated to less
+	// than the read offset, such that each truncation is counted once.
+	truncated bool
 }
 
 // NewTailer creates a new Tailer object configured to read data from the file
@@ -60,14 +76,51 @@ func (t *Tailer) openOrRotate() error {
 		t.file.Close()
 		t.file = file
 		t.fileInfo = info
+		t.truncated = false
+		t.stats.Rotations++
+	}
+	return nil
+}
+
+// checkTruncation counts a truncation if the file has been truncated to less
+// than the current read offset. Note that reading is otherwise unaffected,
+// i.e. resumes from the current offset once the file regrows past it.
+func (t *Tailer) checkTruncation() error {
+	offset, err := t.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() < offset {
+		if !t.truncated {
+			t.stats.Truncations++
+		}
+		t.truncated = true
+	} else {
+		t.truncated = false
 	}
 	return nil
 }
 
+// Stats returns cumulative counts of rotation and truncation events observed
+// by the Tailer.
+func (t *Tailer) Stats() Stats {
+	return t.stats
+}
+
 // Next will return content newly read from the log file. If no new content is
 // available, and this condition has persisted for at least the idleDuration, a
 // rotation check will be performed.
 func (t *Tailer) Next() ([]byte, error) {
+	if err := t.checkTruncation(); err != nil {
+		return nil, err
+	}
+
 	bytes, err := ioutil.ReadAll(t.file)
 	if err != nil {
 		return nil, err
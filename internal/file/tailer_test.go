@@ -173,6 +173,10 @@ func TestReadRotate(t *testing.T) {
 		t.Fatalf("Expected zero-length content, got: %v", b)
 	}
 
+	if want, got := (file.Stats{Rotations: uint64(len(testContent))}), tail.Stats(); want != got {
+		t.Fatalf("Expected stats %+v, got %+v", want, got)
+	}
+
 	for _, name := range rotate.AllTempFileNames() {
 		err := os.Remove(name)
 		if err != nil {
@@ -180,3 +184,52 @@ func TestReadRotate(t *testing.T) {
 		}
 	}
 }
+
+func TestReadTruncate(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "test_log_file")
+	if err != nil {
+		t.Fatalf("Could not open test log file: %v", logFile)
+	}
+	defer os.Remove(logFile.Name())
+
+	tail, err := file.NewTailer(logFile.Name(), time.Second)
+	if err != nil {
+		t.Fatalf("Could not create tailer: %v", err)
+	}
+
+	if err := syncWrite(logFile, []byte("foobar")); err != nil {
+		t.Fatalf("Could not durably write to log file: %v", err)
+	}
+	if _, err := tail.Next(); err != nil {
+		t.Fatalf("Error fetching next byte slice: %v", err)
+	}
+
+	if err := logFile.Truncate(0); err != nil {
+		t.Fatalf("Could not truncate log file: %v", err)
+	}
+	if _, err := logFile.Seek(0, 0); err != nil {
+		t.Fatalf("Could not seek in log file: %v", err)
+	}
+	if err := syncWrite(logFile, []byte("baz")); err != nil {
+		t.Fatalf("Could not durably write to log file: %v", err)
+	}
+
+	// Truncation is counted (once), while reading continues from the
+	// previous offset.
+	for i := 0; i < 2; i++ {
+		b, err := tail.Next()
+		if err != nil {
+			t.Fatalf("Error fetching next byte slice: %v", err)
+		}
+		if len(b) != 0 {
+			t.Fatalf("Expected zero-length content following truncation, got: %v", b)
+		}
+		if want, got := (file.Stats{Truncations: 1}), tail.Stats(); want != got {
+			t.Fatalf("Expected stats %+v, got %+v", want, got)
+		}
+	}
+
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Could not close log file")
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ValidateBuckets returns an error if the supplied histogram bucket upper
+// bounds are empty, non-finite, or not strictly increasing.
+func ValidateBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("at least one bucket is required")
+	}
+	for i, b := range buckets {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("bucket %d is not finite: %v", i, b)
+		}
+		if i > 0 && b <= buckets[i-1] {
+			return fmt.Errorf("buckets must be strictly increasing, but bucket %d (%v) follows %v", i, b, buckets[i-1])
+		}
+	}
+	return nil
+}
+
+func parseFloats(s string) ([]float64, error) {
+	var values []float64
+	for _, elem := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(elem), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse bucket value: %v", err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// ParseBuckets parses a histogram bucket layout from the supplied spec, which
+// is one of:
+//
+//   - An explicit, comma-separated list of upper bounds (e.g. "0.1,0.5,1").
+//   - "linear:start,width,count" for count buckets, the lowest having upper
+//     bound start, each width wide.
+//   - "exponential:start,factor,count" for count buckets, the lowest having
+//     upper bound start, each factor times larger than the last.
+//
+// The resulting layout is validated with ValidateBuckets.
+func ParseBuckets(spec string) ([]float64, error) {
+	var buckets []float64
+	if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 {
+		kind := parts[0]
+		args, err := parseFloats(parts[1])
+		if err != nil {
+			return nil, err
+		} else if len(args) != 3 {
+			return nil, fmt.Errorf("%s buckets require 3 parameters (start, width or factor, count), got %d", kind, len(args))
+		}
+		start, step, count := args[0], args[1], args[2]
+		if count < 1 || count != math.Trunc(count) {
+			return nil, fmt.Errorf("bucket count must be a positive integer, got %v", count)
+		}
+		switch kind {
+		case "linear":
+			if step <= 0 {
+				return nil, fmt.Errorf("linear bucket width must be positive, got %v", step)
+			}
+			buckets = prometheus.LinearBuckets(start, step, int(count))
+		case "exponential":
+			if start <= 0 {
+				return nil, fmt.Errorf("exponential bucket start must be positive, got %v", start)
+			} else if step <= 1 {
+				return nil, fmt.Errorf("exponential bucket factor must be greater than 1, got %v", step)
+			}
+			buckets = prometheus.ExponentialBuckets(start, step, int(count))
+		default:
+			return nil, fmt.Errorf("unknown bucket generator: \"%s\" (supported: linear, exponential)", kind)
+		}
+	} else {
+		var err error
+		if buckets, err = parseFloats(spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateBuckets(buckets); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
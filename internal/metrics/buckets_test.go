@@ -0,0 +1,68 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+func TestParseBuckets(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want []float64
+	}{
+		{
+			spec: "1",
+			want: []float64{1},
+		},
+		{
+			spec: "0.1, 0.5,1,5",
+			want: []float64{0.1, 0.5, 1, 5},
+		},
+		{
+			spec: "linear:0.5,0.5,4",
+			want: []float64{0.5, 1, 1.5, 2},
+		},
+		{
+			spec: "exponential:256,4,4",
+			want: []float64{256, 1024, 4096, 16384},
+		},
+	} {
+		got, err := metrics.ParseBuckets(tc.spec)
+		if err != nil {
+			t.Errorf("ParseBuckets(%q) returned unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("ParseBuckets(%q) = %v, want %v", tc.spec, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("ParseBuckets(%q) = %v, want %v", tc.spec, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseBucketsErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"1,2,foo",
+		"1,2,2",
+		"1,3,2",
+		"1,Inf",
+		"linear:1,1",
+		"linear:1,0,4",
+		"linear:1,1,0",
+		"linear:1,1,2.5",
+		"exponential:0,2,4",
+		"exponential:1,1,4",
+		"quadratic:1,2,3",
+	} {
+		if got, err := metrics.ParseBuckets(spec); err == nil {
+			t.Errorf("ParseBuckets(%q) = %v, expected an error", spec, got)
+		}
+	}
+}
@@ -2,22 +2,146 @@ package metrics
 
 import (
 	"fmt"
+	"net/http"
 	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// series holds bookkeeping for a single label set of a wrapped metric.
+type series struct {
+	labels     map[string]string
+	created    time.Time
+	lastUpdate time.Time
+}
+
+// seriesTracker records the creation and last update time of each label set
+// seen by a wrapped metric, so that those which have gone stale can later be
+// deleted. Since this holds a copy of every label set, label sets are only
+// tracked if expiry is enabled or if creation times are required (i.e. for
+// counters and histograms, see Manager.Handler).
+type seriesTracker struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	series map[string]*series
+	delete func(prometheus.Labels) bool
+	// trackCreation, if true, causes label sets to be tracked regardless of
+	// ttl.
+	trackCreation bool
+}
+
+func newSeriesTracker(delete func(prometheus.Labels) bool, trackCreation bool) seriesTracker {
+	return seriesTracker{
+		series:        make(map[string]*series),
+		delete:        delete,
+		trackCreation: trackCreation,
+	}
+}
+
+// LabelsKey returns a canonical string representation of the supplied labels,
+// e.g. for keying aggregations by label set.
+func LabelsKey(labels map[string]string) string {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// touch records an update to the supplied label set, which is considered
+// created if not previously seen (or since expired). Must be called with mu
+// held.
+func (s *seriesTracker) touch(labels map[string]string, now time.Time) {
+	if s.ttl <= 0 && !s.trackCreation {
+		return
+	}
+	key := LabelsKey(labels)
+	if e, ok := s.series[key]; ok {
+		e.lastUpdate = now
+		return
+	}
+	e := &series{
+		labels:     make(map[string]string),
+		created:    now,
+		lastUpdate: now,
+	}
+	for k, v := range labels {
+		e.labels[k] = v
+	}
+	s.series[key] = e
+}
+
+// SeriesCreationTime returns the creation time of the supplied label set,
+// and false if it has never been updated (or has since expired).
+func (s *seriesTracker) SeriesCreationTime(labels map[string]string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.series[LabelsKey(labels)]
+	if !ok {
+		return time.Time{}, false
+	}
+	return e.created, true
+}
+
+// remove deletes the supplied label set, returning true if it was present.
+// Must be called with mu held.
+func (s *seriesTracker) remove(labels map[string]string) bool {
+	delete(s.series, LabelsKey(labels))
+	return s.delete(labels)
+}
+
+func (s *seriesTracker) setTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+// expire deletes all label sets that have not been updated within the
+// configured ttl (if any) as of now, returning the number deleted.
+func (s *seriesTracker) expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ttl <= 0 {
+		return 0
+	}
+	expired := 0
+	for key, e := range s.series {
+		if now.Sub(e.lastUpdate) > s.ttl {
+			s.delete(e.labels)
+			delete(s.series, key)
+			expired++
+		}
+	}
+	return expired
+}
+
 // CounterT is an interface for "wrapped" (i.e. owned by the Manager) counters.
 type CounterT interface {
 	Add(labels map[string]string, value float64) error
 	Metric() *prometheus.CounterVec
 	CreationTime() time.Time
+	SeriesCreationTime(labels map[string]string) (time.Time, bool)
 }
 
 // Counter is a concrete impl of CounterT.
 type Counter struct {
+	seriesTracker
 	creationTime time.Time
 	metric       *prometheus.CounterVec
 }
@@ -35,11 +159,14 @@ func (c *Counter) CreationTime() time.Time {
 // Add adds the supplied value to the counter associated with the supplied
 // labels.
 func (c *Counter) Add(labels map[string]string, value float64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	m, err := c.metric.GetMetricWith(labels)
 	if err != nil {
 		return err
 	}
 	m.Add(value)
+	c.touch(labels, time.Now())
 	return nil
 }
 
@@ -47,12 +174,15 @@ func (c *Counter) Add(labels map[string]string, value float64) error {
 // histograms.
 type HistogramT interface {
 	Observe(labels map[string]string, values []float64) error
+	ObserveWithExemplar(labels map[string]string, value float64, exemplar map[string]string) error
 	Metric() prometheus.ObserverVec
 	CreationTime() time.Time
+	SeriesCreationTime(labels map[string]string) (time.Time, bool)
 }
 
 // Histogram is a concrete impl of HistogramT.
 type Histogram struct {
+	seriesTracker
 	creationTime time.Time
 	// Note: CurryWith returns an ObserverVec interface, rather than a
 	// pointer.
@@ -72,6 +202,8 @@ func (h *Histogram) CreationTime() time.Time {
 // Observe records the slice of float64 observations in the histogram
 // associated with the supplied labels.
 func (h *Histogram) Observe(labels map[string]string, values []float64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	m, err := h.metric.GetMetricWith(labels)
 	if err != nil {
 		return err
@@ -79,33 +211,211 @@ func (h *Histogram) Observe(labels map[string]string, values []float64) error {
 	for _, value := range values {
 		m.Observe(value)
 	}
+	h.touch(labels, time.Now())
 	return nil
 }
 
+// ObserveWithExemplar records a single float64 observation in the histogram
+// associated with the supplied labels, attaching the supplied exemplar labels
+// (e.g. a trace ID) to it. Returns an error if the exemplar labels exceed the
+// length permitted by OpenMetrics.
+func (h *Histogram) ObserveWithExemplar(labels map[string]string, value float64, exemplar map[string]string) error {
+	if err := ValidateExemplar(exemplar); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, err := h.metric.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	m.(prometheus.ExemplarObserver).ObserveWithExemplar(value, exemplar)
+	h.touch(labels, time.Now())
+	return nil
+}
+
+// ValidateExemplar returns an error if the total length (in runes) of the
+// supplied exemplar label names and values exceeds that permitted by
+// OpenMetrics.
+func ValidateExemplar(exemplar map[string]string) error {
+	n := 0
+	for k, v := range exemplar {
+		n += utf8.RuneCountInString(k) + utf8.RuneCountInString(v)
+	}
+	if n > prometheus.ExemplarMaxRunes {
+		return fmt.Errorf("exemplar labels contain %d runes, exceeding limit of %d", n, prometheus.ExemplarMaxRunes)
+	}
+	return nil
+}
+
+// GaugeT is an interface for "wrapped" (i.e. owned by the Manager) gauges.
+type GaugeT interface {
+	Set(labels map[string]string, value float64) error
+	Add(labels map[string]string, value float64) error
+	Delete(labels map[string]string) bool
+	Metric() *prometheus.GaugeVec
+	CreationTime() time.Time
+}
+
+// Gauge is a concrete impl of GaugeT.
+type Gauge struct {
+	seriesTracker
+	creationTime time.Time
+	metric       *prometheus.GaugeVec
+}
+
+// Metric returns a pointer to the underlying GaugeVec.
+func (g *Gauge) Metric() *prometheus.GaugeVec {
+	return g.metric
+}
+
+// CreationTime returns the creation time of this metric.
+func (g *Gauge) CreationTime() time.Time {
+	return g.creationTime
+}
+
+// Set sets the gauge associated with the supplied labels to value.
+func (g *Gauge) Set(labels map[string]string, value float64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, err := g.metric.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	m.Set(value)
+	g.touch(labels, time.Now())
+	return nil
+}
+
+// Add adds the supplied value (which may be negative) to the gauge associated
+// with the supplied labels.
+func (g *Gauge) Add(labels map[string]string, value float64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, err := g.metric.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	m.Add(value)
+	g.touch(labels, time.Now())
+	return nil
+}
+
+// Delete deletes the gauge associated with the supplied labels, such that it
+// is no longer exported. Returns true if it was present.
+func (g *Gauge) Delete(labels map[string]string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.remove(labels)
+}
+
+// SummaryT is an interface for "wrapped" (i.e. owned by the Manager)
+// summaries.
+type SummaryT interface {
+	Observe(labels map[string]string, values []float64) error
+	Metric() prometheus.ObserverVec
+	CreationTime() time.Time
+}
+
+// Summary is a concrete impl of SummaryT.
+type Summary struct {
+	seriesTracker
+	creationTime time.Time
+	// Note: As with Histogram, CurryWith returns an ObserverVec interface.
+	metric prometheus.ObserverVec
+}
+
+// Metric returns the underlying ObserverVec interface.
+func (s *Summary) Metric() prometheus.ObserverVec {
+	return s.metric
+}
+
+// CreationTime returns the creation time of this metric.
+func (s *Summary) CreationTime() time.Time {
+	return s.creationTime
+}
+
+// Observe records the slice of float64 observations in the summary associated
+// with the supplied labels.
+func (s *Summary) Observe(labels map[string]string, values []float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.metric.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		m.Observe(value)
+	}
+	s.touch(labels, time.Now())
+	return nil
+}
+
+// NativeHistogramOpts configures the native (sparse) buckets of histograms
+// created via AddNativeHistogram.
+type NativeHistogramOpts struct {
+	// BucketFactor is the maximum ratio between the upper and lower bounds
+	// of each bucket, and must be greater than 1 (e.g. 1.1).
+	BucketFactor float64
+	// MaxBucketNumber is the maximum number of populated buckets, beyond
+	// which resolution is reduced. Zero means no limit.
+	MaxBucketNumber uint32
+	// ZeroThreshold is the width of the bucket for observations close to
+	// zero. Zero means the Prometheus default is used.
+	ZeroThreshold float64
+}
+
+var (
+	// Quantile objectives (and associated absolute error) used with summary
+	// metrics when none are specified.
+	defaultObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+)
+
 // ManagerT is an interface representing a Manager (useful for mocks).
 type ManagerT interface {
 	AddCounter(name, help string, labelNames []string) error
 	AddHistogram(name, help string, labelNames []string, buckets []float64) error
+	AddNativeHistogram(name, help string, labelNames []string, buckets []float64, native NativeHistogramOpts) error
+	AddGauge(name, help string, labelNames []string) error
+	AddSummary(name, help string, labelNames []string, objectives map[float64]float64) error
 	GetCounter(name string) (CounterT, error)
 	GetHistogram(name string) (HistogramT, error)
+	GetGauge(name string) (GaugeT, error)
+	GetSummary(name string) (SummaryT, error)
 }
 
-// Manager is an abstraction for ownership and access to counter and histogram
-// metrics, intended to reduce boilerplate over managing Prometheus metrics
-// directly.
+// Manager is an abstraction for ownership and access to counter, histogram,
+// gauge, and summary metrics, intended to reduce boilerplate over managing
+// Prometheus metrics directly.
 type Manager struct {
+	mu           sync.RWMutex
+	registerer   prometheus.Registerer
+	gatherer     prometheus.Gatherer
 	commonLabels map[string]string
 	counters     map[string]*Counter
 	histograms   map[string]*Histogram
+	gauges       map[string]*Gauge
+	summaries    map[string]*Summary
 }
 
 // NewManager returns a Manager configured with the supplied "base" labels. All
 // metrics created by the manager will be curried so as to already have those
-// labels partially applied.
-func NewManager(commonLabels map[string]string) *Manager {
+// labels partially applied. Metrics are registered with the supplied
+// registerer, and the gatherer is used to serve them from Handler (typically,
+// both will be the same *prometheus.Registry). If either is nil, a new private
+// registry is created and used for both.
+func NewManager(commonLabels map[string]string, registerer prometheus.Registerer, gatherer prometheus.Gatherer) *Manager {
+	if registerer == nil || gatherer == nil {
+		r := prometheus.NewRegistry()
+		registerer, gatherer = r, r
+	}
 	m := &Manager{
+		registerer:   registerer,
+		gatherer:     gatherer,
 		counters:     make(map[string]*Counter),
 		histograms:   make(map[string]*Histogram),
+		gauges:       make(map[string]*Gauge),
+		summaries:    make(map[string]*Summary),
 		commonLabels: make(map[string]string),
 	}
 	for k, v := range commonLabels {
@@ -114,15 +424,22 @@ func NewManager(commonLabels map[string]string) *Manager {
 	return m
 }
 
-// AddCounter adds a counter metric with the supplied name, help string, and
-// field labels.
-func (m *Manager) AddCounter(name, help string, labelNames []string) error {
+// allLabelNames returns the sorted union of the common label names and the
+// supplied field label names.
+func (m *Manager) allLabelNames(labelNames []string) []string {
 	var allLabels sort.StringSlice
 	for k := range m.commonLabels {
 		allLabels = append(allLabels, k)
 	}
 	allLabels = append(allLabels, labelNames...)
 	allLabels.Sort()
+	return allLabels
+}
+
+// AddCounter adds a counter metric with the supplied name, help string, and
+// field labels.
+func (m *Manager) AddCounter(name, help string, labelNames []string) error {
+	allLabels := m.allLabelNames(labelNames)
 
 	metric := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -131,7 +448,7 @@ func (m *Manager) AddCounter(name, help string, labelNames []string) error {
 		},
 		allLabels,
 	)
-	if err := prometheus.Register(metric); err != nil {
+	if err := m.registerer.Register(metric); err != nil {
 		return err
 	}
 
@@ -140,9 +457,12 @@ func (m *Manager) AddCounter(name, help string, labelNames []string) error {
 		return err
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.counters[name] = &Counter{
-		creationTime: time.Now(),
-		metric:       partialMetric,
+		seriesTracker: newSeriesTracker(partialMetric.Delete, true),
+		creationTime:  time.Now(),
+		metric:        partialMetric,
 	}
 	return nil
 }
@@ -151,23 +471,115 @@ func (m *Manager) AddCounter(name, help string, labelNames []string) error {
 // field labels, and (optionally) buckets. Pass nil for buckets to use the
 // defaults.
 func (m *Manager) AddHistogram(name, help string, labelNames []string, buckets []float64) error {
-	var allLabels sort.StringSlice
-	for k := range m.commonLabels {
-		allLabels = append(allLabels, k)
+	opts := prometheus.HistogramOpts{
+		Name: name,
+		Help: help,
 	}
-	allLabels = append(allLabels, labelNames...)
-	allLabels.Sort()
+	if buckets != nil {
+		opts.Buckets = buckets
+	}
+	return m.addHistogram(opts, labelNames)
+}
 
+// AddNativeHistogram adds a histogram metric with the supplied name, help
+// string, and field labels, which will be exported both as a native (sparse)
+// histogram configured by the supplied opts and as a classic histogram with
+// the supplied buckets (for backwards compatibility with scrapers not
+// supporting the former). Pass nil for buckets to use the defaults.
+func (m *Manager) AddNativeHistogram(name, help string, labelNames []string, buckets []float64, native NativeHistogramOpts) error {
+	if native.BucketFactor <= 1 {
+		return fmt.Errorf("native histogram bucket factor must be greater than 1, got %v", native.BucketFactor)
+	}
 	opts := prometheus.HistogramOpts{
 		Name: name,
 		Help: help,
+		// Note: Unlike classic histograms, native histograms do not fall
+		// back to the default buckets when none are specified.
+		Buckets:                        prometheus.DefBuckets,
+		NativeHistogramBucketFactor:    native.BucketFactor,
+		NativeHistogramMaxBucketNumber: native.MaxBucketNumber,
+		NativeHistogramZeroThreshold:   native.ZeroThreshold,
 	}
 	if buckets != nil {
 		opts.Buckets = buckets
 	}
+	return m.addHistogram(opts, labelNames)
+}
+
+func (m *Manager) addHistogram(opts prometheus.HistogramOpts, labelNames []string) error {
+	allLabels := m.allLabelNames(labelNames)
 
 	metric := prometheus.NewHistogramVec(opts, allLabels)
-	if err := prometheus.Register(metric); err != nil {
+	if err := m.registerer.Register(metric); err != nil {
+		return err
+	}
+
+	partialMetric, err := metric.CurryWith(m.commonLabels)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.histograms[opts.Name] = &Histogram{
+		// Note: The curried ObserverVec does not expose Delete, so we use
+		// that of the underlying HistogramVec.
+		seriesTracker: newSeriesTracker(partialMetric.(*prometheus.HistogramVec).Delete, true),
+		creationTime:  time.Now(),
+		metric:        partialMetric,
+	}
+	return nil
+}
+
+// AddGauge adds a gauge metric with the supplied name, help string, and field
+// labels.
+func (m *Manager) AddGauge(name, help string, labelNames []string) error {
+	allLabels := m.allLabelNames(labelNames)
+
+	metric := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: name,
+			Help: help,
+		},
+		allLabels,
+	)
+	if err := m.registerer.Register(metric); err != nil {
+		return err
+	}
+
+	partialMetric, err := metric.CurryWith(m.commonLabels)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = &Gauge{
+		seriesTracker: newSeriesTracker(partialMetric.Delete, false),
+		creationTime:  time.Now(),
+		metric:        partialMetric,
+	}
+	return nil
+}
+
+// AddSummary adds a summary metric with the supplied name, help string, field
+// labels, and (optionally) quantile objectives (mapping quantile to absolute
+// error). Pass nil for objectives to use the defaults (median, 90th, and 99th
+// percentiles).
+func (m *Manager) AddSummary(name, help string, labelNames []string, objectives map[float64]float64) error {
+	allLabels := m.allLabelNames(labelNames)
+
+	opts := prometheus.SummaryOpts{
+		Name:       name,
+		Help:       help,
+		Objectives: defaultObjectives,
+	}
+	if objectives != nil {
+		opts.Objectives = objectives
+	}
+
+	metric := prometheus.NewSummaryVec(opts, allLabels)
+	if err := m.registerer.Register(metric); err != nil {
 		return err
 	}
 
@@ -176,9 +588,14 @@ func (m *Manager) AddHistogram(name, help string, labelNames []string, buckets [
 		return err
 	}
 
-	m.histograms[name] = &Histogram{
-		creationTime: time.Now(),
-		metric:       partialMetric,
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.summaries[name] = &Summary{
+		// Note: As with histograms, we use Delete from the underlying
+		// SummaryVec.
+		seriesTracker: newSeriesTracker(partialMetric.(*prometheus.SummaryVec).Delete, false),
+		creationTime:  time.Now(),
+		metric:        partialMetric,
 	}
 	return nil
 }
@@ -187,6 +604,8 @@ func (m *Manager) AddHistogram(name, help string, labelNames []string, buckets [
 // earlier call to AddCounter). Note that the returned counter will already
 // have the base labels supplied to the Manager partially applied.
 func (m *Manager) GetCounter(name string) (CounterT, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	c, ok := m.counters[name]
 	if !ok {
 		return nil, fmt.Errorf("unknown counter metric: %s", name)
@@ -198,6 +617,8 @@ func (m *Manager) GetCounter(name string) (CounterT, error) {
 // an earlier call to AddHistogram). Note that the returned histogram will
 // already have the base labels supplied to the Manager partially applied.
 func (m *Manager) GetHistogram(name string) (HistogramT, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	h, ok := m.histograms[name]
 	if !ok {
 		return nil, fmt.Errorf("unknown histogram metric: %s", name)
@@ -205,16 +626,184 @@ func (m *Manager) GetHistogram(name string) (HistogramT, error) {
 	return h, nil
 }
 
-// UnregisterAll unregisters all previously created metrics from prometheus.
+// GetGauge returns the gauge with the specified name (i.e. passed on an
+// earlier call to AddGauge). Note that the returned gauge will already have
+// the base labels supplied to the Manager partially applied.
+func (m *Manager) GetGauge(name string) (GaugeT, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.gauges[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown gauge metric: %s", name)
+	}
+	return g, nil
+}
+
+// GetSummary returns the summary with the specified name (i.e. passed on an
+// earlier call to AddSummary). Note that the returned summary will already
+// have the base labels supplied to the Manager partially applied.
+func (m *Manager) GetSummary(name string) (SummaryT, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.summaries[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown summary metric: %s", name)
+	}
+	return s, nil
+}
+
+// SetExpiry configures the metric with the specified name such
+// that label sets not updated for longer than ttl are deleted by subsequent
+// calls to ExpireStale. A ttl of zero (the default for all metrics) disables
+// expiry.
+//
+// Expiry requires a copy of each label set (along with its update time) to be
+// retained, and so memory use grows with the number of live label sets. For
+// gauges and summaries, label sets are only tracked while expiry is enabled,
+// and so those updated only prior to SetExpiry never expire. Counters and
+// histograms always track label sets, for their created timestamps.
+func (m *Manager) SetExpiry(name string, ttl time.Duration) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if c, ok := m.counters[name]; ok {
+		c.setTTL(ttl)
+	} else if h, ok := m.histograms[name]; ok {
+		h.setTTL(ttl)
+	} else if g, ok := m.gauges[name]; ok {
+		g.setTTL(ttl)
+	} else if s, ok := m.summaries[name]; ok {
+		s.setTTL(ttl)
+	} else {
+		return fmt.Errorf("unknown metric: %s", name)
+	}
+	return nil
+}
+
+// ExpireStale deletes all label sets (across metrics configured via
+// SetExpiry) which have not been updated within their respective ttl as of
+// now. Returns the number of label sets deleted.
+func (m *Manager) ExpireStale(now time.Time) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	expired := 0
+	for _, c := range m.counters {
+		expired += c.expire(now)
+	}
+	for _, h := range m.histograms {
+		expired += h.expire(now)
+	}
+	for _, g := range m.gauges {
+		expired += g.expire(now)
+	}
+	for _, s := range m.summaries {
+		expired += s.expire(now)
+	}
+	return expired
+}
+
+// HandlerOpts configures the HTTP handler returned by Manager.Handler.
+type HandlerOpts struct {
+	// GoCollector enables export of Go runtime metrics (go_*).
+	GoCollector bool
+	// ProcessCollector enables export of process metrics (process_*).
+	ProcessCollector bool
+}
+
+// createdGatherer wraps the Manager's gatherer, setting the created timestamp
+// of each counter and histogram series owned by the Manager to the creation
+// time of the corresponding label set.
+type createdGatherer struct {
+	m *Manager
+}
+
+func (g createdGatherer) Gather() ([]*dto.MetricFamily, error) {
+	// Note: Gather may return partial results alongside an error, which we
+	// still annotate.
+	mfs, err := g.m.gatherer.Gather()
+	g.m.mu.RLock()
+	defer g.m.mu.RUnlock()
+	for _, mf := range mfs {
+		var tracker *seriesTracker
+		if c, ok := g.m.counters[mf.GetName()]; ok {
+			tracker = &c.seriesTracker
+		} else if h, ok := g.m.histograms[mf.GetName()]; ok {
+			tracker = &h.seriesTracker
+		} else {
+			continue
+		}
+		for _, metric := range mf.Metric {
+			labels := make(map[string]string)
+			for _, lp := range metric.Label {
+				if _, ok := g.m.commonLabels[lp.GetName()]; !ok {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+			}
+			created, ok := tracker.SeriesCreationTime(labels)
+			if !ok {
+				continue
+			}
+			if metric.Counter != nil {
+				metric.Counter.CreatedTimestamp = timestamppb.New(created)
+			} else if metric.Histogram != nil {
+				metric.Histogram.CreatedTimestamp = timestamppb.New(created)
+			}
+		}
+	}
+	return mfs, err
+}
+
+// Handler returns an HTTP handler serving all metrics gathered from the
+// Manager's gatherer, along with (optionally) Go runtime and process metrics.
+// The latter are gathered from a separate registry, and are never registered
+// with the Manager's registerer.
+//
+// The OpenMetrics format is served to scrapers that request it, in which case
+// counter and histogram series owned by the Manager are exported along with
+// _created samples reflecting when their label set was first updated (or
+// re-created after expiry), allowing resets to be detected.
+func (m *Manager) Handler(opts HandlerOpts) http.Handler {
+	gatherers := prometheus.Gatherers{createdGatherer{m: m}}
+	if opts.GoCollector || opts.ProcessCollector {
+		r := prometheus.NewRegistry()
+		if opts.GoCollector {
+			r.MustRegister(collectors.NewGoCollector())
+		}
+		if opts.ProcessCollector {
+			r.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		}
+		gatherers = append(gatherers, r)
+	}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
+		// Note: Exemplars are only exposed in the OpenMetrics format,
+		// which will be used if requested by the scraper.
+		EnableOpenMetrics:                   true,
+		EnableOpenMetricsTextCreatedSamples: true,
+	})
+}
+
+// UnregisterAll unregisters all previously created metrics from the
+// Manager's registerer.
 func (m *Manager) UnregisterAll() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	var failed []string
 	for n, c := range m.counters {
-		if !prometheus.Unregister(c.metric) {
+		if !m.registerer.Unregister(c.metric) {
 			failed = append(failed, n)
 		}
 	}
 	for n, h := range m.histograms {
-		if !prometheus.Unregister(h.metric) {
+		if !m.registerer.Unregister(h.metric) {
+			failed = append(failed, n)
+		}
+	}
+	for n, g := range m.gauges {
+		if !m.registerer.Unregister(g.metric) {
+			failed = append(failed, n)
+		}
+	}
+	for n, s := range m.summaries {
+		if !m.registerer.Unregister(s.metric) {
 			failed = append(failed, n)
 		}
 	}
@@ -7,10 +7,14 @@
 package metrics_test
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/swfrench/nginx-log-exporter/internal/metrics"
 )
@@ -18,7 +22,7 @@ import (
 func TestCounterUpdates(t *testing.T) {
 	m := metrics.NewManager(map[string]string{
 		"foo": "bar",
-	})
+	}, nil, nil)
 
 	tMin := time.Now()
 	if err := m.AddCounter("foo_counter", "It counts things.", []string{
@@ -87,7 +91,7 @@ func TestCounterUpdates(t *testing.T) {
 func TestHistogramUpdates(t *testing.T) {
 	m := metrics.NewManager(map[string]string{
 		"foo": "bar",
-	})
+	}, nil, nil)
 
 	tMin := time.Now()
 	if err := m.AddHistogram("foo_dist", "It counts things, but in buckets.", []string{
@@ -182,7 +186,7 @@ func TestHistogramUpdates(t *testing.T) {
 func TestHistogramUpdatesWithCustomBuckets(t *testing.T) {
 	m := metrics.NewManager(map[string]string{
 		"foo": "bar",
-	})
+	}, nil, nil)
 
 	if err := m.AddHistogram("foo_dist", "It counts things, but in buckets.", []string{
 		"label_one",
@@ -255,3 +259,574 @@ func TestHistogramUpdatesWithCustomBuckets(t *testing.T) {
 		t.Fatalf("Failed to unregister one or more exported metrics: %v", err)
 	}
 }
+
+func TestHistogramExemplars(t *testing.T) {
+	m := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, nil, nil)
+
+	if err := m.AddHistogram("foo_dist", "It counts things, but in buckets.", []string{
+		"label_one",
+	}, []float64{1, 2}); err != nil {
+		t.Fatalf("Histogram creation failed: %v", err)
+	}
+
+	h, err := m.GetHistogram("foo_dist")
+	if err != nil {
+		t.Fatalf("Could not access newly created histogram: %v", err)
+	}
+
+	if err := h.ObserveWithExemplar(map[string]string{"label_one": "one"}, 1.5, map[string]string{
+		"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+	}); err != nil {
+		t.Fatalf("Failed to update histogram: %v", err)
+	}
+	if err := h.ObserveWithExemplar(map[string]string{"label_one": "one"}, 0.5, map[string]string{
+		"request_id": strings.Repeat("x", 200),
+	}); err == nil {
+		t.Fatalf("Expected ObserveWithExemplar to fail for oversized exemplar")
+	}
+
+	s := httptest.NewServer(m.Handler(metrics.HandlerOpts{}))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("Could not build metrics request: %v", err)
+	}
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Could not fetch metrics: %v", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Could not read metrics response: %v", err)
+	}
+	body := string(b)
+
+	if want := `foo_dist_bucket{foo="bar",label_one="one",le="2.0"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 1.5`; !strings.Contains(body, want) {
+		t.Errorf("Expected exemplar %q in OpenMetrics output:\n%s", want, body)
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Expected OpenMetrics output to end with # EOF:\n%s", body)
+	}
+}
+
+func TestCreatedTimestamps(t *testing.T) {
+	m := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, nil, nil)
+
+	if err := m.AddCounter("foo_count", "It counts things.", []string{
+		"label_one",
+	}); err != nil {
+		t.Fatalf("Counter creation failed: %v", err)
+	}
+	if err := m.AddHistogram("foo_dist", "It counts things, but in buckets.", []string{
+		"label_one",
+	}, []float64{1, 2}); err != nil {
+		t.Fatalf("Histogram creation failed: %v", err)
+	}
+
+	c, err := m.GetCounter("foo_count")
+	if err != nil {
+		t.Fatalf("Could not access newly created counter: %v", err)
+	}
+	h, err := m.GetHistogram("foo_dist")
+	if err != nil {
+		t.Fatalf("Could not access newly created histogram: %v", err)
+	}
+
+	labels := map[string]string{"label_one": "one"}
+	if _, ok := c.SeriesCreationTime(labels); ok {
+		t.Fatalf("Expected no creation time for label set never updated")
+	}
+
+	before := time.Now()
+	if err := c.Add(labels, 1); err != nil {
+		t.Fatalf("Failed to update counter: %v", err)
+	}
+	if err := h.Observe(labels, []float64{1.5}); err != nil {
+		t.Fatalf("Failed to update histogram: %v", err)
+	}
+	after := time.Now()
+
+	created, ok := c.SeriesCreationTime(labels)
+	if !ok {
+		t.Fatalf("Expected creation time for updated counter label set")
+	}
+	if created.Before(before) || created.After(after) {
+		t.Fatalf("Expected counter creation time in [%v, %v], got %v", before, after, created)
+	}
+
+	// Subsequent updates do not change the creation time.
+	if err := c.Add(labels, 1); err != nil {
+		t.Fatalf("Failed to update counter: %v", err)
+	}
+	if got, _ := c.SeriesCreationTime(labels); !got.Equal(created) {
+		t.Fatalf("Expected creation time %v to be unchanged by update, got %v", created, got)
+	}
+
+	s := httptest.NewServer(m.Handler(metrics.HandlerOpts{}))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("Could not build metrics request: %v", err)
+	}
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Could not fetch metrics: %v", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Could not read metrics response: %v", err)
+	}
+	body := string(b)
+
+	for _, want := range []string{
+		`foo_count_created{foo="bar",label_one="one"} `,
+		`foo_dist_created{foo="bar",label_one="one"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in OpenMetrics output:\n%s", want, body)
+		}
+	}
+
+	// Expired label sets are re-created on the next update.
+	if err := m.SetExpiry("foo_count", time.Minute); err != nil {
+		t.Fatalf("Could not configure expiry: %v", err)
+	}
+	if got, want := m.ExpireStale(time.Now().Add(time.Hour)), 1; got != want {
+		t.Fatalf("Expected %d expired label sets, got %d", want, got)
+	}
+	if _, ok := c.SeriesCreationTime(labels); ok {
+		t.Fatalf("Expected no creation time for expired label set")
+	}
+	if err := c.Add(labels, 1); err != nil {
+		t.Fatalf("Failed to update counter: %v", err)
+	}
+	if got, ok := c.SeriesCreationTime(labels); !ok || !got.After(created) {
+		t.Fatalf("Expected creation time after %v for re-created label set, got %v", created, got)
+	}
+}
+
+func TestNativeHistogramUpdates(t *testing.T) {
+	r := prometheus.NewRegistry()
+	m := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, r, r)
+
+	if err := m.AddNativeHistogram("foo_invalid_dist", "It counts things, but in buckets.", []string{
+		"label_one",
+	}, nil, metrics.NativeHistogramOpts{BucketFactor: 1}); err == nil {
+		t.Fatalf("Expected native histogram creation to fail for bucket factor <= 1")
+	}
+
+	if err := m.AddNativeHistogram("foo_dist", "It counts things, but in buckets.", []string{
+		"label_one",
+	}, []float64{1, 2, 4}, metrics.NativeHistogramOpts{
+		BucketFactor:    1.1,
+		MaxBucketNumber: 100,
+	}); err != nil {
+		t.Fatalf("Native histogram creation failed: %v", err)
+	}
+
+	h, err := m.GetHistogram("foo_dist")
+	if err != nil {
+		t.Fatalf("Could not access newly created histogram: %v", err)
+	}
+	if err := h.Observe(map[string]string{"label_one": "one"}, []float64{1, 3, 3.5}); err != nil {
+		t.Fatalf("Failed to update histogram: %v", err)
+	}
+
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	if len(families) != 1 || len(families[0].GetMetric()) != 1 {
+		t.Fatalf("Expected exactly one histogram series, got: %v", families)
+	}
+	hist := families[0].GetMetric()[0].GetHistogram()
+	if hist == nil {
+		t.Fatalf("Gathered metric is not a histogram: %v", families[0])
+	}
+
+	// Classic buckets are retained alongside the native histogram.
+	if got, want := len(hist.GetBucket()), 3; got != want {
+		t.Errorf("Got %d classic buckets, want %d", got, want)
+	}
+	if got, want := hist.GetSampleCount(), uint64(3); got != want {
+		t.Errorf("Got sample count %d, want %d", got, want)
+	}
+	if hist.Schema == nil || len(hist.GetPositiveSpan()) == 0 {
+		t.Errorf("Expected native histogram schema and positive spans, got: %v", hist)
+	}
+
+	if err := m.UnregisterAll(); err != nil {
+		t.Fatalf("Failed to unregister one or more exported metrics: %v", err)
+	}
+}
+
+func TestGaugeUpdates(t *testing.T) {
+	m := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, nil, nil)
+
+	tMin := time.Now()
+	if err := m.AddGauge("foo_gauge", "It measures things.", []string{
+		"label_one",
+	}); err != nil {
+		t.Fatalf("Gauge creation failed: %v", err)
+	}
+	tMax := time.Now()
+
+	g, err := m.GetGauge("foo_gauge")
+	if err != nil {
+		t.Fatalf("Could not access newly created gauge: %v", err)
+	}
+
+	if creationTime := g.CreationTime(); creationTime.Before(tMin) || creationTime.After(tMax) {
+		t.Fatalf("Reported gauge creation time of %v is not in [%v, %v]", creationTime, tMin, tMax)
+	}
+
+	if err := g.Set(map[string]string{"label_one": "one"}, 42); err != nil {
+		t.Fatalf("Failed to set gauge: %v", err)
+	}
+	if err := g.Add(map[string]string{"label_one": "one"}, -2); err != nil {
+		t.Fatalf("Failed to update gauge: %v", err)
+	}
+	if err := g.Add(map[string]string{"label_one": "two"}, 3); err != nil {
+		t.Fatalf("Failed to update gauge: %v", err)
+	}
+	if err := g.Set(map[string]string{"label_one": "three"}, 1); err != nil {
+		t.Fatalf("Failed to set gauge: %v", err)
+	}
+	if !g.Delete(map[string]string{"label_one": "three"}) {
+		t.Fatalf("Expected Delete to remove existing gauge")
+	}
+	if g.Delete(map[string]string{"label_one": "three"}) {
+		t.Fatalf("Expected Delete to report absent gauge")
+	}
+
+	const expected = `
+		# HELP foo_gauge It measures things.
+		# TYPE foo_gauge gauge
+		foo_gauge{foo="bar",label_one="one"} 40.0
+		foo_gauge{foo="bar",label_one="two"} 3.0
+	`
+
+	if err := testutil.CollectAndCompare(g.Metric(), strings.NewReader(expected)); err != nil {
+		t.Errorf("Collected metrics and / or metadata do not match expectation:\n%s", err)
+	}
+	if err := m.UnregisterAll(); err != nil {
+		t.Fatalf("Failed to unregister one or more exported metrics: %v", err)
+	}
+}
+
+func TestSummaryUpdates(t *testing.T) {
+	m := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, nil, nil)
+
+	tMin := time.Now()
+	if err := m.AddSummary("foo_summary", "It summarizes things.", []string{
+		"label_one",
+	}, map[float64]float64{0.5: 0.01}); err != nil {
+		t.Fatalf("Summary creation failed: %v", err)
+	}
+	tMax := time.Now()
+
+	s, err := m.GetSummary("foo_summary")
+	if err != nil {
+		t.Fatalf("Could not access newly created summary: %v", err)
+	}
+
+	if creationTime := s.CreationTime(); creationTime.Before(tMin) || creationTime.After(tMax) {
+		t.Fatalf("Reported summary creation time of %v is not in [%v, %v]", creationTime, tMin, tMax)
+	}
+
+	if err := s.Observe(map[string]string{"label_one": "one"}, []float64{1, 2, 3}); err != nil {
+		t.Fatalf("Failed to update summary: %v", err)
+	}
+	if err := s.Observe(map[string]string{"label_one": "two"}, []float64{4}); err != nil {
+		t.Fatalf("Failed to update summary: %v", err)
+	}
+
+	const expected = `
+		# HELP foo_summary It summarizes things.
+		# TYPE foo_summary summary
+		foo_summary{foo="bar",label_one="one",quantile="0.5"} 2.0
+		foo_summary_sum{foo="bar",label_one="one"} 6.0
+		foo_summary_count{foo="bar",label_one="one"} 3.0
+		foo_summary{foo="bar",label_one="two",quantile="0.5"} 4.0
+		foo_summary_sum{foo="bar",label_one="two"} 4.0
+		foo_summary_count{foo="bar",label_one="two"} 1.0
+	`
+
+	if err := testutil.CollectAndCompare(s.Metric(), strings.NewReader(expected)); err != nil {
+		t.Errorf("Collected metrics and / or metadata do not match expectation:\n%s", err)
+	}
+	if err := m.UnregisterAll(); err != nil {
+		t.Fatalf("Failed to unregister one or more exported metrics: %v", err)
+	}
+}
+
+func TestExpireStale(t *testing.T) {
+	m := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, nil, nil)
+
+	const ttl = time.Hour
+
+	if err := m.AddCounter("foo_counter", "It counts things.", []string{
+		"label_one",
+	}); err != nil {
+		t.Fatalf("Counter creation failed: %v", err)
+	}
+	if err := m.AddHistogram("foo_dist", "It counts things, but in buckets.", []string{
+		"label_one",
+	}, []float64{1, 2}); err != nil {
+		t.Fatalf("Histogram creation failed: %v", err)
+	}
+	if err := m.SetExpiry("foo_counter", ttl); err != nil {
+		t.Fatalf("Could not set counter expiry: %v", err)
+	}
+	if err := m.SetExpiry("foo_dist", ttl); err != nil {
+		t.Fatalf("Could not set histogram expiry: %v", err)
+	}
+	if err := m.SetExpiry("unknown_metric", ttl); err == nil {
+		t.Fatalf("Expected SetExpiry to fail for unknown metric")
+	}
+
+	c, err := m.GetCounter("foo_counter")
+	if err != nil {
+		t.Fatalf("Could not access newly created counter: %v", err)
+	}
+	h, err := m.GetHistogram("foo_dist")
+	if err != nil {
+		t.Fatalf("Could not access newly created histogram: %v", err)
+	}
+
+	if err := c.Add(map[string]string{"label_one": "old"}, 1); err != nil {
+		t.Fatalf("Failed to update counter: %v", err)
+	}
+	if err := h.Observe(map[string]string{"label_one": "old"}, []float64{1}); err != nil {
+		t.Fatalf("Failed to update histogram: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+	tMid := time.Now()
+	time.Sleep(time.Millisecond)
+
+	if err := c.Add(map[string]string{"label_one": "new"}, 2); err != nil {
+		t.Fatalf("Failed to update counter: %v", err)
+	}
+	if err := h.Observe(map[string]string{"label_one": "new"}, []float64{2}); err != nil {
+		t.Fatalf("Failed to update histogram: %v", err)
+	}
+
+	if n := m.ExpireStale(tMid); n != 0 {
+		t.Fatalf("Expected no label sets to expire before ttl elapsed, got %d", n)
+	}
+	if n := m.ExpireStale(tMid.Add(ttl)); n != 2 {
+		t.Fatalf("Expected 2 label sets to expire, got %d", n)
+	}
+
+	const expectedCounter = `
+		# HELP foo_counter It counts things.
+		# TYPE foo_counter counter
+		foo_counter{foo="bar",label_one="new"} 2.0
+	`
+	if err := testutil.CollectAndCompare(c.Metric(), strings.NewReader(expectedCounter)); err != nil {
+		t.Errorf("Collected metrics and / or metadata do not match expectation:\n%s", err)
+	}
+
+	const expectedHistogram = `
+		# HELP foo_dist It counts things, but in buckets.
+		# TYPE foo_dist histogram
+		foo_dist_bucket{foo="bar",label_one="new",le="1.0"} 0.0
+		foo_dist_bucket{foo="bar",label_one="new",le="2.0"} 1.0
+		foo_dist_bucket{foo="bar",label_one="new",le="+Inf"} 1.0
+		foo_dist_sum{foo="bar",label_one="new"} 2.0
+		foo_dist_count{foo="bar",label_one="new"} 1.0
+	`
+	if err := testutil.CollectAndCompare(h.Metric(), strings.NewReader(expectedHistogram)); err != nil {
+		t.Errorf("Collected metrics and / or metadata do not match expectation:\n%s", err)
+	}
+
+	if n := m.ExpireStale(time.Now().Add(2 * ttl)); n != 2 {
+		t.Fatalf("Expected 2 label sets to expire, got %d", n)
+	}
+
+	if err := m.UnregisterAll(); err != nil {
+		t.Fatalf("Failed to unregister one or more exported metrics: %v", err)
+	}
+}
+
+func TestExpireStaleOnlyTracksWithExpiry(t *testing.T) {
+	m := metrics.NewManager(nil, nil, nil)
+
+	const ttl = time.Hour
+
+	if err := m.AddGauge("foo_gauge", "It measures things.", []string{
+		"label_one",
+	}); err != nil {
+		t.Fatalf("Gauge creation failed: %v", err)
+	}
+	g, err := m.GetGauge("foo_gauge")
+	if err != nil {
+		t.Fatalf("Could not access newly created gauge: %v", err)
+	}
+
+	// Label sets updated while expiry is disabled are not tracked, and so
+	// never expire.
+	if err := g.Set(map[string]string{"label_one": "untracked"}, 1); err != nil {
+		t.Fatalf("Failed to set gauge: %v", err)
+	}
+	if err := m.SetExpiry("foo_gauge", ttl); err != nil {
+		t.Fatalf("Could not set gauge expiry: %v", err)
+	}
+	if err := g.Set(map[string]string{"label_one": "tracked"}, 2); err != nil {
+		t.Fatalf("Failed to set gauge: %v", err)
+	}
+
+	if n := m.ExpireStale(time.Now().Add(2 * ttl)); n != 1 {
+		t.Fatalf("Expected 1 label set to expire, got %d", n)
+	}
+
+	const expected = `
+		# HELP foo_gauge It measures things.
+		# TYPE foo_gauge gauge
+		foo_gauge{label_one="untracked"} 1.0
+	`
+	if err := testutil.CollectAndCompare(g.Metric(), strings.NewReader(expected)); err != nil {
+		t.Errorf("Collected metrics and / or metadata do not match expectation:\n%s", err)
+	}
+	if err := m.UnregisterAll(); err != nil {
+		t.Fatalf("Failed to unregister one or more exported metrics: %v", err)
+	}
+}
+
+func TestManagersDoNotCollide(t *testing.T) {
+	m1 := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, nil, nil)
+	m2 := metrics.NewManager(map[string]string{
+		"foo": "baz",
+	}, nil, nil)
+
+	for _, m := range []*metrics.Manager{m1, m2} {
+		if err := m.AddCounter("foo_counter", "It counts things.", []string{
+			"label_one",
+		}); err != nil {
+			t.Fatalf("Counter creation failed: %v", err)
+		}
+	}
+}
+
+func TestSharedRegistry(t *testing.T) {
+	r := prometheus.NewRegistry()
+	m := metrics.NewManager(map[string]string{
+		"foo": "bar",
+	}, r, r)
+
+	if err := m.AddCounter("foo_counter", "It counts things.", []string{
+		"label_one",
+	}); err != nil {
+		t.Fatalf("Counter creation failed: %v", err)
+	}
+
+	c, err := m.GetCounter("foo_counter")
+	if err != nil {
+		t.Fatalf("Could not access newly created counter: %v", err)
+	}
+	if err := c.Add(map[string]string{"label_one": "one"}, 1); err != nil {
+		t.Fatalf("Failed to update counter: %v", err)
+	}
+
+	const expected = `
+		# HELP foo_counter It counts things.
+		# TYPE foo_counter counter
+		foo_counter{foo="bar",label_one="one"} 1.0
+	`
+	if err := testutil.GatherAndCompare(r, strings.NewReader(expected), "foo_counter"); err != nil {
+		t.Errorf("Gathered metrics and / or metadata do not match expectation:\n%s", err)
+	}
+
+	if err := m.UnregisterAll(); err != nil {
+		t.Fatalf("Failed to unregister one or more exported metrics: %v", err)
+	}
+	if n, err := testutil.GatherAndCount(r); err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	} else if n != 0 {
+		t.Fatalf("Expected no metrics after UnregisterAll, got %d", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	for _, tc := range []struct {
+		opts        metrics.HandlerOpts
+		wantGo      bool
+		wantProcess bool
+	}{
+		{
+			opts: metrics.HandlerOpts{},
+		},
+		{
+			opts:   metrics.HandlerOpts{GoCollector: true},
+			wantGo: true,
+		},
+		{
+			opts:        metrics.HandlerOpts{GoCollector: true, ProcessCollector: true},
+			wantGo:      true,
+			wantProcess: true,
+		},
+	} {
+		m := metrics.NewManager(map[string]string{
+			"foo": "bar",
+		}, nil, nil)
+
+		if err := m.AddCounter("foo_counter", "It counts things.", []string{
+			"label_one",
+		}); err != nil {
+			t.Fatalf("Counter creation failed: %v", err)
+		}
+		c, err := m.GetCounter("foo_counter")
+		if err != nil {
+			t.Fatalf("Could not access newly created counter: %v", err)
+		}
+		if err := c.Add(map[string]string{"label_one": "one"}, 1); err != nil {
+			t.Fatalf("Failed to update counter: %v", err)
+		}
+
+		s := httptest.NewServer(m.Handler(tc.opts))
+		resp, err := s.Client().Get(s.URL)
+		if err != nil {
+			t.Fatalf("Could not fetch metrics: %v", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		s.Close()
+		if err != nil {
+			t.Fatalf("Could not read metrics response: %v", err)
+		}
+		body := string(b)
+
+		if !strings.Contains(body, `foo_counter{foo="bar",label_one="one"} 1`) {
+			t.Errorf("Expected foo_counter in handler output:\n%s", body)
+		}
+		// Note: The process collector only exports metrics on supported
+		// platforms, so we only check for its absence.
+		if got := strings.Contains(body, "go_goroutines"); got != tc.wantGo {
+			t.Errorf("Go runtime metrics exported = %v, want %v (opts: %+v)", got, tc.wantGo, tc.opts)
+		}
+		if !tc.wantProcess && strings.Contains(body, "process_") {
+			t.Errorf("Unexpected process metrics exported (opts: %+v)", tc.opts)
+		}
+	}
+}
@@ -49,6 +49,20 @@ func (mr *MockCounterTMockRecorder) Add(labels, value interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockCounterT)(nil).Add), labels, value)
 }
 
+// CreationTime mocks base method
+func (m *MockCounterT) CreationTime() time.Time {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreationTime")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// CreationTime indicates an expected call of CreationTime
+func (mr *MockCounterTMockRecorder) CreationTime() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreationTime", reflect.TypeOf((*MockCounterT)(nil).CreationTime))
+}
+
 // Metric mocks base method
 func (m *MockCounterT) Metric() *prometheus.CounterVec {
 	m.ctrl.T.Helper()
@@ -63,18 +77,19 @@ func (mr *MockCounterTMockRecorder) Metric() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Metric", reflect.TypeOf((*MockCounterT)(nil).Metric))
 }
 
-// CreationTime mocks base method
-func (m *MockCounterT) CreationTime() time.Time {
+// SeriesCreationTime mocks base method
+func (m *MockCounterT) SeriesCreationTime(labels map[string]string) (time.Time, bool) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreationTime")
+	ret := m.ctrl.Call(m, "SeriesCreationTime", labels)
 	ret0, _ := ret[0].(time.Time)
-	return ret0
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
 }
 
-// CreationTime indicates an expected call of CreationTime
-func (mr *MockCounterTMockRecorder) CreationTime() *gomock.Call {
+// SeriesCreationTime indicates an expected call of SeriesCreationTime
+func (mr *MockCounterTMockRecorder) SeriesCreationTime(labels interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreationTime", reflect.TypeOf((*MockCounterT)(nil).CreationTime))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SeriesCreationTime", reflect.TypeOf((*MockCounterT)(nil).SeriesCreationTime), labels)
 }
 
 // MockHistogramT is a mock of HistogramT interface
@@ -100,6 +115,34 @@ func (m *MockHistogramT) EXPECT() *MockHistogramTMockRecorder {
 	return m.recorder
 }
 
+// CreationTime mocks base method
+func (m *MockHistogramT) CreationTime() time.Time {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreationTime")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// CreationTime indicates an expected call of CreationTime
+func (mr *MockHistogramTMockRecorder) CreationTime() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreationTime", reflect.TypeOf((*MockHistogramT)(nil).CreationTime))
+}
+
+// Metric mocks base method
+func (m *MockHistogramT) Metric() prometheus.ObserverVec {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Metric")
+	ret0, _ := ret[0].(prometheus.ObserverVec)
+	return ret0
+}
+
+// Metric indicates an expected call of Metric
+func (mr *MockHistogramTMockRecorder) Metric() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Metric", reflect.TypeOf((*MockHistogramT)(nil).Metric))
+}
+
 // Observe mocks base method
 func (m *MockHistogramT) Observe(labels map[string]string, values []float64) error {
 	m.ctrl.T.Helper()
@@ -114,22 +157,153 @@ func (mr *MockHistogramTMockRecorder) Observe(labels, values interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Observe", reflect.TypeOf((*MockHistogramT)(nil).Observe), labels, values)
 }
 
+// ObserveWithExemplar mocks base method
+func (m *MockHistogramT) ObserveWithExemplar(labels map[string]string, value float64, exemplar map[string]string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ObserveWithExemplar", labels, value, exemplar)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ObserveWithExemplar indicates an expected call of ObserveWithExemplar
+func (mr *MockHistogramTMockRecorder) ObserveWithExemplar(labels, value, exemplar interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ObserveWithExemplar", reflect.TypeOf((*MockHistogramT)(nil).ObserveWithExemplar), labels, value, exemplar)
+}
+
+// SeriesCreationTime mocks base method
+func (m *MockHistogramT) SeriesCreationTime(labels map[string]string) (time.Time, bool) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SeriesCreationTime", labels)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// SeriesCreationTime indicates an expected call of SeriesCreationTime
+func (mr *MockHistogramTMockRecorder) SeriesCreationTime(labels interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SeriesCreationTime", reflect.TypeOf((*MockHistogramT)(nil).SeriesCreationTime), labels)
+}
+
+// MockGaugeT is a mock of GaugeT interface
+type MockGaugeT struct {
+	ctrl     *gomock.Controller
+	recorder *MockGaugeTMockRecorder
+}
+
+// MockGaugeTMockRecorder is the mock recorder for MockGaugeT
+type MockGaugeTMockRecorder struct {
+	mock *MockGaugeT
+}
+
+// NewMockGaugeT creates a new mock instance
+func NewMockGaugeT(ctrl *gomock.Controller) *MockGaugeT {
+	mock := &MockGaugeT{ctrl: ctrl}
+	mock.recorder = &MockGaugeTMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockGaugeT) EXPECT() *MockGaugeTMockRecorder {
+	return m.recorder
+}
+
+// Add mocks base method
+func (m *MockGaugeT) Add(labels map[string]string, value float64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Add", labels, value)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Add indicates an expected call of Add
+func (mr *MockGaugeTMockRecorder) Add(labels, value interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockGaugeT)(nil).Add), labels, value)
+}
+
+// CreationTime mocks base method
+func (m *MockGaugeT) CreationTime() time.Time {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreationTime")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// CreationTime indicates an expected call of CreationTime
+func (mr *MockGaugeTMockRecorder) CreationTime() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreationTime", reflect.TypeOf((*MockGaugeT)(nil).CreationTime))
+}
+
+// Delete mocks base method
+func (m *MockGaugeT) Delete(labels map[string]string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", labels)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete
+func (mr *MockGaugeTMockRecorder) Delete(labels interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockGaugeT)(nil).Delete), labels)
+}
+
 // Metric mocks base method
-func (m *MockHistogramT) Metric() prometheus.ObserverVec {
+func (m *MockGaugeT) Metric() *prometheus.GaugeVec {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Metric")
-	ret0, _ := ret[0].(prometheus.ObserverVec)
+	ret0, _ := ret[0].(*prometheus.GaugeVec)
 	return ret0
 }
 
 // Metric indicates an expected call of Metric
-func (mr *MockHistogramTMockRecorder) Metric() *gomock.Call {
+func (mr *MockGaugeTMockRecorder) Metric() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Metric", reflect.TypeOf((*MockHistogramT)(nil).Metric))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Metric", reflect.TypeOf((*MockGaugeT)(nil).Metric))
+}
+
+// Set mocks base method
+func (m *MockGaugeT) Set(labels map[string]string, value float64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Set", labels, value)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Set indicates an expected call of Set
+func (mr *MockGaugeTMockRecorder) Set(labels, value interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockGaugeT)(nil).Set), labels, value)
+}
+
+// MockSummaryT is a mock of SummaryT interface
+type MockSummaryT struct {
+	ctrl     *gomock.Controller
+	recorder *MockSummaryTMockRecorder
+}
+
+// MockSummaryTMockRecorder is the mock recorder for MockSummaryT
+type MockSummaryTMockRecorder struct {
+	mock *MockSummaryT
+}
+
+// NewMockSummaryT creates a new mock instance
+func NewMockSummaryT(ctrl *gomock.Controller) *MockSummaryT {
+	mock := &MockSummaryT{ctrl: ctrl}
+	mock.recorder = &MockSummaryTMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSummaryT) EXPECT() *MockSummaryTMockRecorder {
+	return m.recorder
 }
 
 // CreationTime mocks base method
-func (m *MockHistogramT) CreationTime() time.Time {
+func (m *MockSummaryT) CreationTime() time.Time {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "CreationTime")
 	ret0, _ := ret[0].(time.Time)
@@ -137,9 +311,37 @@ func (m *MockHistogramT) CreationTime() time.Time {
 }
 
 // CreationTime indicates an expected call of CreationTime
-func (mr *MockHistogramTMockRecorder) CreationTime() *gomock.Call {
+func (mr *MockSummaryTMockRecorder) CreationTime() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreationTime", reflect.TypeOf((*MockHistogramT)(nil).CreationTime))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreationTime", reflect.TypeOf((*MockSummaryT)(nil).CreationTime))
+}
+
+// Metric mocks base method
+func (m *MockSummaryT) Metric() prometheus.ObserverVec {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Metric")
+	ret0, _ := ret[0].(prometheus.ObserverVec)
+	return ret0
+}
+
+// Metric indicates an expected call of Metric
+func (mr *MockSummaryTMockRecorder) Metric() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Metric", reflect.TypeOf((*MockSummaryT)(nil).Metric))
+}
+
+// Observe mocks base method
+func (m *MockSummaryT) Observe(labels map[string]string, values []float64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Observe", labels, values)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Observe indicates an expected call of Observe
+func (mr *MockSummaryTMockRecorder) Observe(labels, values interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Observe", reflect.TypeOf((*MockSummaryT)(nil).Observe), labels, values)
 }
 
 // MockManagerT is a mock of ManagerT interface
@@ -179,6 +381,20 @@ func (mr *MockManagerTMockRecorder) AddCounter(name, help, labelNames interface{
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddCounter", reflect.TypeOf((*MockManagerT)(nil).AddCounter), name, help, labelNames)
 }
 
+// AddGauge mocks base method
+func (m *MockManagerT) AddGauge(name, help string, labelNames []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddGauge", name, help, labelNames)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddGauge indicates an expected call of AddGauge
+func (mr *MockManagerTMockRecorder) AddGauge(name, help, labelNames interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddGauge", reflect.TypeOf((*MockManagerT)(nil).AddGauge), name, help, labelNames)
+}
+
 // AddHistogram mocks base method
 func (m *MockManagerT) AddHistogram(name, help string, labelNames []string, buckets []float64) error {
 	m.ctrl.T.Helper()
@@ -193,6 +409,34 @@ func (mr *MockManagerTMockRecorder) AddHistogram(name, help, labelNames, buckets
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddHistogram", reflect.TypeOf((*MockManagerT)(nil).AddHistogram), name, help, labelNames, buckets)
 }
 
+// AddNativeHistogram mocks base method
+func (m *MockManagerT) AddNativeHistogram(name, help string, labelNames []string, buckets []float64, native metrics.NativeHistogramOpts) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddNativeHistogram", name, help, labelNames, buckets, native)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddNativeHistogram indicates an expected call of AddNativeHistogram
+func (mr *MockManagerTMockRecorder) AddNativeHistogram(name, help, labelNames, buckets, native interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddNativeHistogram", reflect.TypeOf((*MockManagerT)(nil).AddNativeHistogram), name, help, labelNames, buckets, native)
+}
+
+// AddSummary mocks base method
+func (m *MockManagerT) AddSummary(name, help string, labelNames []string, objectives map[float64]float64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddSummary", name, help, labelNames, objectives)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddSummary indicates an expected call of AddSummary
+func (mr *MockManagerTMockRecorder) AddSummary(name, help, labelNames, objectives interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSummary", reflect.TypeOf((*MockManagerT)(nil).AddSummary), name, help, labelNames, objectives)
+}
+
 // GetCounter mocks base method
 func (m *MockManagerT) GetCounter(name string) (metrics.CounterT, error) {
 	m.ctrl.T.Helper()
@@ -208,6 +452,21 @@ func (mr *MockManagerTMockRecorder) GetCounter(name interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCounter", reflect.TypeOf((*MockManagerT)(nil).GetCounter), name)
 }
 
+// GetGauge mocks base method
+func (m *MockManagerT) GetGauge(name string) (metrics.GaugeT, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetGauge", name)
+	ret0, _ := ret[0].(metrics.GaugeT)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetGauge indicates an expected call of GetGauge
+func (mr *MockManagerTMockRecorder) GetGauge(name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetGauge", reflect.TypeOf((*MockManagerT)(nil).GetGauge), name)
+}
+
 // GetHistogram mocks base method
 func (m *MockManagerT) GetHistogram(name string) (metrics.HistogramT, error) {
 	m.ctrl.T.Helper()
@@ -222,3 +481,18 @@ func (mr *MockManagerTMockRecorder) GetHistogram(name interface{}) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHistogram", reflect.TypeOf((*MockManagerT)(nil).GetHistogram), name)
 }
+
+// GetSummary mocks base method
+func (m *MockManagerT) GetSummary(name string) (metrics.SummaryT, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSummary", name)
+	ret0, _ := ret[0].(metrics.SummaryT)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSummary indicates an expected call of GetSummary
+func (mr *MockManagerTMockRecorder) GetSummary(name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSummary", reflect.TypeOf((*MockManagerT)(nil).GetSummary), name)
+}
@@ -0,0 +1,255 @@
+// Package openmetrics implements writing timestamped samples in the
+// OpenMetrics text format, e.g. for backfilling via
+// `promtool tsdb create-blocks-from openmetrics`.
+package openmetrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Family is a metric family and its samples, which may span many timestamps.
+type Family struct {
+	// Name is the family name, which for counters excludes the "_total"
+	// suffix.
+	Name string
+	// Type is the family type, e.g. "counter" or "histogram".
+	Type string
+	Help string
+	// Samples are written in order, and should be ordered by time for each
+	// series.
+	Samples []Sample
+}
+
+// Sample is a timestamped sample of a single series.
+type Sample struct {
+	// Name is the sample name, e.g. the family name with a "_total" or
+	// "_bucket" suffix.
+	Name   string
+	Labels map[string]string
+	Value  float64
+	Time   time.Time
+}
+
+// Writer accumulates families, writing them in the OpenMetrics text format on
+// Close. Since OpenMetrics does not permit the samples of different families
+// to be interleaved, the samples of each family are formatted as added and
+// buffered until Close, either in memory or (see NewTempFileWriter) in a
+// temporary file per family.
+type Writer struct {
+	w io.Writer
+	// tempDir is the directory in which families are buffered, if tempFiles
+	// is true.
+	tempDir   string
+	tempFiles bool
+	families  map[string]*familyBuffer
+	names     []string
+}
+
+// familyBuffer holds the formatted samples of a single family.
+type familyBuffer struct {
+	name string
+	typ  string
+	help string
+	// file is the temporary file to which samples are written, or nil if
+	// buffered in memory.
+	file     *os.File
+	unlinked bool
+	mem      bytes.Buffer
+	b        *bufio.Writer
+}
+
+// NewWriter returns a Writer writing to w, buffering families in memory.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:        w,
+		families: make(map[string]*familyBuffer),
+	}
+}
+
+// NewTempFileWriter returns a Writer writing to w, buffering each family in a
+// temporary file in dir (or the default directory for temporary files, if
+// empty) rather than in memory, e.g. for the samples of many windows.
+func NewTempFileWriter(w io.Writer, dir string) *Writer {
+	ow := NewWriter(w)
+	ow.tempDir = dir
+	ow.tempFiles = true
+	return ow
+}
+
+// Add adds the supplied families, appending samples to those of any family of
+// the same name previously added.
+func (w *Writer) Add(families ...Family) error {
+	for _, f := range families {
+		buf, ok := w.families[f.Name]
+		if !ok {
+			buf = &familyBuffer{
+				name: f.Name,
+				typ:  f.Type,
+				help: f.Help,
+			}
+			if w.tempFiles {
+				file, err := ioutil.TempFile(w.tempDir, ".family")
+				if err != nil {
+					return err
+				}
+				// The file is unlinked immediately where supported, such
+				// that it is removed even if Close is never called.
+				buf.unlinked = os.Remove(file.Name()) == nil
+				buf.file = file
+				buf.b = bufio.NewWriter(file)
+			} else {
+				buf.b = bufio.NewWriter(&buf.mem)
+			}
+			w.families[f.Name] = buf
+			w.names = append(w.names, f.Name)
+		}
+		for i := range f.Samples {
+			writeSample(buf.b, &f.Samples[i])
+		}
+	}
+	return nil
+}
+
+// WriteWindow adds the supplied families, such that a Writer may accumulate
+// the samples of many windows (e.g. to write a single file when backfilling).
+func (w *Writer) WriteWindow(end time.Time, families []Family) error {
+	return w.Add(families...)
+}
+
+// Close writes all families added, followed by the terminating "# EOF" line,
+// and removes any temporary files. Close does not close the underlying
+// io.Writer.
+func (w *Writer) Close() error {
+	defer func() {
+		for _, buf := range w.families {
+			if buf.file != nil {
+				buf.file.Close()
+				if !buf.unlinked {
+					os.Remove(buf.file.Name())
+				}
+			}
+		}
+	}()
+
+	b := bufio.NewWriter(w.w)
+	for _, name := range w.names {
+		buf := w.families[name]
+		fmt.Fprintf(b, "# TYPE %s %s\n", buf.name, buf.typ)
+		if buf.help != "" {
+			fmt.Fprintf(b, "# HELP %s %s\n", buf.name, escape(buf.help, false))
+		}
+		if err := buf.b.Flush(); err != nil {
+			return err
+		}
+		if buf.file == nil {
+			buf.mem.WriteTo(b)
+			continue
+		}
+		if _, err := buf.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(b, buf.file); err != nil {
+			return err
+		}
+	}
+	b.WriteString("# EOF\n")
+	return b.Flush()
+}
+
+// Write writes the supplied families to w, as in Writer.
+func Write(w io.Writer, families []Family) error {
+	ow := NewWriter(w)
+	if err := ow.Add(families...); err != nil {
+		return err
+	}
+	return ow.Close()
+}
+
+func writeSample(b *bufio.Writer, s *Sample) {
+	b.WriteString(s.Name)
+	if len(s.Labels) > 0 {
+		var keys []string
+		for k := range s.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", k, escape(s.Labels[k], true))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(b, " %s %s\n", FormatFloat(s.Value), formatTime(s.Time))
+}
+
+// escape escapes backslashes and newlines (and double quotes, if quoted) per
+// the OpenMetrics text format.
+func escape(s string, quoted bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quoted {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+// FormatFloat formats the supplied value per the OpenMetrics text format
+// (e.g. for use as a bucket "le" label value).
+func FormatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatTime formats the supplied time as seconds since the epoch.
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+}
+
+// DirSink writes families to a new OpenMetrics file in Dir for each call to
+// WriteWindow, named for the supplied time (e.g. "1700000000.om").
+type DirSink struct {
+	Dir string
+}
+
+// WriteWindow writes the supplied families to a file named for end. The file
+// is written atomically, such that readers never observe partial content.
+func (s *DirSink) WriteWindow(end time.Time, families []Family) error {
+	f, err := ioutil.TempFile(s.Dir, ".window")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := Write(f, families); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.Dir, fmt.Sprintf("%d.om", end.Unix())))
+}
@@ -0,0 +1,118 @@
+package openmetrics_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/openmetrics"
+)
+
+func TestWriter(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, tc := range []struct {
+		name      string
+		newWriter func(io.Writer) *openmetrics.Writer
+	}{
+		{"memory", openmetrics.NewWriter},
+		{"temp files", func(w io.Writer) *openmetrics.Writer { return openmetrics.NewTempFileWriter(w, tempDir) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testWriter(t, tc.newWriter)
+		})
+	}
+
+	files, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected temporary files to be removed, got: %v", files)
+	}
+}
+
+func testWriter(t *testing.T, newWriter func(io.Writer) *openmetrics.Writer) {
+	t0 := time.Unix(1700000000, 0)
+	t1 := time.Unix(1700000060, 500000000)
+
+	var b bytes.Buffer
+	w := newWriter(&b)
+	if err := w.Add(openmetrics.Family{
+		Name: "requests",
+		Type: "counter",
+		Help: "Total requests",
+		Samples: []openmetrics.Sample{
+			{Name: "requests_total", Labels: map[string]string{"status": "200", "path": "/a\"b"}, Value: 1, Time: t0},
+		},
+	}, openmetrics.Family{
+		Name: "latency",
+		Type: "histogram",
+		Samples: []openmetrics.Sample{
+			{Name: "latency_bucket", Labels: map[string]string{"le": openmetrics.FormatFloat(math.Inf(1))}, Value: 2, Time: t0},
+		},
+	}); err != nil {
+		t.Fatalf("Add() returned unexpected error: %v", err)
+	}
+	if err := w.Add(openmetrics.Family{
+		Name: "requests",
+		Type: "counter",
+		Help: "Total requests",
+		Samples: []openmetrics.Sample{
+			{Name: "requests_total", Labels: map[string]string{"status": "200", "path": "/a\"b"}, Value: 3, Time: t1},
+		},
+	}); err != nil {
+		t.Fatalf("Add() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	want := `# TYPE requests counter
+# HELP requests Total requests
+requests_total{path="/a\"b",status="200"} 1 1700000000
+requests_total{path="/a\"b",status="200"} 3 1700000060.5
+# TYPE latency histogram
+latency_bucket{le="+Inf"} 2 1700000000
+# EOF
+`
+	if got := b.String(); got != want {
+		t.Errorf("Unexpected output:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDirSink(t *testing.T) {
+	dir := t.TempDir()
+	end := time.Unix(1700000060, 0)
+
+	s := &openmetrics.DirSink{Dir: dir}
+	if err := s.WriteWindow(end, []openmetrics.Family{
+		{
+			Name:    "requests",
+			Type:    "counter",
+			Samples: []openmetrics.Sample{{Name: "requests_total", Value: 1, Time: end}},
+		},
+	}); err != nil {
+		t.Fatalf("WriteWindow() returned unexpected error: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != "1700000060.om" {
+		t.Fatalf("Expected a single file 1700000060.om, got: %v", files)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "1700000060.om"))
+	if err != nil {
+		t.Fatalf("Could not read window file: %v", err)
+	}
+	want := "# TYPE requests counter\nrequests_total 1 1700000060\n# EOF\n"
+	if got := string(b); got != want {
+		t.Errorf("Unexpected window file content:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
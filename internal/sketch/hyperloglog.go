@@ -0,0 +1,286 @@
+package sketch
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// Bounds on HyperLogLog precision (the number of index bits). The
+	// relative standard error of estimates is approximately
+	// 1.04 / sqrt(2^precision), e.g. 1.6% for precision 12.
+	MinPrecision = 4
+	MaxPrecision = 18
+)
+
+// hash64 returns a well-mixed 64-bit hash of the supplied value (FNV-1a,
+// followed by the SplitMix64 finalizer, since the low-order bits of FNV are
+// poorly distributed).
+func hash64(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// HyperLogLog estimates the number of distinct values added to it (Flajolet
+// et al.), using 2^precision bytes of state regardless of the number of
+// values. Values themselves are never retained.
+//
+// HyperLogLog is not safe for concurrent use.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty HyperLogLog sketch with the supplied
+// precision, which must be in [MinPrecision, MaxPrecision].
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, fmt.Errorf("precision must be in [%d, %d], got %d", MinPrecision, MaxPrecision, precision)
+	}
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}, nil
+}
+
+// Add adds the supplied value to the sketch.
+func (h *HyperLogLog) Add(value string) {
+	x := hash64(value)
+	index := x >> (64 - h.precision)
+	// Note: The sentinel bit bounds the rank at 64 - precision + 1.
+	w := x<<h.precision | 1<<(h.precision-1)
+	if rank := uint8(bits.LeadingZeros64(w)) + 1; rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Estimate returns the estimated number of distinct values added.
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+
+	// Small-range correction (linear counting).
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// Merge merges the supplied sketch into this one, such that the latter
+// estimates the number of distinct values added to either. Both must have the
+// same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.precision != other.precision {
+		return fmt.Errorf("cannot merge sketches of differing precision (%d and %d)", h.precision, other.precision)
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Reset discards all values added to the sketch.
+func (h *HyperLogLog) Reset() {
+	for i := range h.registers {
+		h.registers[i] = 0
+	}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 1+len(h.registers))
+	b = append(b, h.precision)
+	return append(b, h.registers...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (h *HyperLogLog) UnmarshalBinary(b []byte) error {
+	if len(b) < 1 {
+		return fmt.Errorf("empty HyperLogLog encoding")
+	}
+	precision := b[0]
+	if precision < MinPrecision || precision > MaxPrecision {
+		return fmt.Errorf("invalid HyperLogLog precision: %d", precision)
+	}
+	if want := 1 + (1 << precision); len(b) != want {
+		return fmt.Errorf("invalid HyperLogLog encoding length for precision %d: expected %d, got %d", precision, want, len(b))
+	}
+	h.precision = precision
+	h.registers = make([]uint8, 1<<precision)
+	copy(h.registers, b[1:])
+	return nil
+}
+
+// WindowedHyperLogLog estimates the number of distinct values added within a
+// rolling window. The window is divided into a fixed number of slots, each
+// backed by a HyperLogLog sketch, such that values expire with a granularity
+// of window / slots. Slots are aligned to multiples of their width since the
+// epoch, so that sketches may be persisted and restored across restarts.
+//
+// WindowedHyperLogLog is not safe for concurrent use.
+type WindowedHyperLogLog struct {
+	width     time.Duration
+	precision uint8
+	slots     []*HyperLogLog
+	epochs    []int64
+}
+
+// NewWindowedHyperLogLog returns an empty WindowedHyperLogLog covering the
+// supplied window with the supplied number of slots, each having the supplied
+// precision.
+func NewWindowedHyperLogLog(window time.Duration, slots int, precision uint8) (*WindowedHyperLogLog, error) {
+	if slots < 1 {
+		return nil, fmt.Errorf("number of slots must be positive, got %d", slots)
+	}
+	if window < time.Duration(slots) {
+		return nil, fmt.Errorf("window %v is too short for %d slots", window, slots)
+	}
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, fmt.Errorf("precision must be in [%d, %d], got %d", MinPrecision, MaxPrecision, precision)
+	}
+	return &WindowedHyperLogLog{
+		width:     window / time.Duration(slots),
+		precision: precision,
+		slots:     make([]*HyperLogLog, slots),
+		epochs:    make([]int64, slots),
+	}, nil
+}
+
+func (w *WindowedHyperLogLog) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(w.width)
+}
+
+// Add adds the supplied value, observed at time t, to the sketch. Values
+// observed at times older than the slot they map to (i.e. by at least one
+// window) are ignored.
+func (w *WindowedHyperLogLog) Add(value string, t time.Time) {
+	epoch := w.epoch(t)
+	i := int(epoch % int64(len(w.slots)))
+	if w.slots[i] == nil {
+		// Note: Precision has already been validated.
+		w.slots[i], _ = NewHyperLogLog(w.precision)
+		w.epochs[i] = epoch
+	} else if w.epochs[i] < epoch {
+		w.slots[i].Reset()
+		w.epochs[i] = epoch
+	} else if w.epochs[i] > epoch {
+		return
+	}
+	w.slots[i].Add(value)
+}
+
+// Estimate returns the estimated number of distinct values added within the
+// window ending at now. Values observed after now (e.g. due to clock skew) are
+// included.
+func (w *WindowedHyperLogLog) Estimate(now time.Time) uint64 {
+	epoch := w.epoch(now)
+	merged, _ := NewHyperLogLog(w.precision)
+	for i, slot := range w.slots {
+		if slot != nil && w.epochs[i] > epoch-int64(len(w.slots)) {
+			merged.Merge(slot)
+		}
+	}
+	return merged.Estimate()
+}
+
+// windowedState is the gob-encoded representation of a WindowedHyperLogLog.
+// Slots which have never been used are encoded as nil.
+type windowedState struct {
+	Width     time.Duration
+	Precision uint8
+	Slots     [][]byte
+	Epochs    []int64
+}
+
+// GobEncode implements gob.GobEncoder.
+func (w *WindowedHyperLogLog) GobEncode() ([]byte, error) {
+	state := &windowedState{
+		Width:     w.width,
+		Precision: w.precision,
+		Slots:     make([][]byte, len(w.slots)),
+		Epochs:    w.epochs,
+	}
+	for i, slot := range w.slots {
+		if slot != nil {
+			state.Slots[i], _ = slot.MarshalBinary()
+		}
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(state); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder.
+func (w *WindowedHyperLogLog) GobDecode(b []byte) error {
+	var state windowedState
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&state); err != nil {
+		return err
+	}
+	if state.Width <= 0 || len(state.Slots) == 0 || len(state.Slots) != len(state.Epochs) {
+		return fmt.Errorf("invalid windowed HyperLogLog encoding")
+	}
+	slots := make([]*HyperLogLog, len(state.Slots))
+	for i, encoded := range state.Slots {
+		if len(encoded) == 0 {
+			continue
+		}
+		slots[i] = &HyperLogLog{}
+		if err := slots[i].UnmarshalBinary(encoded); err != nil {
+			return err
+		}
+		if slots[i].precision != state.Precision {
+			return fmt.Errorf("invalid windowed HyperLogLog encoding: slot precision %d differs from %d", slots[i].precision, state.Precision)
+		}
+	}
+	w.width = state.Width
+	w.precision = state.Precision
+	w.slots = slots
+	w.epochs = state.Epochs
+	return nil
+}
+
+// Window returns the duration of the window covered by the sketch.
+func (w *WindowedHyperLogLog) Window() time.Duration {
+	return w.width * time.Duration(len(w.slots))
+}
+
+// Precision returns the precision of the sketch.
+func (w *WindowedHyperLogLog) Precision() uint8 {
+	return w.precision
+}
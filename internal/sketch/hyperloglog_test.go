@@ -0,0 +1,130 @@
+package sketch_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/sketch"
+)
+
+func newHyperLogLog(t *testing.T, precision uint8) *sketch.HyperLogLog {
+	h, err := sketch.NewHyperLogLog(precision)
+	if err != nil {
+		t.Fatalf("Could not create HyperLogLog: %v", err)
+	}
+	return h
+}
+
+func checkEstimate(t *testing.T, got uint64, want int, tolerance float64) {
+	if err := math.Abs(float64(got)-float64(want)) / float64(want); err > tolerance {
+		t.Errorf("Expected estimate within %v of %d, got %d", tolerance, want, got)
+	}
+}
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		h := newHyperLogLog(t, 12)
+		for i := 0; i < n; i++ {
+			// Duplicates should not affect the estimate.
+			h.Add(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+			h.Add(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		}
+		checkEstimate(t, h.Estimate(), n, 0.05)
+	}
+
+	if got := newHyperLogLog(t, 12).Estimate(); got != 0 {
+		t.Errorf("Expected zero estimate for empty sketch, got %d", got)
+	}
+}
+
+func TestHyperLogLogInvalidPrecision(t *testing.T) {
+	for _, precision := range []uint8{0, sketch.MinPrecision - 1, sketch.MaxPrecision + 1} {
+		if _, err := sketch.NewHyperLogLog(precision); err == nil {
+			t.Errorf("Expected NewHyperLogLog to fail for precision %d", precision)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a := newHyperLogLog(t, 12)
+	b := newHyperLogLog(t, 12)
+	for i := 0; i < 2000; i++ {
+		a.Add(fmt.Sprintf("user-%d", i))
+		b.Add(fmt.Sprintf("user-%d", i+1000))
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge returned unexpected error: %v", err)
+	}
+	checkEstimate(t, a.Estimate(), 3000, 0.05)
+
+	if err := a.Merge(newHyperLogLog(t, 10)); err == nil {
+		t.Errorf("Expected Merge to fail for differing precision")
+	}
+}
+
+func TestHyperLogLogMarshal(t *testing.T) {
+	h := newHyperLogLog(t, 10)
+	for i := 0; i < 500; i++ {
+		h.Add(fmt.Sprintf("user-%d", i))
+	}
+
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary returned unexpected error: %v", err)
+	}
+	var got sketch.HyperLogLog
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary returned unexpected error: %v", err)
+	}
+	if want, got := h.Estimate(), got.Estimate(); want != got {
+		t.Errorf("Expected estimate %d after round trip, got %d", want, got)
+	}
+
+	if err := got.UnmarshalBinary(b[:len(b)-1]); err == nil {
+		t.Errorf("Expected UnmarshalBinary to fail for truncated encoding")
+	}
+}
+
+func TestWindowedHyperLogLog(t *testing.T) {
+	w, err := sketch.NewWindowedHyperLogLog(time.Minute, 6, 12)
+	if err != nil {
+		t.Fatalf("Could not create WindowedHyperLogLog: %v", err)
+	}
+
+	start := time.Unix(1600000000, 0)
+	for i := 0; i < 100; i++ {
+		w.Add(fmt.Sprintf("early-%d", i), start)
+		w.Add(fmt.Sprintf("late-%d", i), start.Add(30*time.Second))
+	}
+	// Values predating the window are ignored.
+	w.Add("ancient", start.Add(-time.Hour))
+
+	checkEstimate(t, w.Estimate(start.Add(30*time.Second)), 200, 0.05)
+	// The early values expire after one window.
+	checkEstimate(t, w.Estimate(start.Add(80*time.Second)), 100, 0.05)
+	if got := w.Estimate(start.Add(time.Hour)); got != 0 {
+		t.Errorf("Expected zero estimate once all values expire, got %d", got)
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(w); err != nil {
+		t.Fatalf("Could not encode WindowedHyperLogLog: %v", err)
+	}
+	var got sketch.WindowedHyperLogLog
+	if err := gob.NewDecoder(&b).Decode(&got); err != nil {
+		t.Fatalf("Could not decode WindowedHyperLogLog: %v", err)
+	}
+	if want, got := w.Estimate(start.Add(30*time.Second)), got.Estimate(start.Add(30*time.Second)); want != got {
+		t.Errorf("Expected estimate %d after round trip, got %d", want, got)
+	}
+	if want, got := time.Minute, got.Window(); want != got {
+		t.Errorf("Expected window %v after round trip, got %v", want, got)
+	}
+	if want, got := w.Precision(), got.Precision(); want != got {
+		t.Errorf("Expected precision %d after round trip, got %d", want, got)
+	}
+}
@@ -0,0 +1,134 @@
+// Package sketch provides space-bounded approximate summaries of streams of
+// observations (e.g. log-derived keys).
+package sketch
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Counter is an approximate count of observations of a single key tracked by
+// a SpaceSaving sketch.
+type Counter struct {
+	Key string
+	// Count is an upper bound on the number of observations of Key.
+	Count uint64
+	// Error is the maximum amount by which Count overestimates the true
+	// number of observations of Key.
+	Error uint64
+	// Data is arbitrary caller-owned state associated with Key. It is reset
+	// to nil whenever the counter is reassigned to a new key.
+	Data interface{}
+
+	index int
+}
+
+// counterHeap is a min-heap of counters ordered by count.
+type counterHeap []*Counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	c := x.(*Counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[:n-1]
+	return c
+}
+
+// SpaceSaving implements the Space-Saving heavy-hitters algorithm (Metwally et
+// al.), tracking approximate counts of at most capacity distinct keys. Any key
+// observed more than N/capacity times (where N is the total number of
+// observations) is guaranteed to be tracked.
+//
+// SpaceSaving is not safe for concurrent use.
+type SpaceSaving struct {
+	capacity int
+	counters map[string]*Counter
+	heap     counterHeap
+}
+
+// NewSpaceSaving returns an empty SpaceSaving sketch tracking at most capacity
+// keys.
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SpaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*Counter),
+	}
+}
+
+// Add records an observation of the supplied key, returning the counter now
+// tracking it. If the sketch is at capacity and key is not already tracked,
+// the counter with the smallest count is reassigned to key.
+func (s *SpaceSaving) Add(key string) *Counter {
+	if c, ok := s.counters[key]; ok {
+		c.Count++
+		heap.Fix(&s.heap, c.index)
+		return c
+	}
+
+	if len(s.heap) < s.capacity {
+		c := &Counter{
+			Key:   key,
+			Count: 1,
+		}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+		return c
+	}
+
+	c := s.heap[0]
+	delete(s.counters, c.Key)
+	c.Key = key
+	c.Error = c.Count
+	c.Count++
+	c.Data = nil
+	s.counters[key] = c
+	heap.Fix(&s.heap, c.index)
+	return c
+}
+
+// Top returns (copies of) the n counters with the largest counts, in
+// descending order of count. Fewer are returned if fewer keys are tracked.
+func (s *SpaceSaving) Top(n int) []Counter {
+	var top []Counter
+	for _, c := range s.heap {
+		top = append(top, *c)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Len returns the number of keys currently tracked.
+func (s *SpaceSaving) Len() int {
+	return len(s.heap)
+}
+
+// Reset discards all tracked keys.
+func (s *SpaceSaving) Reset() {
+	s.counters = make(map[string]*Counter)
+	s.heap = nil
+}
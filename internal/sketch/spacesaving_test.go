@@ -0,0 +1,80 @@
+package sketch_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/swfrench/nginx-log-exporter/internal/sketch"
+)
+
+func TestSpaceSavingExact(t *testing.T) {
+	s := sketch.NewSpaceSaving(10)
+	for key, count := range map[string]int{"a": 5, "b": 3, "c": 1} {
+		for i := 0; i < count; i++ {
+			s.Add(key)
+		}
+	}
+
+	top := s.Top(2)
+	if len(top) != 2 {
+		t.Fatalf("Expected 2 counters, got: %v", top)
+	}
+	for i, want := range []sketch.Counter{
+		{Key: "a", Count: 5},
+		{Key: "b", Count: 3},
+	} {
+		if top[i].Key != want.Key || top[i].Count != want.Count || top[i].Error != 0 {
+			t.Errorf("Expected counter %d to be %+v, got %+v", i, want, top[i])
+		}
+	}
+
+	if got, want := len(s.Top(10)), 3; got != want {
+		t.Errorf("Expected %d counters, got %d", want, got)
+	}
+}
+
+func TestSpaceSavingHeavyHitters(t *testing.T) {
+	s := sketch.NewSpaceSaving(10)
+	// Interleave two heavy hitters with a long tail of distinct keys.
+	for i := 0; i < 1000; i++ {
+		s.Add("heavy")
+		if i%2 == 0 {
+			s.Add("medium")
+		}
+		s.Add(fmt.Sprintf("tail-%d", i))
+	}
+
+	if got, want := s.Len(), 10; got != want {
+		t.Fatalf("Expected sketch to track %d keys, got %d", want, got)
+	}
+
+	top := s.Top(2)
+	if len(top) != 2 || top[0].Key != "heavy" || top[1].Key != "medium" {
+		t.Fatalf("Expected heavy hitters [heavy medium], got: %+v", top)
+	}
+	for _, c := range top {
+		if c.Error > c.Count {
+			t.Errorf("Error exceeds count for %+v", c)
+		}
+	}
+	if top[0].Count < 1000 || top[0].Count-top[0].Error > 1000 {
+		t.Errorf("Expected count bounds for heavy to contain 1000, got %+v", top[0])
+	}
+}
+
+func TestSpaceSavingData(t *testing.T) {
+	s := sketch.NewSpaceSaving(1)
+	c := s.Add("a")
+	c.Data = "state"
+	if got := s.Add("a"); got.Data != "state" {
+		t.Errorf("Expected data to be retained, got %v", got.Data)
+	}
+	if got := s.Add("b"); got.Data != nil || got.Key != "b" || got.Count != 3 || got.Error != 2 {
+		t.Errorf("Expected reassigned counter with reset data, got %+v", got)
+	}
+
+	s.Reset()
+	if got := s.Len(); got != 0 {
+		t.Errorf("Expected empty sketch after Reset, got %d keys", got)
+	}
+}
@@ -0,0 +1,280 @@
+// Package status implements collection of metrics from the nginx stub_status
+// page (see ngx_http_stub_status_module).
+package status
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+)
+
+const (
+	// UpMetricName is the name of the metric reporting whether the last
+	// fetch of the stub_status page succeeded (1) or not (0).
+	UpMetricName = "nginx_up"
+	// ActiveConnectionsMetricName is the name of the metric reporting the
+	// current number of active client connections, including waiting
+	// connections.
+	ActiveConnectionsMetricName = "nginx_connections_active"
+	// ReadingConnectionsMetricName is the name of the metric reporting the
+	// current number of connections on which nginx is reading the request
+	// header.
+	ReadingConnectionsMetricName = "nginx_connections_reading"
+	// WritingConnectionsMetricName is the name of the metric reporting the
+	// current number of connections on which nginx is writing the response.
+	WritingConnectionsMetricName = "nginx_connections_writing"
+	// WaitingConnectionsMetricName is the name of the metric reporting the
+	// current number of idle client connections waiting for a request.
+	WaitingConnectionsMetricName = "nginx_connections_waiting"
+	// AcceptedConnectionsMetricName is the name of the metric reporting the
+	// total number of accepted client connections.
+	AcceptedConnectionsMetricName = "nginx_connections_accepted_total"
+	// HandledConnectionsMetricName is the name of the metric reporting the
+	// total number of handled client connections (which is less than the
+	// number accepted only if some resource limit was reached).
+	HandledConnectionsMetricName = "nginx_connections_handled_total"
+	// RequestsMetricName is the name of the metric reporting the total number
+	// of client requests.
+	RequestsMetricName = "nginx_http_requests_total"
+)
+
+var (
+	// Matches the stub_status page, capturing active connections, accepts,
+	// handled, requests, reading, writing, and waiting.
+	stubStatusRE = regexp.MustCompile(`^Active connections:\s*(\d+)\s+server accepts handled requests\s+(\d+)\s+(\d+)\s+(\d+)\s+Reading:\s*(\d+)\s+Writing:\s*(\d+)\s+Waiting:\s*(\d+)\s*$`)
+)
+
+// Status holds the values reported by the stub_status page.
+type Status struct {
+	Active   float64
+	Accepts  float64
+	Handled  float64
+	Requests float64
+	Reading  float64
+	Writing  float64
+	Waiting  float64
+}
+
+// Parse parses the content of the stub_status page, e.g.:
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+func Parse(b []byte) (*Status, error) {
+	m := stubStatusRE.FindSubmatch(b)
+	if m == nil {
+		return nil, fmt.Errorf("could not parse stub_status content: \"%s\"", string(b))
+	}
+	var values [7]float64
+	for i := range values {
+		v, err := strconv.ParseFloat(string(m[i+1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse stub_status value: %v", err)
+		}
+		values[i] = v
+	}
+	return &Status{
+		Active:   values[0],
+		Accepts:  values[1],
+		Handled:  values[2],
+		Requests: values[3],
+		Reading:  values[4],
+		Writing:  values[5],
+		Waiting:  values[6],
+	}, nil
+}
+
+// Collector implements periodic fetching of the stub_status page, exporting
+// the reported connection and request stats.
+type Collector struct {
+	Period   time.Duration
+	url      string
+	client   *http.Client
+	stop     chan bool
+	last     *Status
+	up       metrics.GaugeT
+	gauges   map[string]metrics.GaugeT
+	counters map[string]metrics.CounterT
+}
+
+// NewCollector returns a Collector fetching the stub_status page at the
+// supplied URL and exporting its stats to the supplied manager at the
+// specified period. The specific metrics exported by the Collector will be
+// created during init in NewCollector. Accepted, handled, and request counts
+// are exported as counters starting from zero at the first successful fetch.
+func NewCollector(period time.Duration, url string, manager metrics.ManagerT) (*Collector, error) {
+	c := &Collector{
+		Period: period,
+		url:    url,
+		client: &http.Client{
+			Timeout: period,
+		},
+		stop:     make(chan bool, 1),
+		gauges:   make(map[string]metrics.GaugeT),
+		counters: make(map[string]metrics.CounterT),
+	}
+
+	var err error
+
+	if err = manager.AddGauge(UpMetricName, "Whether the last fetch of the nginx stub_status page succeeded", nil); err != nil {
+		return nil, err
+	}
+	if c.up, err = manager.GetGauge(UpMetricName); err != nil {
+		return nil, err
+	}
+
+	for _, gauge := range []struct {
+		name string
+		help string
+	}{
+		{ActiveConnectionsMetricName, "Current number of active client connections"},
+		{ReadingConnectionsMetricName, "Current number of connections reading the request header"},
+		{WritingConnectionsMetricName, "Current number of connections writing the response"},
+		{WaitingConnectionsMetricName, "Current number of idle client connections waiting for a request"},
+	} {
+		if err = manager.AddGauge(gauge.name, gauge.help, nil); err != nil {
+			return nil, err
+		}
+		if c.gauges[gauge.name], err = manager.GetGauge(gauge.name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, counter := range []struct {
+		name string
+		help string
+	}{
+		{AcceptedConnectionsMetricName, "Total number of accepted client connections"},
+		{HandledConnectionsMetricName, "Total number of handled client connections"},
+		{RequestsMetricName, "Total number of client requests"},
+	} {
+		if err = manager.AddCounter(counter.name, counter.help, nil); err != nil {
+			return nil, err
+		}
+		if c.counters[counter.name], err = manager.GetCounter(counter.name); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// fetch fetches and parses the stub_status page.
+func (c *Collector) fetch() (*Status, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", c.url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// connectionGauges are the names of the gauges reporting current connections.
+var connectionGauges = []string{
+	ActiveConnectionsMetricName,
+	ReadingConnectionsMetricName,
+	WritingConnectionsMetricName,
+	WaitingConnectionsMetricName,
+}
+
+// export exports the supplied stats.
+func (c *Collector) export(s *Status) error {
+	labels := map[string]string{}
+	for name, value := range map[string]float64{
+		ActiveConnectionsMetricName:  s.Active,
+		ReadingConnectionsMetricName: s.Reading,
+		WritingConnectionsMetricName: s.Writing,
+		WaitingConnectionsMetricName: s.Waiting,
+	} {
+		if err := c.gauges[name].Set(labels, value); err != nil {
+			return err
+		}
+	}
+
+	var last Status
+	if c.last != nil {
+		last = *c.last
+	}
+	for _, counter := range []struct {
+		name  string
+		value float64
+		last  float64
+	}{
+		{AcceptedConnectionsMetricName, s.Accepts, last.Accepts},
+		{HandledConnectionsMetricName, s.Handled, last.Handled},
+		{RequestsMetricName, s.Requests, last.Requests},
+	} {
+		// Note: The first fetch establishes a baseline, while counts smaller
+		// than those last fetched indicate nginx has restarted (and hence
+		// counted from zero).
+		delta := 0.0
+		if c.last != nil {
+			if counter.value >= counter.last {
+				delta = counter.value - counter.last
+			} else {
+				delta = counter.value
+			}
+		}
+		if err := c.counters[counter.name].Add(labels, delta); err != nil {
+			return err
+		}
+	}
+
+	c.last = s
+	return nil
+}
+
+// Collect fetches the stub_status page and exports its stats once. Failure to
+// fetch or parse the page is logged and reported via UpMetricName (with the
+// current connection gauges deleted, rather than reporting stale values),
+// while failure to export metrics is returned.
+func (c *Collector) Collect() error {
+	labels := map[string]string{}
+	s, err := c.fetch()
+	if err != nil {
+		log.Printf("Could not fetch stub_status: %v", err)
+		for _, name := range connectionGauges {
+			c.gauges[name].Delete(labels)
+		}
+		return c.up.Set(labels, 0)
+	}
+	if err := c.export(s); err != nil {
+		return err
+	}
+	return c.up.Set(labels, 1)
+}
+
+// Run performs periodic collection. It will only return on error or if Stop
+// is called.
+func (c *Collector) Run() error {
+	for {
+		select {
+		case <-time.After(c.Period):
+		case <-c.stop:
+			return nil
+		}
+		if err := c.Collect(); err != nil {
+			return fmt.Errorf("could not export stub_status stats: %v", err)
+		}
+	}
+}
+
+// Stop signals that collection should cease in Run and the latter should
+// return (e.g. if Run is blocking in another goroutine).
+func (c *Collector) Stop() {
+	c.stop <- true
+}
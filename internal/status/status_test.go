@@ -0,0 +1,145 @@
+package status_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/swfrench/nginx-log-exporter/internal/metrics/mock_metrics"
+	"github.com/swfrench/nginx-log-exporter/internal/status"
+)
+
+const testStatus = `Active connections: 291 
+server accepts handled requests
+ 16630948 16630946 31070465 
+Reading: 6 Writing: 179 Waiting: 106 
+`
+
+func TestParse(t *testing.T) {
+	s, err := status.Parse([]byte(testStatus))
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	want := status.Status{
+		Active:   291,
+		Accepts:  16630948,
+		Handled:  16630946,
+		Requests: 31070465,
+		Reading:  6,
+		Writing:  179,
+		Waiting:  106,
+	}
+	if *s != want {
+		t.Errorf("Expected Parse to return %+v, got %+v", want, *s)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"Active connections: 291\n",
+		"Active connections: 291\nserver accepts handled requests\n 1 2\nReading: 6 Writing: 179 Waiting: 106\n",
+		"<html><body>Not Found</body></html>",
+	} {
+		if s, err := status.Parse([]byte(content)); err == nil {
+			t.Errorf("Expected Parse to fail for content %q, got: %+v", content, s)
+		}
+	}
+}
+
+var (
+	gaugeNames = []string{
+		status.UpMetricName,
+		status.ActiveConnectionsMetricName,
+		status.ReadingConnectionsMetricName,
+		status.WritingConnectionsMetricName,
+		status.WaitingConnectionsMetricName,
+	}
+	counterNames = []string{
+		status.AcceptedConnectionsMetricName,
+		status.HandledConnectionsMetricName,
+		status.RequestsMetricName,
+	}
+)
+
+func mockInit(ctrl *gomock.Controller) (*mock_metrics.MockManagerT, map[string]*mock_metrics.MockGaugeT, map[string]*mock_metrics.MockCounterT) {
+	m := mock_metrics.NewMockManagerT(ctrl)
+	gauges := make(map[string]*mock_metrics.MockGaugeT)
+	counters := make(map[string]*mock_metrics.MockCounterT)
+	for _, name := range gaugeNames {
+		gauges[name] = mock_metrics.NewMockGaugeT(ctrl)
+		m.EXPECT().AddGauge(name, gomock.Any(), gomock.Nil()).Return(nil)
+		m.EXPECT().GetGauge(name).Return(gauges[name], nil)
+	}
+	for _, name := range counterNames {
+		counters[name] = mock_metrics.NewMockCounterT(ctrl)
+		m.EXPECT().AddCounter(name, gomock.Any(), gomock.Nil()).Return(nil)
+		m.EXPECT().GetCounter(name).Return(counters[name], nil)
+	}
+	return m, gauges, counters
+}
+
+func TestCollector(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	responses := []struct {
+		code    int
+		content string
+	}{
+		{http.StatusOK, testStatus},
+		{http.StatusOK, "Active connections: 10\nserver accepts handled requests\n 16630958 16630956 31070565\nReading: 1 Writing: 2 Waiting: 7\n"},
+		{http.StatusNotFound, "Not Found"},
+		// Counts lower than those last fetched follow an nginx restart.
+		{http.StatusOK, "Active connections: 1\nserver accepts handled requests\n 5 5 8\nReading: 0 Writing: 1 Waiting: 0\n"},
+	}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := responses[fetches]
+		fetches++
+		w.WriteHeader(response.code)
+		fmt.Fprint(w, response.content)
+	}))
+	defer server.Close()
+
+	manager, gauges, counters := mockInit(ctrl)
+
+	c, err := status.NewCollector(time.Second, server.URL, manager)
+	if err != nil {
+		t.Fatalf("Could not build new collector: %v", err)
+	}
+
+	labels := map[string]string{}
+	up := gauges[status.UpMetricName]
+	for i, expected := range []struct {
+		up       float64
+		gauges   []float64
+		counters []float64
+	}{
+		// The first fetch establishes a baseline for counters.
+		{1, []float64{291, 6, 179, 106}, []float64{0, 0, 0}},
+		{1, []float64{10, 1, 2, 7}, []float64{10, 10, 100}},
+		// Failed fetches delete the (stale) connection gauges.
+		{0, nil, nil},
+		{1, []float64{1, 0, 1, 0}, []float64{5, 5, 8}},
+	} {
+		up.EXPECT().Set(labels, expected.up).Return(nil)
+		for j, value := range expected.gauges {
+			gauges[gaugeNames[j+1]].EXPECT().Set(labels, value).Return(nil)
+		}
+		if expected.up == 0 {
+			for _, name := range gaugeNames[1:] {
+				gauges[name].EXPECT().Delete(labels).Return(true)
+			}
+		}
+		for j, value := range expected.counters {
+			counters[counterNames[j]].EXPECT().Add(labels, value).Return(nil)
+		}
+		if err := c.Collect(); err != nil {
+			t.Fatalf("Collect %d returned unexpected error: %v", i, err)
+		}
+	}
+}
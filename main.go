@@ -3,19 +3,22 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"log/syslog"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/swfrench/nginx-log-exporter/internal/consumer"
 	"github.com/swfrench/nginx-log-exporter/internal/file"
 	"github.com/swfrench/nginx-log-exporter/internal/metrics"
+	"github.com/swfrench/nginx-log-exporter/internal/openmetrics"
+	"github.com/swfrench/nginx-log-exporter/internal/status"
 
 	"cloud.google.com/go/compute/metadata"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -25,16 +28,120 @@ var (
 
 	accessLogFormat = flag.String("access_log_format", "JSON", "Format of log lines in the access log. Supported: JSON (see README) and CLF.")
 
+	streamLogPath = flag.String("stream_log_path", "", "If set, path to an nginx stream (TCP / UDP proxy) access log in JSON format (see README), from which session metrics are exported.")
+
+	errorLogPath = flag.String("error_log_path", "", "If set, path to the nginx error log, from which message counts by level and event class (see README) are exported.")
+
+	errorLogEventsPath = flag.String("error_log_events_path", "", "If set, path to a JSON file of error log classification rules (see README), evaluated before the built-in rules for -error_log_path.")
+
+	stubStatusURL = flag.String("stub_status_url", "", "If set, URL of the nginx stub_status page (e.g. http://127.0.0.1/nginx_status), from which connection and request stats are exported (see README).")
+
+	stubStatusPeriod = flag.Duration("stub_status_period", 15*time.Second, "Period between fetches of -stub_status_url.")
+
 	logPollingPeriod = flag.Duration("log_polling_period", 30*time.Second, "Period between checks for new log lines.")
 
 	rotationCheckPeriod = flag.Duration("rotation_check_period", time.Minute, "Idle period between log rotation checks.")
 
+	exportGoMetrics = flag.Bool("export_go_metrics", true, "If true, export Go runtime metrics (go_*) alongside log-derived metrics.")
+
+	exportProcessMetrics = flag.Bool("export_process_metrics", true, "If true, export process metrics (process_*) alongside log-derived metrics.")
+
 	useSyslog = flag.Bool("use_syslog", false, "If true, emit info logs to syslog.")
 
 	useMetadataServiceLabels = flag.Bool("use_metadata_service_labels", false, "If true, use the GCE instance metadata service to fetch \"instance_id\" and \"zone\" labels, which will be applied to all metrics.")
 
 	customLabels = flag.String("custom_labels", "", "A comma-separated, key=value list of additional labels to apply to all metrics.")
 
+	seriesTTLs = flag.String("series_ttls", "", "A comma-separated, metric=duration list of metrics for which label sets not updated within the given duration (e.g. nginx_http_response_detailed_total=1h) will be deleted. Metrics not listed never expire.")
+
+	seriesExpiryPeriod = flag.Duration("series_expiry_period", time.Minute, "Period between checks for stale label sets (see -series_ttls).")
+
+	nativeHistograms = flag.Bool("native_histograms", false, "If true, export response duration and size distributions as native (sparse) histograms, in addition to classic buckets. Native histograms are only exposed to scrapers negotiating the protobuf exposition format.")
+
+	nativeHistogramBucketFactor = flag.Float64("native_histogram_bucket_factor", 1.1, "Maximum ratio between the bounds of adjacent native histogram buckets (must be greater than 1).")
+
+	nativeHistogramMaxBuckets = flag.Uint("native_histogram_max_buckets", 160, "Maximum number of populated native histogram buckets, beyond which resolution is reduced (0 for no limit).")
+
+	nativeHistogramZeroThreshold = flag.Float64("native_histogram_zero_threshold", 0, "Width of the native histogram zero bucket (0 for the Prometheus default).")
+
+	histogramBuckets = flag.String("histogram_buckets", "", "A semicolon-separated, metric=buckets list of bucket layouts overriding the defaults for histogram metrics. Buckets may be an explicit comma-separated list of upper bounds (e.g. 0.1,0.5,1), linear:start,width,count, or exponential:start,factor,count.")
+
+	exemplarField = flag.String("exemplar_field", "", "If set, the name of a log field (JSON format only) whose value is attached as an exemplar to response duration observations, e.g. request_id or http_traceparent (W3C traceparent values are exported as trace_id and span_id). Exemplars are exposed via the OpenMetrics format.")
+
+	sloConfigPath = flag.String("slo_config_path", "", "If set, path to a JSON file defining SLOs (see README) against which requests are evaluated, exporting good / bad event and Apdex counts per SLO.")
+
+	topClients = flag.Int("top_clients", 0, "If positive, the number of clients issuing the most requests in each -top_clients_window to export (0 disables).")
+
+	topClientsCapacity = flag.Int("top_clients_capacity", 0, "Number of distinct clients tracked when identifying top clients (0 for 10 times -top_clients). Larger values improve accuracy at the cost of memory.")
+
+	topClientsField = flag.String("top_clients_field", "remote_addr", "Log field identifying clients for -top_clients. For CLF, only remote_addr is supported. For lists of addresses (e.g. http_x_forwarded_for), the first is used.")
+
+	topClientsWindow = flag.Duration("top_clients_window", time.Minute, "Period over which requests are counted for -top_clients.")
+
+	topClientsIPv4Prefix = flag.Int("top_clients_ipv4_prefix", 0, "If positive, the prefix length to which IPv4 client addresses are truncated for -top_clients (e.g. 24).")
+
+	topClientsIPv6Prefix = flag.Int("top_clients_ipv6_prefix", 0, "If positive, the prefix length to which IPv6 client addresses are truncated for -top_clients (e.g. 64).")
+
+	topPathsCapacity = flag.Int("top_paths_capacity", 0, "If positive, the number of most frequently requested (normalized) paths to track, served as JSON at /top_paths (0 disables). Useful for choosing -monitored_paths.")
+
+	uniqueVisitors = flag.Bool("unique_visitors", false, "If true, export estimated numbers of distinct visitors over rolling windows (see README), using HyperLogLog sketches.")
+
+	uniqueVisitorsField = flag.String("unique_visitors_field", "remote_addr", "Log field identifying visitors for -unique_visitors, e.g. remote_addr or a hashed user ID field. For CLF, only remote_addr is supported.")
+
+	uniqueVisitorsDimensions = flag.String("unique_visitors_dimensions", "", "A comma-separated list of log fields (e.g. host) by which visitors are counted separately for -unique_visitors. The special dimension \"path\" denotes the normalized request path.")
+
+	uniqueVisitorsWindows = flag.String("unique_visitors_windows", "1m,1h,24h", "A comma-separated list of rolling windows over which visitors are counted for -unique_visitors.")
+
+	uniqueVisitorsStatePath = flag.String("unique_visitors_state_path", "", "If set, path to a file to which -unique_visitors sketches are persisted, so that estimates survive restarts.")
+
+	agentClass = flag.Bool("agent_class", false, "If true, classify user agents (e.g. crawler, library, mobile; see README), exported as an \"agent_class\" label on the response count metrics.")
+
+	agentClassField = flag.String("agent_class_field", "http_user_agent", "Log field containing the user agent for -agent_class. For CLF, the user agent is available when the combined log format is used.")
+
+	agentClassRulesPath = flag.String("agent_class_rules_path", "", "If set, path to a JSON file of user agent classification rules (see README) used in place of the built-in rules for -agent_class. The file is reloaded when modified.")
+
+	geoIPDatabases = flag.String("geoip_databases", "", "A comma-separated list of MaxMind (MMDB) database paths, e.g. GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb. If set, client country and / or ASN labels (see README) are added to the metrics listed in -geoip_metrics. Databases are reloaded when modified.")
+
+	geoIPLabels = flag.String("geoip_labels", "country,asn", "A comma-separated list of labels added for -geoip_databases. Supported: country and asn.")
+
+	geoIPMetrics = flag.String("geoip_metrics", "nginx_http_response_total", "A comma-separated list of metrics to which -geoip_labels are added, any of the HTTP response, SLO, protocol, limit, and connection metrics.")
+
+	geoIPForwardedField = flag.String("geoip_forwarded_field", "", "If set, a log field (JSON format only) containing forwarded client addresses (e.g. http_x_forwarded_for), consulted for -geoip_databases lookups when remote_addr is in -geoip_trusted_proxies.")
+
+	geoIPTrustedProxies = flag.String("geoip_trusted_proxies", "", "A comma-separated list of CIDR networks of proxies trusted to forward client addresses via -geoip_forwarded_field.")
+
+	httpProtocols = flag.Bool("http_protocols", false, "If true, export request counts by HTTP protocol version (e.g. HTTP/1.1), as logged in the request line.")
+
+	httpProtocolsAllowlist = flag.String("http_protocols_allowlist", "", "A comma-separated list of HTTP protocol versions exported verbatim by -http_protocols, with others exported as \"other\". Defaults to HTTP/0.9 through HTTP/3.0.")
+
+	tlsProtocols = flag.Bool("tls_protocols", false, "If true, export request counts by TLS protocol version, read from -tls_protocols_field (JSON format only).")
+
+	tlsProtocolsField = flag.String("tls_protocols_field", "ssl_protocol", "Log field containing the TLS protocol version (e.g. as logged via $ssl_protocol) for -tls_protocols.")
+
+	tlsProtocolsAllowlist = flag.String("tls_protocols_allowlist", "", "A comma-separated list of TLS protocol versions exported verbatim by -tls_protocols, with others exported as \"other\". Defaults to SSLv3 through TLSv1.3.")
+
+	tlsCiphers = flag.Bool("tls_ciphers", false, "If true, export request counts by TLS cipher suite, read from -tls_ciphers_field (JSON format only).")
+
+	tlsCiphersField = flag.String("tls_ciphers_field", "ssl_cipher", "Log field containing the TLS cipher suite (e.g. as logged via $ssl_cipher) for -tls_ciphers.")
+
+	tlsCiphersAllowlist = flag.String("tls_ciphers_allowlist", "", "A comma-separated list of TLS cipher suites exported verbatim by -tls_ciphers, with others exported as \"other\". Defaults to common TLS 1.2 and 1.3 cipher suites (see README).")
+
+	connections = flag.Bool("connections", false, "If true, export connection reuse (keepalive) metrics derived from the connection and connection_requests log fields (JSON format only; see README).")
+
+	connectionsIdleTimeout = flag.Duration("connections_idle_timeout", 75*time.Second, "Period without requests after which a connection is considered closed for -connections. Should be at least nginx's keepalive_timeout.")
+
+	limits = flag.Bool("limits", false, "If true, export counts of requests delayed or rejected by limit_req or limit_conn, read from the limit_req_status and limit_conn_status log fields (JSON format only; see README).")
+
+	limitsServerField = flag.String("limits_server_field", "server_name", "Log field identifying the server (e.g. as logged via $server_name) for -limits.")
+
+	windowOutputDir = flag.String("window_output_dir", "", "If set, path to a directory to which response metrics aggregated into fixed windows by logged timestamp are written as timestamped OpenMetrics files, one per window (see README).")
+
+	windowWidth = flag.Duration("window_width", time.Minute, "Width of each window for -window_output_dir.")
+
+	windowAllowedLateness = flag.Duration("window_allowed_lateness", 0, "Period following the end of each window during which late lines are still aggregated for -window_output_dir, after which the window is written and later lines are dropped.")
+
+	labelConfigPath = flag.String("label_config_path", "", "If set, path to a JSON file defining additional labels (see README) extracted from query parameters or log fields and added to response, SLO, protocol, limit, connection, or stream metrics.")
+
 	monitoredPaths = flag.String("monitored_paths", "", "A comma-separated list of paths for which response metrics will be exported at path/method granularity. Paths are matched verbatim to the start of the first non-path expression (query string, fragment, etc.). Elements must be non-empty and contain no whitespace.")
 )
 
@@ -70,6 +177,177 @@ func parseMonitoredPaths() ([]string, error) {
 	return paths, nil
 }
 
+func parseSeriesTTLs() (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	if len(*seriesTTLs) > 0 {
+		for _, elem := range strings.Split(*seriesTTLs, ",") {
+			pair := strings.Split(elem, "=")
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("could not parse metric=duration pair: %v", elem)
+			}
+			ttl, err := time.ParseDuration(pair[1])
+			if err != nil {
+				return nil, fmt.Errorf("could not parse duration for %s: %v", pair[0], err)
+			} else if ttl <= 0 {
+				return nil, fmt.Errorf("duration for %s must be positive", pair[0])
+			}
+			ttls[pair[0]] = ttl
+		}
+	}
+
+	return ttls, nil
+}
+
+func parseHistogramBuckets() (map[string][]float64, error) {
+	buckets := make(map[string][]float64)
+
+	if len(*histogramBuckets) > 0 {
+		for _, elem := range strings.Split(*histogramBuckets, ";") {
+			pair := strings.SplitN(elem, "=", 2)
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("could not parse metric=buckets pair: %v", elem)
+			}
+			b, err := metrics.ParseBuckets(pair[1])
+			if err != nil {
+				return nil, fmt.Errorf("could not parse buckets for %s: %v", pair[0], err)
+			}
+			buckets[pair[0]] = b
+		}
+	}
+
+	return buckets, nil
+}
+
+func parseUniqueVisitorsOptions() (*consumer.UniqueVisitorsOptions, error) {
+	opts := &consumer.UniqueVisitorsOptions{
+		Field:     *uniqueVisitorsField,
+		StatePath: *uniqueVisitorsStatePath,
+	}
+
+	if len(*uniqueVisitorsDimensions) > 0 {
+		opts.Dimensions = strings.Split(*uniqueVisitorsDimensions, ",")
+	}
+
+	if len(*uniqueVisitorsWindows) > 0 {
+		for _, elem := range strings.Split(*uniqueVisitorsWindows, ",") {
+			window, err := time.ParseDuration(elem)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse window: %v", err)
+			}
+			opts.Windows = append(opts.Windows, window)
+		}
+	}
+
+	return opts, nil
+}
+
+func parseGeoIPOptions() (*consumer.GeoIPOptions, error) {
+	opts := &consumer.GeoIPOptions{
+		Databases:      strings.Split(*geoIPDatabases, ","),
+		ForwardedField: *geoIPForwardedField,
+	}
+
+	if len(*geoIPLabels) > 0 {
+		opts.Labels = strings.Split(*geoIPLabels, ",")
+	}
+
+	if len(*geoIPMetrics) > 0 {
+		opts.Families = strings.Split(*geoIPMetrics, ",")
+	}
+
+	if len(*geoIPTrustedProxies) > 0 {
+		for _, elem := range strings.Split(*geoIPTrustedProxies, ",") {
+			_, network, err := net.ParseCIDR(elem)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse trusted proxy network: %v", err)
+			}
+			opts.TrustedProxies = append(opts.TrustedProxies, network)
+		}
+	}
+
+	return opts, nil
+}
+
+// protocolDimensionOptions returns options for a protocol dimension with the
+// supplied log field and comma-separated allowlist (either of which may be
+// empty).
+func protocolDimensionOptions(field, allowlist string) *consumer.ProtocolDimensionOptions {
+	opts := &consumer.ProtocolDimensionOptions{
+		Field: field,
+	}
+
+	if len(allowlist) > 0 {
+		opts.Allowed = strings.Split(allowlist, ",")
+	}
+
+	return opts
+}
+
+func loadSLOs() ([]consumer.SLO, error) {
+	if len(*sloConfigPath) == 0 {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(*sloConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return consumer.ParseSLOs(b)
+}
+
+func loadErrorEventRules() ([]consumer.ErrorEventRule, error) {
+	if len(*errorLogEventsPath) == 0 {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(*errorLogEventsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return consumer.ParseErrorEventRules(b)
+}
+
+func loadLabelExtractions() ([]consumer.LabelExtraction, error) {
+	if len(*labelConfigPath) == 0 {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(*labelConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return consumer.ParseLabelExtractions(b)
+}
+
+// addResponseLabelOptions configures the options adding labels to the HTTP
+// request metrics (extracted labels, agent classes, and GeoIP labels).
+func addResponseLabelOptions(opts *consumer.Options) error {
+	extractions, err := loadLabelExtractions()
+	if err != nil {
+		return fmt.Errorf("could not load label config: %v", err)
+	}
+	opts.LabelExtractions = extractions
+
+	if *agentClass {
+		opts.AgentClass = &consumer.AgentClassOptions{
+			Field:     *agentClassField,
+			RulesPath: *agentClassRulesPath,
+		}
+	}
+
+	if len(*geoIPDatabases) > 0 {
+		if opts.GeoIP, err = parseGeoIPOptions(); err != nil {
+			return fmt.Errorf("could not parse GeoIP options: %v", err)
+		}
+	}
+
+	return nil
+}
+
 func getLabelsFromMetadataService() (map[string]string, error) {
 	if !metadata.OnGCE() {
 		return nil, fmt.Errorf("metadata service is unavailable when not on GCE")
@@ -92,6 +370,17 @@ func getLabelsFromMetadataService() (map[string]string, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			backfill(os.Args[2:])
+			return
+		case "analyze":
+			analyze(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 
 	if *useSyslog {
@@ -127,20 +416,216 @@ func main() {
 		log.Fatalf("Could not parse monitored paths: %v", err)
 	}
 
+	ttls, err := parseSeriesTTLs()
+	if err != nil {
+		log.Fatalf("Could not parse series ttls: %v", err)
+	}
+
 	log.Printf("Creating metrics manager for with base labels: %v", labels)
 
-	m := metrics.NewManager(labels)
+	m := metrics.NewManager(labels, nil, nil)
+
+	buckets, err := parseHistogramBuckets()
+	if err != nil {
+		log.Fatalf("Could not parse histogram buckets: %v", err)
+	}
+
+	// Note: Buckets for stream metrics are configured on the stream log
+	// consumer only.
+	streamBuckets := make(map[string][]float64)
+	if b, ok := buckets[consumer.StreamSessionDurationMetricName]; ok {
+		if len(*streamLogPath) == 0 {
+			log.Fatalf("Buckets configured for metric %s which is not enabled (see -stream_log_path)", consumer.StreamSessionDurationMetricName)
+		}
+		streamBuckets[consumer.StreamSessionDurationMetricName] = b
+		delete(buckets, consumer.StreamSessionDurationMetricName)
+	}
+
+	slos, err := loadSLOs()
+	if err != nil {
+		log.Fatalf("Could not load SLO config: %v", err)
+	}
+
+	opts := consumer.Options{
+		Buckets:       buckets,
+		ExemplarField: *exemplarField,
+		SLOs:          slos,
+	}
+
+	if err := addResponseLabelOptions(&opts); err != nil {
+		log.Fatalf("Could not configure response labels: %v", err)
+	}
+
+	if *topClients > 0 {
+		opts.TopClients = &consumer.TopClientsOptions{
+			N:             *topClients,
+			Capacity:      *topClientsCapacity,
+			Field:         *topClientsField,
+			Window:        *topClientsWindow,
+			IPv4PrefixLen: *topClientsIPv4Prefix,
+			IPv6PrefixLen: *topClientsIPv6Prefix,
+		}
+	}
+
+	if *topPathsCapacity > 0 {
+		opts.TopPaths = &consumer.TopPathsOptions{
+			Capacity: *topPathsCapacity,
+		}
+	}
+
+	if *uniqueVisitors {
+		if opts.UniqueVisitors, err = parseUniqueVisitorsOptions(); err != nil {
+			log.Fatalf("Could not parse unique visitors options: %v", err)
+		}
+	}
+
+	if *httpProtocols {
+		opts.HTTPProtocols = protocolDimensionOptions("", *httpProtocolsAllowlist)
+	}
+
+	if *tlsProtocols {
+		opts.TLSProtocols = protocolDimensionOptions(*tlsProtocolsField, *tlsProtocolsAllowlist)
+	}
+
+	if *tlsCiphers {
+		opts.TLSCiphers = protocolDimensionOptions(*tlsCiphersField, *tlsCiphersAllowlist)
+	}
+
+	if *connections {
+		opts.Connections = &consumer.ConnectionsOptions{
+			IdleTimeout: *connectionsIdleTimeout,
+		}
+	}
+
+	if *limits {
+		opts.Limits = &consumer.LimitsOptions{
+			ServerField: *limitsServerField,
+		}
+	}
+
+	if *windowOutputDir != "" {
+		opts.Windows = &consumer.WindowOptions{
+			Width:           *windowWidth,
+			AllowedLateness: *windowAllowedLateness,
+			Sink:            &openmetrics.DirSink{Dir: *windowOutputDir},
+		}
+	}
+
+	if *nativeHistograms {
+		opts.NativeHistograms = &metrics.NativeHistogramOpts{
+			BucketFactor:    *nativeHistogramBucketFactor,
+			MaxBucketNumber: uint32(*nativeHistogramMaxBuckets),
+			ZeroThreshold:   *nativeHistogramZeroThreshold,
+		}
+	}
+
+	c, err := consumer.NewConsumer(*logPollingPeriod, t, m, paths, *accessLogFormat, opts)
+	if err != nil {
+		log.Fatalf("Could not create consumer: %v", err)
+	}
+
+	// Additional logs, consumed alongside the access log.
+	var others []*consumer.Consumer
+	var otherPaths []string
+
+	if len(*streamLogPath) > 0 {
+		st, err := file.NewTailer(*streamLogPath, *rotationCheckPeriod)
+		if err != nil {
+			log.Fatalf("Could not create tailer for %s: %v", *streamLogPath, err)
+		}
+
+		sc, err := consumer.NewConsumer(*logPollingPeriod, st, m, nil, consumer.StreamFormat, consumer.Options{
+			NativeHistograms: opts.NativeHistograms,
+			Buckets:          streamBuckets,
+			ExporterMetrics:  c.ExporterMetrics(),
+			LabelExtractions: opts.LabelExtractions,
+		})
+		if err != nil {
+			log.Fatalf("Could not create stream log consumer: %v", err)
+		}
+		others = append(others, sc)
+		otherPaths = append(otherPaths, *streamLogPath)
+	}
+
+	if len(*errorLogPath) > 0 {
+		rules, err := loadErrorEventRules()
+		if err != nil {
+			log.Fatalf("Could not load error event rules: %v", err)
+		}
+
+		et, err := file.NewTailer(*errorLogPath, *rotationCheckPeriod)
+		if err != nil {
+			log.Fatalf("Could not create tailer for %s: %v", *errorLogPath, err)
+		}
+
+		ec, err := consumer.NewConsumer(*logPollingPeriod, et, m, nil, consumer.ErrorLogFormat, consumer.Options{
+			ErrorEvents:     rules,
+			ExporterMetrics: c.ExporterMetrics(),
+		})
+		if err != nil {
+			log.Fatalf("Could not create error log consumer: %v", err)
+		}
+		others = append(others, ec)
+		otherPaths = append(otherPaths, *errorLogPath)
+	}
+
+	for name, ttl := range ttls {
+		if err := m.SetExpiry(name, ttl); err != nil {
+			log.Fatalf("Could not configure expiry for %s: %v", name, err)
+		}
+	}
+
+	if len(ttls) > 0 {
+		log.Printf("Starting stale series expiry with ttls: %v", ttls)
+
+		go func() {
+			for range time.Tick(*seriesExpiryPeriod) {
+				if n := m.ExpireStale(time.Now()); n > 0 {
+					log.Printf("Expired %d stale label sets", n)
+				}
+			}
+		}()
+	}
 
 	log.Printf("Starting prometheus exporter at %s", *exportAddress)
 
+	// All handlers are registered before serving begins.
+	http.Handle("/metrics", m.Handler(metrics.HandlerOpts{
+		GoCollector:      *exportGoMetrics,
+		ProcessCollector: *exportProcessMetrics,
+	}))
+	if h := c.TopPathsHandler(); h != nil {
+		http.Handle("/top_paths", h)
+	}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
 		log.Fatal(http.ListenAndServe(*exportAddress, nil))
 	}()
 
-	c, err := consumer.NewConsumer(*logPollingPeriod, t, m, paths, *accessLogFormat)
-	if err != nil {
-		log.Fatalf("Could not create consumer: %v", err)
+	if len(*stubStatusURL) > 0 {
+		sc, err := status.NewCollector(*stubStatusPeriod, *stubStatusURL, m)
+		if err != nil {
+			log.Fatalf("Could not create stub_status collector: %v", err)
+		}
+
+		log.Printf("Starting stub_status collector for %s", *stubStatusURL)
+
+		go func() {
+			if err := sc.Run(); err != nil {
+				log.Fatalf("Failure collecting stub_status: %v", err)
+			}
+		}()
+	}
+
+	for i := range others {
+		other, path := others[i], otherPaths[i]
+
+		log.Printf("Starting consumer for %s", path)
+
+		go func() {
+			if err := other.Run(); err != nil {
+				log.Fatalf("Failure consuming logs from %s: %v", path, err)
+			}
+		}()
 	}
 
 	log.Printf("Starting consumer for %s", *accessLogPath)